@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const _LINUX_CAPABILITY_VERSION_3 = 0x20080522
+
+type kCapHeader struct {
+	version        uint32
+	pid            int32
+}
+
+type kCapData struct {
+	effective      uint32
+	permitted      uint32
+	inheritable    uint32
+}
+
+// read capability set of process from /proc
+func readCapabilities(field string) (kCapSet, error) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, field + ":") {
+			continue
+		}
+
+		caps, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, field + ":")), 16, 64)
+		if err != nil {
+			return 0, err
+		}
+		return kCapSet(caps), nil
+	}
+
+	return 0, ErrUnsupportedSystem
+}
+
+// get effective capabilities of process
+func getCapabilities() (kCapSet, error) {
+	return readCapabilities("CapEff")
+}
+
+// drop all capabilities but the kept ones from every thread of process
+func dropCapabilities(keep kCapSet) error {
+	permitted, err := readCapabilities("CapPrm")
+	if err != nil {
+		return err
+	}
+	keep &= permitted
+
+	hdr := kCapHeader{version: _LINUX_CAPABILITY_VERSION_3}
+	data := [2]kCapData{
+		{effective: uint32(keep), permitted: uint32(keep)},
+		{effective: uint32(keep >> 32), permitted: uint32(keep >> 32)},
+	}
+
+	// capabilities are per thread, so all threads of runtime have to be changed
+	_, _, errno := syscall.AllThreadsSyscall(syscall.SYS_CAPSET,
+		uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0)
+	if errno == syscall.ENOTSUP {
+		return fmt.Errorf("%v, capabilities can be dropped only if built with CGO_ENABLED=0", errno)
+	}
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
@@ -26,12 +26,11 @@
 package main
 
 import (
- 	"io"
- 	"net"
- 	"sync"
- 	"fmt"
-	"encoding/binary"
-	"errors"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -42,8 +41,10 @@ const (
 
 // kaohi command listener struct
 type KaohiCmdListener struct {
-	listener *net.TCPListener
-	srv      *CmdServer
+	listeners []deadlineListener
+	srv       *CmdServer
+	retired   []*CmdServer // servers which keep connections of previous listeners
+	listening int32        // set while the listeners accept connections
 }
 
 // global variable for command listener
@@ -57,72 +58,17 @@ type CmdConfig struct {
 type CmdServer struct {
 	config    *CmdConfig         // server configuration
 	callback  ConnCallback       // message callbacks in connection
-	protocol  CmdProtocol        // customize packet protocol
+	protocol  *CmdProtocol       // customize packet protocol
 	exitChan  chan struct{}      // notify all goroutines to shutdown
+	stopChan  chan struct{}      // notify listeners to stop accepting
 	waitGroup *sync.WaitGroup    // wait for all goroutines
 }
 
-type CmdPacket struct {
-	buff []byte
-}
-
-func (this *CmdPacket) Serialize() []byte {
-	return this.buff
-}
-
-func (this *CmdPacket) GetLength() uint32 {
-	return binary.BigEndian.Uint32(this.buff[0:4])
-}
-
-func (this *CmdPacket) GetBody() []byte {
-	return this.buff[4:]
-}
-
-func NewEchoPacket(buff []byte, hasLengthField bool) (p *CmdPacket) {
-	if hasLengthField {
-		p.buff = buff
-
-	} else {
-		p.buff = make([]byte, 4+len(buff))
-		binary.BigEndian.PutUint32(p.buff[0:4], uint32(len(buff)))
-		copy(p.buff[4:], buff)
-	}
-
-	return p
-}
-
-type CmdProtocol struct {
-}
-
-func (this *CmdProtocol) ReadPacket(conn *net.TCPConn) (*CmdPacket, error) {
-	var (
-		lengthBytes []byte = make([]byte, 4)
-		length      uint32
-	)
-
-	// read length
-	if _, err := io.ReadFull(conn, lengthBytes); err != nil {
-		return nil, err
-	}
-	if length = binary.BigEndian.Uint32(lengthBytes); length > 1024 {
-		return nil, errors.New("the size of packet is larger than the limit")
-	}
-
-	buff := make([]byte, 4+length)
-	copy(buff[0:4], lengthBytes)
-
-	// read body ( buff = lengthBytes + body )
-	if _, err := io.ReadFull(conn, buff[4:]); err != nil {
-		return nil, err
-	}
-
-	return NewEchoPacket(buff, true), nil
-}
-
 // Conn exposes a set of callbacks for the various events that occur on a connection
 type Conn struct {
 	srv               *CmdServer
-	conn              *net.TCPConn      // the raw connection
+	conn              net.Conn          // the raw connection
+	stream            *CmdStream        // packet stream over the connection
 	extraData         interface{}       // to save extra data
 	closeOnce         sync.Once         // close the conn, once, per instance
 	closeFlag         int32             // close flag
@@ -146,8 +92,8 @@ type ConnCallback interface {
 }
 
 // newConn returns a wrapper of raw conn
-func newConn(conn *net.TCPConn, srv *CmdServer) *Conn {
-	DEBUG_INFO("Accepted new connection")
+func newConn(conn net.Conn, srv *CmdServer) *Conn {
+	DEBUG_DBG("Accepted new connection")
 
 	return &Conn{
 		srv:               srv,
@@ -168,11 +114,16 @@ func (c *Conn) PutExtraData(data interface{}) {
 	c.extraData = data
 }
 
-// GetRawConn returns the raw net.TCPConn from the Conn
-func (c *Conn) GetRawConn() *net.TCPConn {
+// GetRawConn returns the raw net.Conn from the Conn
+func (c *Conn) GetRawConn() net.Conn {
 	return c.conn
 }
 
+// SetRawConn replaces the raw connection, it's only allowed in OnConnect
+func (c *Conn) SetRawConn(conn net.Conn) {
+	c.conn = conn
+}
+
 // Close closes the connection
 func (c *Conn) Close() {
 	c.closeOnce.Do(func() {
@@ -180,6 +131,9 @@ func (c *Conn) Close() {
 		close(c.closeChan)
 		close(c.packetSendChan)
 		close(c.packetReceiveChan)
+		if c.stream != nil {
+			c.stream.Close()
+		}
 		c.conn.Close()
 		c.srv.callback.OnClose(c)
 	})
@@ -190,6 +144,11 @@ func (c *Conn) IsClosed() bool {
 	return atomic.LoadInt32(&c.closeFlag) == 1
 }
 
+// PendingPackets returns the number of packets waiting to be written
+func (c *Conn) PendingPackets() int {
+	return len(c.packetSendChan)
+}
+
 // AsyncWritePacket async writes a packet, this method will never block
 func (c *Conn) AsyncWritePacket(p *CmdPacket, timeout time.Duration) (err error) {
 	if c.IsClosed() {
@@ -230,6 +189,8 @@ func (c *Conn) Do() {
 	if !c.srv.callback.OnConnect(c) {
 		return
 	}
+	c.stream = NewCmdStream(c.conn, c.srv.protocol)
+	c.stream.limit = c.srv.protocol.requestLimitOf
 
 	asyncDo(c.handleLoop, c.srv.waitGroup)
 	asyncDo(c.readLoop, c.srv.waitGroup)
@@ -253,7 +214,7 @@ func (c *Conn) readLoop() {
 		default:
 		}
 
-		p, err := c.srv.protocol.ReadPacket(c.conn)
+		p, err := c.stream.ReadPacket()
 		if err != nil {
 			return
 		}
@@ -280,7 +241,7 @@ func (c *Conn) writeLoop() {
 			if c.IsClosed() {
 				return
 			}
-			if _, err := c.conn.Write(p.Serialize()); err != nil {
+			if err := c.stream.WritePacket(p); err != nil {
 				return
 			}
 		}
@@ -308,6 +269,7 @@ func (c *Conn) handleLoop() {
 			if !c.srv.callback.OnMessage(c, p) {
 				return
 			}
+			c.stream.Consumed(p)
 		}
 	}
 }
@@ -321,18 +283,25 @@ func asyncDo(fn func(), wg *sync.WaitGroup) {
 }
 
 // NewServer creates a server
-func NewServer(config *CmdConfig, callback ConnCallback, protocol CmdProtocol) *CmdServer {
+func NewServer(config *CmdConfig, callback ConnCallback, protocol *CmdProtocol) *CmdServer {
 	return &CmdServer{
 		config:    config,
 		callback:  callback,
 		protocol:  protocol,
 		exitChan:  make(chan struct{}),
+		stopChan:  make(chan struct{}),
 		waitGroup: &sync.WaitGroup{},
 	}
 }
 
+// listener which supports accept deadline
+type deadlineListener interface {
+	net.Listener
+	SetDeadline(t time.Time) error
+}
+
 // Start starts service
-func (s *CmdServer) Start(listener *net.TCPListener, acceptTimeout time.Duration) {
+func (s *CmdServer) Start(listener deadlineListener, acceptTimeout time.Duration) {
 	DEBUG_INFO("Starting command listening service")
 
 	s.waitGroup.Add(1)
@@ -346,11 +315,14 @@ func (s *CmdServer) Start(listener *net.TCPListener, acceptTimeout time.Duration
 		case <-s.exitChan:
 			return
 
+		case <-s.stopChan:
+			return
+
 		default:
 		}
 
 		listener.SetDeadline(time.Now().Add(acceptTimeout))
-		conn, err := listener.AcceptTCP()
+		conn, err := listener.Accept()
 		if err != nil {
 			continue
 		}
@@ -363,64 +335,291 @@ func (s *CmdServer) Start(listener *net.TCPListener, acceptTimeout time.Duration
 	}
 }
 
+// StopListening stops accepting new connections, accepted ones are kept
+func (s *CmdServer) StopListening() {
+	close(s.stopChan)
+}
+
 // Stop stops service
 func (s *CmdServer) Stop() {
 	close(s.exitChan)
 	s.waitGroup.Wait()
 }
 
-type Callback struct{}
+type Callback struct {
+	ctx  *kContext
+	auth *kCmdAuth
+}
 
 func (this *Callback) OnConnect(c *Conn) bool {
-	addr := c.GetRawConn().RemoteAddr()
-	c.PutExtraData(addr)
+	peer, conn, err := this.auth.Authenticate(c.GetRawConn())
+	if err != nil {
+		DEBUG_WARN("Could not authenticate connection from %v: %v", c.GetRawConn().RemoteAddr(), err)
+		c.GetRawConn().Close()
+		return false
+	}
+
+	if peer.Role == CMD_ROLE_NONE {
+		DEBUG_WARN("Rejected connection from %v", peer)
+		conn.Close()
+		return false
+	}
+
+	c.SetRawConn(conn)
+	c.PutExtraData(peer)
+	atomic.AddInt64(&kCmdClients, 1)
+
 	return true
 }
 
 func (this *Callback) OnMessage(c *Conn, p *CmdPacket) bool {
-	fmt.Printf("OnMessage:[%v] [%v]\n", p.GetLength(), string(p.GetBody()))
-	c.AsyncWritePacket(NewEchoPacket(p.Serialize(), true), time.Second)
+	var resp *kCmdMessage
+
+	// chunks of too large request were dropped, only its head is left
+	if p.TooLarge() {
+		id, command := peekCmdMessage(p.GetBody())
+		return this.respond(c, detectCmdCodec(p.GetBody()), tooLargeCmdResponse(c, id, command))
+	}
+
+	msg, codec, err := DecodeCmdMessage(p.GetBody())
+	if err != nil {
+		DEBUG_WARN("Invalid command message from %v", c.GetExtraData())
+		resp = &kCmdMessage{
+			Type:   CMD_MSG_RESPONSE,
+			Status: CMD_STATUS_BAD_REQUEST,
+			Error:  err.Error(),
+		}
+	} else if limit := c.srv.protocol.RequestLimit(msg.Command); uint32(len(p.GetBody())) > limit {
+		resp = tooLargeCmdResponse(c, msg.ID, msg.Command)
+	} else {
+		resp = dispatchCmdRequest(this.ctx, c, msg, codec)
+	}
+
+	return this.respond(c, codec, resp)
+}
+
+// response to request which exceeds the limit of its command
+func tooLargeCmdResponse(c *Conn, id uint32, command string) *kCmdMessage {
+	DEBUG_WARN("Too large '%s' request from %v", command, c.GetExtraData())
+
+	return &kCmdMessage{
+		Type:    CMD_MSG_RESPONSE,
+		ID:      id,
+		Command: command,
+		Status:  CMD_STATUS_TOO_LARGE,
+		Error:   ErrCmdPacketTooLarge.Error(),
+	}
+}
+
+// send response, false is returned if it can't be encoded
+func (this *Callback) respond(c *Conn, codec kCmdCodec, resp *kCmdMessage) bool {
+	packet, err := EncodeCmdMessage(codec, resp)
+	if err != nil {
+		DEBUG_ERR("Could not encode command response: %v", err)
+		return false
+	}
+	if err := c.AsyncWritePacket(packet, time.Second); err != nil {
+		DEBUG_WARN("Could not send command response to %v: %v", c.GetExtraData(), err)
+	}
+
 	return true
 }
 
 func (this *Callback) OnClose(c *Conn) {
-	fmt.Println("OnClose:", c.GetExtraData())
+	if _, ok := c.GetExtraData().(*kCmdPeer); ok {
+		atomic.AddInt64(&kCmdClients, -1)
+	}
+	removeTailSubscriptions(c, 0)
+	DEBUG_DBG("Closed connection from %v", c.GetExtraData())
 }
 
-// init kaohi command listener
-func InitCmdListener(ctx *kContext) error {
-	var err error
+// parse octal permission of unix socket
+func parseSocketMode(mode string) (os.FileMode, error) {
+	if mode == "" {
+		return KAOHI_DEFAULT_SOCKET_MODE, nil
+	}
 
-	DEBUG_INFO("Initializing command listener")
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm > 0777 {
+		return 0, ErrCmdInvalidSocketMode
+	}
 
-	// create listener
-	listenAddr, err := net.ResolveTCPAddr("tcp4", ctx.config.GetListenAddr())
+	return os.FileMode(perm), nil
+}
+
+// listen on unix socket with given permission
+func listenCmdUnixSocket(path string, mode string) (*net.UnixListener, error) {
+	perm, err := parseSocketMode(mode)
 	if err != nil {
-		return ErrResolveAddr
+		return nil, err
+	}
+
+	// remove stale socket of previous run
+	if fi, err := os.Lstat(path); err == nil && fi.Mode() & os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, ErrListenFaield
+	}
+
+	if err := os.Chmod(path, perm); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+// create packet protocol with limits of configuration
+func newCmdProtocolFromConfig(cfg kCmdListenerConfig) *CmdProtocol {
+	protocol := NewCmdProtocol()
+
+	if cfg.MaxFrameSize > 0 {
+		protocol.MaxFrameSize = uint32(cfg.MaxFrameSize)
+	}
+	if cfg.MaxMessageSize > 0 {
+		protocol.MaxMessageSize = uint32(cfg.MaxMessageSize)
+	}
+	if cfg.StreamWindow > 0 {
+		protocol.Window = uint32(cfg.StreamWindow)
+	}
+	if protocol.ChunkSize > protocol.MaxFrameSize {
+		protocol.ChunkSize = protocol.MaxFrameSize
 	}
 
-	kCmdListener.listener, err = net.ListenTCP("tcp", listenAddr)
+	for command, limit := range cfg.RequestLimits {
+		if limit > 0 {
+			protocol.RequestLimits[command] = uint32(limit)
+		}
+	}
+
+	return protocol
+}
+
+// create listeners and start server for configuration
+func startCmdListener(ctx *kContext, config *kConfigScheme) error {
+	var listeners []deadlineListener
+
+	cfg := config.GetCmdListener()
+	auth, err := newCmdAuth(cfg)
 	if err != nil {
-		return ErrListenFaield
+		return err
 	}
 
-	DEBUG_INFO("Listening on %s", ctx.config.GetListenAddr())
+	// create unix socket listener
+	if cfg.UnixSocket != "" {
+		listener, err := listenCmdUnixSocket(cfg.UnixSocket, cfg.SocketMode)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, listener)
+
+		DEBUG_INFO("Listening on unix socket %s", cfg.UnixSocket)
+	}
+
+	// create TCP listener
+	if config.GetListenAddr() != "" || cfg.UnixSocket == "" {
+		listenAddr, err := net.ResolveTCPAddr("tcp4", config.GetListenAddr())
+		if err != nil {
+			closeCmdListeners(listeners)
+			return ErrResolveAddr
+		}
+
+		listener, err := net.ListenTCP("tcp", listenAddr)
+		if err != nil {
+			closeCmdListeners(listeners)
+			return ErrListenFaield
+		}
+		listeners = append(listeners, listener)
+
+		if auth.tlsConfig != nil {
+			DEBUG_INFO("Listening on %s with TLS", config.GetListenAddr())
+		} else {
+			DEBUG_INFO("Listening on %s", config.GetListenAddr())
+		}
+	}
 
 	// creates a server instance
-	config := &CmdConfig{
+	srvConfig := &CmdConfig{
+		PacketSendChanLimit:    KAOHI_CMD_SEND_QUEUE_SIZE,
 		PacketReceiveChanLimit: 20,
 	}
-	kCmdListener.srv = NewServer(config, &Callback{}, CmdProtocol{})
+	kCmdListener.srv = NewServer(srvConfig, &Callback{ctx: ctx, auth: auth}, newCmdProtocolFromConfig(cfg))
+	kCmdListener.listeners = listeners
 
 	// starts service
-	go kCmdListener.srv.Start(kCmdListener.listener, time.Second)
+	for _, listener := range listeners {
+		go kCmdListener.srv.Start(listener, time.Second)
+	}
+	atomic.StoreInt32(&kCmdListener.listening, 1)
 
 	return nil
 }
 
+// check whether command listener must be rebound for configuration
+func cmdListenerChanged(old *kConfigScheme, config *kConfigScheme) bool {
+	return old.GetListenAddr() != config.GetListenAddr() ||
+		!reflect.DeepEqual(old.GetCmdListener(), config.GetCmdListener())
+}
+
+// check whether command listener accepts connections
+func cmdListenerListening() bool {
+	return atomic.LoadInt32(&kCmdListener.listening) != 0
+}
+
+// init kaohi command listener
+func InitCmdListener(ctx *kContext) error {
+	DEBUG_INFO("Initializing command listener")
+
+	return startCmdListener(ctx, ctx.config)
+}
+
+// rebind command listener to addresses of configuration, connections of
+// previous listeners are kept until they are closed
+func RebindCmdListener(ctx *kContext, old *kConfigScheme, config *kConfigScheme) error {
+	DEBUG_INFO("Rebinding command listener")
+
+	// the previous rebind may have failed to restore the listener
+	if kCmdListener.srv != nil {
+		kCmdListener.srv.StopListening()
+		closeCmdListeners(kCmdListener.listeners)
+		kCmdListener.retired = append(kCmdListener.retired, kCmdListener.srv)
+	}
+	atomic.StoreInt32(&kCmdListener.listening, 0)
+	kCmdListener.srv = nil
+	kCmdListener.listeners = nil
+
+	if err := startCmdListener(ctx, config); err != nil {
+		if rerr := startCmdListener(ctx, old); rerr != nil {
+			DEBUG_ERR("Could not restore command listener, running without it: %v", rerr)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// close listeners
+func closeCmdListeners(listeners []deadlineListener) {
+	for _, listener := range listeners {
+		listener.Close()
+	}
+}
+
 // finalize kaohi command listener
 func FinalizeCmdListener() {
 	DEBUG_INFO("Finalzing command listener")
 
-	kCmdListener.srv.Stop()
+	for _, srv := range kCmdListener.retired {
+		srv.Stop()
+	}
+	if kCmdListener.srv != nil {
+		kCmdListener.srv.Stop()
+	}
+	atomic.StoreInt32(&kCmdListener.listening, 0)
+	kCmdListener.srv = nil
+	kCmdListener.listeners = nil
+	kCmdListener.retired = nil
 }
@@ -0,0 +1,282 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+)
+
+// roles of command connections
+const (
+	CMD_ROLE_NONE = iota
+	CMD_ROLE_READ_ONLY
+	CMD_ROLE_ADMIN
+)
+
+var kCmdRoleNames = map[string]int{
+	"none":        CMD_ROLE_NONE,
+	"read-only":   CMD_ROLE_READ_ONLY,
+	"admin":       CMD_ROLE_ADMIN,
+}
+
+// commands which require admin role, other commands are allowed for read-only role
+var kCmdAdminCommands = map[string]bool{
+	CMD_PAUSE_INPUT:        true,
+	CMD_RESUME_INPUT:       true,
+	CMD_RELOAD_CONFIG:      true,
+	CMD_FLUSH_OUTPUTS:      true,
+	CMD_SHOW_CONFIG:        true,
+	CMD_SUBSCRIBE:          true,
+	CMD_APPLY_CONFIG:       true,
+	CMD_SET_LOG_LEVEL:      true,
+}
+
+// authenticated peer of command connection
+type kCmdPeer struct {
+	Addr           string
+	Identity       string
+	Role           int
+}
+
+func (p *kCmdPeer) String() string {
+	if p.Identity == "" {
+		return p.Addr
+	}
+
+	return p.Identity + "@" + p.Addr
+}
+
+// authenticator of command connections
+type kCmdAuth struct {
+	tcpRole        int
+	tlsConfig      *tls.Config
+
+	allowUids      map[int]bool
+	allowGids      map[int]bool
+	adminUids      map[int]bool
+	adminGids      map[int]bool
+
+	allowNames     map[string]bool
+	adminNames     map[string]bool
+}
+
+func intSet(ids []int) map[int]bool {
+	set := make(map[int]bool)
+	for _, id := range ids {
+		set[id] = true
+	}
+
+	return set
+}
+
+func stringSet(names []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, name := range names {
+		set[name] = true
+	}
+
+	return set
+}
+
+// create authenticator from command listener configuration
+func newCmdAuth(cfg kCmdListenerConfig) (*kCmdAuth, error) {
+	a := &kCmdAuth{
+		tcpRole:        kCmdRoleNames[KAOHI_DEFAULT_TCP_ROLE],
+		allowUids:      intSet(cfg.AllowUids),
+		allowGids:      intSet(cfg.AllowGids),
+		adminUids:      intSet(cfg.AdminUids),
+		adminGids:      intSet(cfg.AdminGids),
+		allowNames:     stringSet(cfg.AllowNames),
+		adminNames:     stringSet(cfg.AdminNames),
+	}
+
+	if cfg.TCPRole != "" {
+		role, ok := kCmdRoleNames[cfg.TCPRole]
+		if !ok {
+			return nil, ErrCmdInvalidRole
+		}
+		a.tcpRole = role
+	}
+
+	if cfg.TLS.CertFile != "" || cfg.TLS.KeyFile != "" {
+		tlsConfig, err := newCmdListenerTLSConfig(cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+		a.tlsConfig = tlsConfig
+	}
+
+	return a, nil
+}
+
+// create server side TLS configuration, client certificates are required when CA is given
+func newCmdListenerTLSConfig(cfg kTLSConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates:   []tls.Certificate{cert},
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	if cfg.CAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, ErrInvalidCACert
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// authenticate connection and return its peer, TCP connections are upgraded to TLS if configured
+func (a *kCmdAuth) Authenticate(conn net.Conn) (*kCmdPeer, net.Conn, error) {
+	peer := &kCmdPeer{
+		Addr:           conn.RemoteAddr().String(),
+		Role:           a.tcpRole,
+	}
+
+	switch conn := conn.(type) {
+	case *net.UnixConn:
+		uid, gids, err := getPeerCred(conn)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		peer.Addr = "unix"
+		peer.Identity = "uid=" + strconv.Itoa(uid)
+		peer.Role = a.unixRole(uid, gids)
+
+		return peer, conn, nil
+
+	case *net.TCPConn:
+		if a.tlsConfig == nil {
+			return peer, conn, nil
+		}
+
+		tlsConn := tls.Server(conn, a.tlsConfig)
+		tlsConn.SetDeadline(time.Now().Add(KAOHI_CMD_HANDSHAKE_TIMEOUT))
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, nil, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+
+		certs := tlsConn.ConnectionState().PeerCertificates
+		if len(certs) > 0 {
+			peer.Identity = certs[0].Subject.CommonName
+			peer.Role = a.certRole(certs[0])
+		}
+
+		return peer, tlsConn, nil
+	}
+
+	return peer, conn, nil
+}
+
+// role of local peer, the user of daemon and root are always admin
+func (a *kCmdAuth) unixRole(uid int, gids []int) int {
+	if uid == 0 || uid == os.Geteuid() || a.adminUids[uid] {
+		return CMD_ROLE_ADMIN
+	}
+
+	// add supplementary groups of the user
+	if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		if groups, err := u.GroupIds(); err == nil {
+			for _, group := range groups {
+				if gid, err := strconv.Atoi(group); err == nil {
+					gids = append(gids, gid)
+				}
+			}
+		}
+	}
+
+	role := CMD_ROLE_NONE
+	if a.allowUids[uid] {
+		role = CMD_ROLE_READ_ONLY
+	}
+	for _, gid := range gids {
+		if a.adminGids[gid] {
+			return CMD_ROLE_ADMIN
+		}
+		if a.allowGids[gid] {
+			role = CMD_ROLE_READ_ONLY
+		}
+	}
+
+	return role
+}
+
+// role of client certificate which is matched by common name or DNS names
+func (a *kCmdAuth) certRole(cert *x509.Certificate) int {
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+
+	for _, name := range names {
+		if a.adminNames[name] {
+			return CMD_ROLE_ADMIN
+		}
+	}
+
+	if len(a.allowNames) == 0 {
+		return CMD_ROLE_READ_ONLY
+	}
+	for _, name := range names {
+		if a.allowNames[name] {
+			return CMD_ROLE_READ_ONLY
+		}
+	}
+
+	return CMD_ROLE_NONE
+}
+
+// check whether connection is permitted to run command
+func checkCmdPermission(c *Conn, command string) error {
+	peer, ok := c.GetExtraData().(*kCmdPeer)
+	if !ok {
+		return ErrCmdPermissionDenied
+	}
+
+	if kCmdAdminCommands[command] && peer.Role < CMD_ROLE_ADMIN {
+		return ErrCmdPermissionDenied
+	}
+
+	return nil
+}
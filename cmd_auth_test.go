@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+)
+
+// uid and gids which don't exist, so no supplementary groups are added
+const (
+	kTestUid = 54321
+	kTestGid = 54322
+)
+
+func TestCmdUnixRole(t *testing.T) {
+	a, err := newCmdAuth(kCmdListenerConfig{
+		AllowUids:      []int{kTestUid + 1},
+		AllowGids:      []int{kTestGid + 1},
+		AdminUids:      []int{kTestUid + 2},
+		AdminGids:      []int{kTestGid + 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name           string
+		uid            int
+		gids           []int
+		role           int
+	}{
+		{"root", 0, nil, CMD_ROLE_ADMIN},
+		{"unknown user", kTestUid, []int{kTestGid}, CMD_ROLE_NONE},
+		{"allowed uid", kTestUid + 1, nil, CMD_ROLE_READ_ONLY},
+		{"allowed gid", kTestUid, []int{kTestGid, kTestGid + 1}, CMD_ROLE_READ_ONLY},
+		{"admin uid", kTestUid + 2, nil, CMD_ROLE_ADMIN},
+		{"admin gid", kTestUid, []int{kTestGid + 2}, CMD_ROLE_ADMIN},
+		{"allowed uid and admin gid", kTestUid + 1, []int{kTestGid + 1, kTestGid + 2}, CMD_ROLE_ADMIN},
+	} {
+		if role := a.unixRole(c.uid, c.gids); role != c.role {
+			t.Errorf("%s: role %d, expected %d", c.name, role, c.role)
+		}
+	}
+}
+
+func TestCmdCertRole(t *testing.T) {
+	cert := func(cn string, dnsNames ...string) *x509.Certificate {
+		return &x509.Certificate{Subject: pkix.Name{CommonName: cn}, DNSNames: dnsNames}
+	}
+
+	restricted, err := newCmdAuth(kCmdListenerConfig{
+		AllowNames:     []string{"monitor"},
+		AdminNames:     []string{"ops", "ops.example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	open, err := newCmdAuth(kCmdListenerConfig{AdminNames: []string{"ops"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name           string
+		auth           *kCmdAuth
+		cert           *x509.Certificate
+		role           int
+	}{
+		{"admin common name", restricted, cert("ops"), CMD_ROLE_ADMIN},
+		{"admin DNS name", restricted, cert("host", "ops.example.com"), CMD_ROLE_ADMIN},
+		{"allowed common name", restricted, cert("monitor"), CMD_ROLE_READ_ONLY},
+		{"allowed DNS name", restricted, cert("host", "monitor"), CMD_ROLE_READ_ONLY},
+		{"unknown name", restricted, cert("intruder", "intruder.example.com"), CMD_ROLE_NONE},
+		{"any name without allow list", open, cert("anyone"), CMD_ROLE_READ_ONLY},
+		{"admin without allow list", open, cert("ops"), CMD_ROLE_ADMIN},
+	} {
+		if role := c.auth.certRole(c.cert); role != c.role {
+			t.Errorf("%s: role %d, expected %d", c.name, role, c.role)
+		}
+	}
+}
+
+func TestCheckCmdPermission(t *testing.T) {
+	admin := map[string]bool{
+		CMD_PAUSE_INPUT:        true,
+		CMD_RESUME_INPUT:       true,
+		CMD_RELOAD_CONFIG:      true,
+		CMD_FLUSH_OUTPUTS:      true,
+		CMD_SHOW_CONFIG:        true,
+		CMD_SUBSCRIBE:          true,
+		CMD_APPLY_CONFIG:       true,
+		CMD_SET_LOG_LEVEL:      true,
+	}
+	commands := []string{CMD_STATUS, CMD_LIST_INPUTS, CMD_LIST_OUTPUTS, CMD_STATS, CMD_UNSUBSCRIBE}
+	for command := range admin {
+		commands = append(commands, command)
+	}
+
+	// connections without role are closed before any command is read
+	for _, role := range []int{CMD_ROLE_READ_ONLY, CMD_ROLE_ADMIN} {
+		c := &Conn{}
+		c.PutExtraData(&kCmdPeer{Addr: "unix", Role: role})
+
+		for _, command := range commands {
+			err := checkCmdPermission(c, command)
+			if allowed := role == CMD_ROLE_ADMIN || !admin[command]; allowed != (err == nil) {
+				t.Errorf("role %d, command %s: %v", role, command, err)
+			}
+		}
+	}
+
+	// connection without authenticated peer
+	if err := checkCmdPermission(&Conn{}, CMD_STATUS); err != ErrCmdPermissionDenied {
+		t.Fatalf("unauthenticated connection: %v", err)
+	}
+}
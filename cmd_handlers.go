@@ -0,0 +1,325 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// command handler
+type kCmdHandler func(ctx *kContext, c *Conn, msg *kCmdMessage, codec kCmdCodec) (interface{}, error)
+
+// error with status code which is returned by command handlers
+type kCmdError struct {
+	Status         int
+	Message        string
+}
+
+func (e *kCmdError) Error() string {
+	return e.Message
+}
+
+func newCmdError(status int, err error) *kCmdError {
+	return &kCmdError{Status: status, Message: err.Error()}
+}
+
+// registered command handlers
+var kCmdHandlers = map[string]kCmdHandler{
+	CMD_STATUS:             handleStatus,
+	CMD_LIST_INPUTS:        handleListInputs,
+	CMD_PAUSE_INPUT:        handlePauseInput,
+	CMD_RESUME_INPUT:       handleResumeInput,
+	CMD_RELOAD_CONFIG:      handleReloadConfig,
+	CMD_FLUSH_OUTPUTS:      handleFlushOutputs,
+	CMD_LIST_OUTPUTS:       handleListOutputs,
+	CMD_STATS:              handleStats,
+	CMD_SHOW_CONFIG:        handleShowConfig,
+	CMD_SUBSCRIBE:          handleSubscribe,
+	CMD_UNSUBSCRIBE:        handleUnsubscribe,
+	CMD_APPLY_CONFIG:       handleApplyConfig,
+	CMD_SET_LOG_LEVEL:      handleSetLogLevel,
+}
+
+// dispatch request to handler and build response
+func dispatchCmdRequest(ctx *kContext, c *Conn, msg *kCmdMessage, codec kCmdCodec) *kCmdMessage {
+	resp := &kCmdMessage{
+		Type:           CMD_MSG_RESPONSE,
+		ID:             msg.ID,
+		Command:        msg.Command,
+		Status:         CMD_STATUS_OK,
+	}
+
+	if msg.Type != CMD_MSG_REQUEST {
+		resp.Status = CMD_STATUS_BAD_REQUEST
+		resp.Error = ErrCmdInvalidMessage.Error()
+		return resp
+	}
+
+	handler, ok := kCmdHandlers[msg.Command]
+	if !ok {
+		resp.Status = CMD_STATUS_NOT_IMPLEMENTED
+		resp.Error = ErrCmdUnknownCommand.Error()
+		return resp
+	}
+
+	if err := checkCmdPermission(c, msg.Command); err != nil {
+		DEBUG_WARN("Denied command '%s' from %v", msg.Command, c.GetExtraData())
+		resp.Status = CMD_STATUS_FORBIDDEN
+		resp.Error = err.Error()
+		return resp
+	}
+
+	body, err := handler(ctx, c, msg, codec)
+	if err != nil {
+		if cerr, ok := err.(*kCmdError); ok {
+			resp.Status = cerr.Status
+		} else {
+			resp.Status = CMD_STATUS_INTERNAL_ERROR
+		}
+		resp.Error = err.Error()
+		return resp
+	}
+	resp.Body = body
+
+	return resp
+}
+
+// get daemon status
+func handleStatus(ctx *kContext, c *Conn, msg *kCmdMessage, codec kCmdCodec) (interface{}, error) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	return &kCmdStatusInfo{
+		Version:        KAOHI_VERSION,
+		PID:            os.Getpid(),
+		StartTime:      ctx.startTime.Format(time.RFC3339),
+		Uptime:         int64(time.Since(ctx.startTime).Seconds()),
+		ConfigFile:     ctx.configPath,
+		Inputs:         len(GetInputs()),
+		Outputs:        len(GetOutputs()),
+		WatchedFiles:   kWatcher.FileCount(),
+		LogLevel:       GetLogLevel(),
+	}, nil
+}
+
+// list inputs with their statistics
+func handleListInputs(ctx *kContext, c *Conn, msg *kCmdMessage, codec kCmdCodec) (interface{}, error) {
+	infos := []kCmdInputInfo{}
+
+	for _, in := range GetInputs() {
+		stats := in.Stats()
+		infos = append(infos, kCmdInputInfo{
+			Name:           in.Name(),
+			Type:           in.Type(),
+			Paused:         in.IsPaused(),
+			Events:         stats.Events,
+			Bytes:          stats.Bytes,
+			Errors:         stats.Errors,
+		})
+	}
+
+	return infos, nil
+}
+
+// find input which is specified by request
+func findRequestedInput(msg *kCmdMessage, codec kCmdCodec) (kInput, error) {
+	var args kCmdInputArgs
+
+	if err := msg.DecodeBody(codec, &args); err != nil || args.Name == "" {
+		return nil, newCmdError(CMD_STATUS_BAD_REQUEST, ErrCmdInvalidArgs)
+	}
+
+	in := FindInput(args.Type, args.Name)
+	if in == nil {
+		return nil, newCmdError(CMD_STATUS_NOT_FOUND, ErrCmdInputNotFound)
+	}
+
+	return in, nil
+}
+
+// pause input
+func handlePauseInput(ctx *kContext, c *Conn, msg *kCmdMessage, codec kCmdCodec) (interface{}, error) {
+	in, err := findRequestedInput(msg, codec)
+	if err != nil {
+		return nil, err
+	}
+
+	DEBUG_INFO("Pausing %s input '%s'", in.Type(), in.Name())
+	in.Pause()
+
+	return nil, nil
+}
+
+// resume input
+func handleResumeInput(ctx *kContext, c *Conn, msg *kCmdMessage, codec kCmdCodec) (interface{}, error) {
+	in, err := findRequestedInput(msg, codec)
+	if err != nil {
+		return nil, err
+	}
+
+	DEBUG_INFO("Resuming %s input '%s'", in.Type(), in.Name())
+	in.Resume()
+
+	return nil, nil
+}
+
+// reload configuration file
+func handleReloadConfig(ctx *kContext, c *Conn, msg *kCmdMessage, codec kCmdCodec) (interface{}, error) {
+	if err := ctx.ReloadConfig(); err != nil {
+		return nil, newCmdError(CMD_STATUS_CONFLICT, err)
+	}
+
+	return nil, nil
+}
+
+// flush all outputs
+func handleFlushOutputs(ctx *kContext, c *Conn, msg *kCmdMessage, codec kCmdCodec) (interface{}, error) {
+	var args kCmdFlushArgs
+
+	if err := msg.DecodeBody(codec, &args); err != nil {
+		return nil, newCmdError(CMD_STATUS_BAD_REQUEST, ErrCmdInvalidArgs)
+	}
+
+	timeout := KAOHI_DEFAULT_OUTPUT_FLUSH_TIMEOUT
+	if args.Timeout > 0 {
+		timeout = time.Duration(args.Timeout) * time.Second
+	}
+
+	results := []kCmdFlushResult{}
+	for _, out := range GetOutputs() {
+		result := kCmdFlushResult{Name: out.Name(), Type: out.Type()}
+		if err := out.Flush(timeout); err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// list outputs with their statistics
+func handleListOutputs(ctx *kContext, c *Conn, msg *kCmdMessage, codec kCmdCodec) (interface{}, error) {
+	infos := []kCmdOutputInfo{}
+
+	for _, out := range GetOutputs() {
+		stats := out.Stats()
+		infos = append(infos, kCmdOutputInfo{
+			Name:           out.Name(),
+			Type:           out.Type(),
+			Queued:         stats.Queued,
+			Sent:           stats.Sent,
+			Dropped:        stats.Dropped,
+			Failed:         stats.Failed,
+		})
+	}
+
+	return infos, nil
+}
+
+// get total statistics of inputs and outputs
+func handleStats(ctx *kContext, c *Conn, msg *kCmdMessage, codec kCmdCodec) (interface{}, error) {
+	info := &kCmdStatsInfo{
+		WatchedFiles:   kWatcher.FileCount(),
+	}
+
+	for _, in := range GetInputs() {
+		stats := in.Stats()
+		info.InputEvents += stats.Events
+		info.InputBytes += stats.Bytes
+		info.InputErrors += stats.Errors
+	}
+
+	for _, out := range GetOutputs() {
+		stats := out.Stats()
+		info.OutputQueued += stats.Queued
+		info.OutputSent += stats.Sent
+		info.OutputDropped += stats.Dropped
+		info.OutputFailed += stats.Failed
+	}
+
+	return info, nil
+}
+
+// get content of configuration file
+func handleShowConfig(ctx *kContext, c *Conn, msg *kCmdMessage, codec kCmdCodec) (interface{}, error) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	content, err := ioutil.ReadFile(ctx.configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &kCmdConfigInfo{
+		Path:           ctx.configPath,
+		Content:        string(content),
+		Includes:       ctx.config.GetIncludes(),
+	}, nil
+}
+
+// validate configuration and apply it
+func handleApplyConfig(ctx *kContext, c *Conn, msg *kCmdMessage, codec kCmdCodec) (interface{}, error) {
+	var args kCmdApplyArgs
+
+	if err := msg.DecodeBody(codec, &args); err != nil || args.Content == "" {
+		return nil, newCmdError(CMD_STATUS_BAD_REQUEST, ErrCmdInvalidArgs)
+	}
+
+	DEBUG_INFO("Applying configuration from %v", c.GetExtraData())
+
+	changes, err := ctx.ApplyConfig([]byte(args.Content), args.DryRun)
+	if err != nil {
+		if _, ok := err.(*kConfigInvalidError); ok {
+			return nil, newCmdError(CMD_STATUS_BAD_REQUEST, err)
+		}
+		return nil, newCmdError(CMD_STATUS_CONFLICT, err)
+	}
+
+	return &kCmdApplyResult{
+		Changes:        changes,
+		Applied:        !args.DryRun,
+	}, nil
+}
+
+// change log level until configuration is reloaded with another level
+func handleSetLogLevel(ctx *kContext, c *Conn, msg *kCmdMessage, codec kCmdCodec) (interface{}, error) {
+	var args kCmdLogLevelArgs
+
+	if err := msg.DecodeBody(codec, &args); err != nil || args.Level == nil {
+		return nil, newCmdError(CMD_STATUS_BAD_REQUEST, ErrCmdInvalidArgs)
+	}
+	if *args.Level < LOG_LEVEL_ERR || *args.Level > LOG_LEVEL_DEBUG {
+		return nil, newCmdError(CMD_STATUS_BAD_REQUEST, ErrInvalidLogLevel)
+	}
+
+	previous := SetLogLevel(*args.Level)
+	DEBUG_WARN("Log level was changed from %s to %s by %v", kLogLevelNames[previous],
+		kLogLevelNames[*args.Level], c.GetExtraData())
+
+	return &kCmdLogLevelResult{Level: *args.Level, Previous: previous}, nil
+}
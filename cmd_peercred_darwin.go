@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	SOL_LOCAL       = 0
+	LOCAL_PEERCRED  = 0x1
+	XUCRED_VERSION  = 0
+)
+
+// struct xucred of sys/ucred.h
+type xucred struct {
+	Version        uint32
+	Uid            uint32
+	Ngroups        int16
+	Groups         [16]uint32
+}
+
+// get uid and groups of process on the other side of unix socket
+func getPeerCred(conn *net.UnixConn) (int, []int, error) {
+	var cred xucred
+	var errno syscall.Errno
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	err = raw.Control(func(fd uintptr) {
+		size := uint32(unsafe.Sizeof(cred))
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, SOL_LOCAL, LOCAL_PEERCRED,
+			uintptr(unsafe.Pointer(&cred)), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	if errno != 0 {
+		return 0, nil, errno
+	}
+	if cred.Version != XUCRED_VERSION {
+		return 0, nil, ErrCmdPeerCredUnsupported
+	}
+
+	gids := []int{}
+	for i := 0; i < int(cred.Ngroups) && i < len(cred.Groups); i++ {
+		gids = append(gids, int(cred.Groups[i]))
+	}
+
+	return int(cred.Uid), gids, nil
+}
@@ -0,0 +1,663 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// message types
+const (
+	CMD_MSG_REQUEST                = 1
+	CMD_MSG_RESPONSE               = 2
+	CMD_MSG_EVENT                  = 3
+)
+
+// status codes of response
+const (
+	CMD_STATUS_OK                  = 200
+	CMD_STATUS_BAD_REQUEST         = 400
+	CMD_STATUS_FORBIDDEN           = 403
+	CMD_STATUS_NOT_FOUND           = 404
+	CMD_STATUS_CONFLICT            = 409
+	CMD_STATUS_TOO_LARGE           = 413
+	CMD_STATUS_INTERNAL_ERROR      = 500
+	CMD_STATUS_NOT_IMPLEMENTED     = 501
+)
+
+// commands
+const (
+	CMD_STATUS                     = "status"
+	CMD_LIST_INPUTS                = "list-inputs"
+	CMD_PAUSE_INPUT                = "pause-input"
+	CMD_RESUME_INPUT               = "resume-input"
+	CMD_RELOAD_CONFIG              = "reload-config"
+	CMD_FLUSH_OUTPUTS              = "flush-outputs"
+	CMD_LIST_OUTPUTS               = "list-outputs"
+	CMD_STATS                      = "stats"
+	CMD_SHOW_CONFIG                = "show-config"
+	CMD_SUBSCRIBE                  = "subscribe"
+	CMD_UNSUBSCRIBE                = "unsubscribe"
+	CMD_APPLY_CONFIG               = "apply-config"
+	CMD_SET_LOG_LEVEL              = "set-log-level"
+)
+
+// known commands
+var kCmdCommands = map[string]bool{
+	CMD_STATUS:             true,
+	CMD_LIST_INPUTS:        true,
+	CMD_PAUSE_INPUT:        true,
+	CMD_RESUME_INPUT:       true,
+	CMD_RELOAD_CONFIG:      true,
+	CMD_FLUSH_OUTPUTS:      true,
+	CMD_LIST_OUTPUTS:       true,
+	CMD_STATS:              true,
+	CMD_SHOW_CONFIG:        true,
+	CMD_SUBSCRIBE:          true,
+	CMD_UNSUBSCRIBE:        true,
+	CMD_APPLY_CONFIG:       true,
+	CMD_SET_LOG_LEVEL:      true,
+}
+
+// command message which is carried in the body of packet
+type kCmdMessage struct {
+	Type           int                `json:"type"`
+	ID             uint32             `json:"id"`
+	Command        string             `json:"command,omitempty"`
+	Status         int                `json:"status,omitempty"`
+	Error          string             `json:"error,omitempty"`
+	Body           interface{}        `json:"body,omitempty"`
+}
+
+// argument of pause-input and resume-input
+type kCmdInputArgs struct {
+	Type           string             `json:"type,omitempty"`
+	Name           string             `json:"name"`
+}
+
+// argument of set-log-level
+type kCmdLogLevelArgs struct {
+	Level          *int               `json:"level"`
+}
+
+// result of set-log-level
+type kCmdLogLevelResult struct {
+	Level          int                `json:"level"`
+	Previous       int                `json:"previous"`
+}
+
+// argument of flush-outputs
+type kCmdFlushArgs struct {
+	Timeout        int                `json:"timeout,omitempty"`
+}
+
+// result of status
+type kCmdStatusInfo struct {
+	Version        string             `json:"version"`
+	PID            int                `json:"pid"`
+	StartTime      string             `json:"start_time"`
+	Uptime         int64              `json:"uptime"`
+	ConfigFile     string             `json:"config_file"`
+	Inputs         int                `json:"inputs"`
+	Outputs        int                `json:"outputs"`
+	WatchedFiles   int                `json:"watched_files"`
+	LogLevel       int                `json:"log_level"`
+}
+
+// result item of list-inputs
+type kCmdInputInfo struct {
+	Name           string             `json:"name"`
+	Type           string             `json:"type"`
+	Paused         bool               `json:"paused"`
+	Events         uint64             `json:"events"`
+	Bytes          uint64             `json:"bytes"`
+	Errors         uint64             `json:"errors"`
+}
+
+// result item of list-outputs
+type kCmdOutputInfo struct {
+	Name           string             `json:"name"`
+	Type           string             `json:"type"`
+	Queued         int64              `json:"queued"`
+	Sent           uint64             `json:"sent"`
+	Dropped        uint64             `json:"dropped"`
+	Failed         uint64             `json:"failed"`
+}
+
+// result of stats
+type kCmdStatsInfo struct {
+	InputEvents    uint64             `json:"input_events"`
+	InputBytes     uint64             `json:"input_bytes"`
+	InputErrors    uint64             `json:"input_errors"`
+	OutputQueued   int64              `json:"output_queued"`
+	OutputSent     uint64             `json:"output_sent"`
+	OutputDropped  uint64             `json:"output_dropped"`
+	OutputFailed   uint64             `json:"output_failed"`
+	WatchedFiles   int                `json:"watched_files"`
+	LogLevel       int                `json:"log_level"`
+}
+
+// result of show-config
+type kCmdConfigInfo struct {
+	Path           string             `json:"path"`
+	Content        string             `json:"content"`
+	Includes       []string           `json:"includes,omitempty"`
+}
+
+// argument of apply-config
+type kCmdApplyArgs struct {
+	Content        string             `json:"content"`
+	DryRun         bool               `json:"dry_run,omitempty"`
+}
+
+// change of input or output by apply-config
+type kCmdConfigChange struct {
+	Action         string             `json:"action"`
+	Kind           string             `json:"kind"`
+	Type           string             `json:"type"`
+	Name           string             `json:"name"`
+}
+
+// result of apply-config
+type kCmdApplyResult struct {
+	Changes        []kCmdConfigChange `json:"changes"`
+	Applied        bool               `json:"applied"`
+}
+
+// argument of subscribe
+type kCmdTailArgs struct {
+	Group          string             `json:"group,omitempty"`
+	Source         string             `json:"source,omitempty"`
+	Match          string             `json:"match,omitempty"`
+}
+
+// argument of unsubscribe, zero id removes all subscriptions of connection
+type kCmdUnsubscribeArgs struct {
+	ID             uint32             `json:"id,omitempty"`
+}
+
+// body of event message, dropped is the number of events which were
+// dropped for this subscription so far
+type kCmdTailEvent struct {
+	Time           string             `json:"time"`
+	Host           string             `json:"host"`
+	Group          string             `json:"group"`
+	Source         string             `json:"source"`
+	Message        string             `json:"message"`
+	Fields         map[string]string  `json:"fields,omitempty"`
+	Dropped        uint64             `json:"dropped"`
+}
+
+// result item of flush-outputs
+type kCmdFlushResult struct {
+	Name           string             `json:"name"`
+	Type           string             `json:"type"`
+	Error          string             `json:"error,omitempty"`
+}
+
+// codec of command messages
+type kCmdCodec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type kJSONCodec struct{}
+
+func (c kJSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (c kJSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type kCBORCodec struct{}
+
+func (c kCBORCodec) Marshal(v interface{}) ([]byte, error) {
+	return cbor.Marshal(v)
+}
+
+func (c kCBORCodec) Unmarshal(data []byte, v interface{}) error {
+	return cbor.Unmarshal(data, v)
+}
+
+// detect codec of message, JSON messages always start with '{' which is
+// never the first byte of CBOR map
+func detectCmdCodec(body []byte) kCmdCodec {
+	if len(body) > 0 && body[0] == '{' {
+		return kJSONCodec{}
+	}
+	return kCBORCodec{}
+}
+
+// decode command message from packet body
+func DecodeCmdMessage(body []byte) (*kCmdMessage, kCmdCodec, error) {
+	codec := detectCmdCodec(body)
+
+	msg := &kCmdMessage{}
+	if err := codec.Unmarshal(body, msg); err != nil {
+		return nil, codec, ErrCmdInvalidMessage
+	}
+
+	return msg, codec, nil
+}
+
+// decode id and command of message from its head, the fields before them
+// must be complete, so they are found in the first chunk of large message
+func peekCmdMessage(head []byte) (id uint32, command string) {
+	if len(head) > 0 && head[0] == '{' {
+		dec := json.NewDecoder(bytes.NewReader(head))
+		if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+			return
+		}
+		for {
+			var key string
+			var value json.RawMessage
+			if t, err := dec.Token(); err != nil {
+				return
+			} else if key, _ = t.(string); key == "" {
+				return
+			}
+			if err := dec.Decode(&value); err != nil {
+				return
+			}
+			switch key {
+			case "id":
+				json.Unmarshal(value, &id)
+			case "command":
+				json.Unmarshal(value, &command)
+			}
+		}
+	}
+
+	// skip header of CBOR map, its length has up to 8 bytes
+	if len(head) == 0 || head[0] >> 5 != 5 {
+		return
+	}
+	n := 1
+	switch head[0] & 0x1f {
+	case 24:
+		n = 2
+	case 25:
+		n = 3
+	case 26:
+		n = 5
+	case 27:
+		n = 9
+	}
+	if len(head) < n {
+		return
+	}
+
+	dec := cbor.NewDecoder(bytes.NewReader(head[n:]))
+	for {
+		var key string
+		var value cbor.RawMessage
+		if dec.Decode(&key) != nil || dec.Decode(&value) != nil {
+			return
+		}
+		switch key {
+		case "id":
+			cbor.Unmarshal(value, &id)
+		case "command":
+			cbor.Unmarshal(value, &command)
+		}
+	}
+}
+
+// encode command message into packet
+func EncodeCmdMessage(codec kCmdCodec, msg *kCmdMessage) (*CmdPacket, error) {
+	body, err := codec.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewCmdPacket(body, false), nil
+}
+
+// decode message body into the given value
+func (msg *kCmdMessage) DecodeBody(codec kCmdCodec, v interface{}) error {
+	if msg.Body == nil {
+		return nil
+	}
+
+	data, err := codec.Marshal(msg.Body)
+	if err != nil {
+		return err
+	}
+
+	return codec.Unmarshal(data, v)
+}
+
+// flags of the 4-byte length header, plain frames never have them set so
+// the header stays compatible with peers which don't know chunked frames
+const (
+	CMD_FRAME_MORE                 = 0x80000000 // more chunks of the message follow
+	CMD_FRAME_ACK                  = 0x40000000 // flow control frame, body is count of consumed bytes
+	CMD_FRAME_LENGTH_MASK          = 0x3fffffff
+)
+
+type CmdPacket struct {
+	buff     []byte
+	tooLarge bool   // the message exceeded its limit, only its head is kept
+	unacked  uint32 // bytes of the last chunk which are acknowledged when consumed
+}
+
+func (this *CmdPacket) Serialize() []byte {
+	return this.buff
+}
+
+func (this *CmdPacket) GetLength() uint32 {
+	return binary.BigEndian.Uint32(this.buff[0:4]) & CMD_FRAME_LENGTH_MASK
+}
+
+func (this *CmdPacket) GetBody() []byte {
+	return this.buff[4:]
+}
+
+// check whether more chunks of the message follow this packet
+func (this *CmdPacket) HasMore() bool {
+	return binary.BigEndian.Uint32(this.buff[0:4]) & CMD_FRAME_MORE != 0
+}
+
+// check whether packet is flow control frame
+func (this *CmdPacket) IsAck() bool {
+	return binary.BigEndian.Uint32(this.buff[0:4]) & CMD_FRAME_ACK != 0
+}
+
+// check whether chunks of message were dropped as it exceeded its limit
+func (this *CmdPacket) TooLarge() bool {
+	return this.tooLarge
+}
+
+func NewCmdPacket(buff []byte, hasLengthField bool) *CmdPacket {
+	p := &CmdPacket{}
+
+	if hasLengthField {
+		p.buff = buff
+
+	} else {
+		p.buff = make([]byte, 4+len(buff))
+		binary.BigEndian.PutUint32(p.buff[0:4], uint32(len(buff)))
+		copy(p.buff[4:], buff)
+	}
+
+	return p
+}
+
+// create frame with given flags
+func newCmdFrame(body []byte, flags uint32) *CmdPacket {
+	p := NewCmdPacket(body, false)
+	binary.BigEndian.PutUint32(p.buff[0:4], uint32(len(body)) | flags)
+
+	return p
+}
+
+// limits of packet protocol
+type CmdProtocol struct {
+	MaxFrameSize   uint32             // the limit of single frame
+	MaxMessageSize uint32             // the limit of message reassembled from chunks
+	ChunkSize      uint32             // the size of chunks of large messages
+	Window         uint32             // bytes of chunks which may be sent before acknowledged
+
+	RequestLimits  map[string]uint32  // the limit of request message per command
+}
+
+// create protocol with default limits
+func NewCmdProtocol() *CmdProtocol {
+	return &CmdProtocol{
+		MaxFrameSize:   KAOHI_DEFAULT_CMD_MAX_FRAME_SIZE,
+		MaxMessageSize: KAOHI_DEFAULT_CMD_MAX_MESSAGE_SIZE,
+		ChunkSize:      KAOHI_DEFAULT_CMD_CHUNK_SIZE,
+		Window:         KAOHI_DEFAULT_CMD_WINDOW,
+		RequestLimits:  map[string]uint32{
+			CMD_APPLY_CONFIG:       KAOHI_DEFAULT_CMD_MAX_MESSAGE_SIZE,
+		},
+	}
+}
+
+// get the limit of request message of the command
+func (this *CmdProtocol) RequestLimit(command string) uint32 {
+	if limit, ok := this.RequestLimits[command]; ok {
+		return limit
+	}
+
+	return KAOHI_DEFAULT_CMD_REQUEST_SIZE
+}
+
+// get the limit of request message by the command in its head, requests
+// whose command can't be decoded have the default limit
+func (this *CmdProtocol) requestLimitOf(head []byte) uint32 {
+	_, command := peekCmdMessage(head)
+	return this.RequestLimit(command)
+}
+
+// read single frame
+func (this *CmdProtocol) ReadPacket(conn io.Reader) (*CmdPacket, error) {
+	var (
+		lengthBytes []byte = make([]byte, 4)
+		length      uint32
+	)
+
+	// read length
+	if _, err := io.ReadFull(conn, lengthBytes); err != nil {
+		return nil, err
+	}
+	if length = binary.BigEndian.Uint32(lengthBytes) & CMD_FRAME_LENGTH_MASK; length > this.MaxFrameSize {
+		return nil, ErrCmdPacketTooLarge
+	}
+
+	buff := make([]byte, 4+length)
+	copy(buff[0:4], lengthBytes)
+
+	// read body ( buff = lengthBytes + body )
+	if _, err := io.ReadFull(conn, buff[4:]); err != nil {
+		return nil, err
+	}
+
+	return NewCmdPacket(buff, true), nil
+}
+
+// packet stream over a connection which splits large messages into chunks
+// and reassembles them, the receiver acknowledges every chunk it consumed
+// and the sender stops when the window of unacknowledged chunks is full.
+// The last chunk of a message is acknowledged only when the message was
+// consumed, so the sender can't queue messages beyond the window
+type CmdStream struct {
+	protocol       *CmdProtocol
+	rw             io.ReadWriter
+	limit          func(head []byte) uint32 // the limit of message by its first chunk
+
+	wmu            sync.Mutex         // serializes frames written by reader and writer
+	mu             sync.Mutex
+	cond           *sync.Cond
+	inFlight       uint32             // bytes of chunks which are not acknowledged
+	closed         bool
+}
+
+func NewCmdStream(rw io.ReadWriter, protocol *CmdProtocol) *CmdStream {
+	s := &CmdStream{
+		protocol:       protocol,
+		rw:             rw,
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	return s
+}
+
+// write frame to connection
+func (this *CmdStream) writeFrame(p *CmdPacket) error {
+	this.wmu.Lock()
+	defer this.wmu.Unlock()
+
+	_, err := this.rw.Write(p.Serialize())
+	return err
+}
+
+// acknowledge consumed chunk
+func (this *CmdStream) ack(n uint32) error {
+	body := make([]byte, 4)
+	binary.BigEndian.PutUint32(body, n)
+
+	return this.writeFrame(newCmdFrame(body, CMD_FRAME_ACK))
+}
+
+// release window by acknowledged bytes
+func (this *CmdStream) release(n uint32) {
+	this.mu.Lock()
+	if n > this.inFlight {
+		n = this.inFlight
+	}
+	this.inFlight -= n
+	this.mu.Unlock()
+
+	this.cond.Broadcast()
+}
+
+// wait until chunk of n bytes fits into window
+func (this *CmdStream) reserve(n uint32) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for !this.closed && this.inFlight > 0 && this.inFlight + n > this.protocol.Window {
+		this.cond.Wait()
+	}
+	if this.closed {
+		return ErrConnClosing
+	}
+	this.inFlight += n
+
+	return nil
+}
+
+// read message, chunks are reassembled and acknowledge frames are consumed;
+// chunks of message which exceeds its limit are dropped as they arrive and
+// only its first chunk is returned, marked as too large
+func (this *CmdStream) ReadPacket() (*CmdPacket, error) {
+	var body, head []byte
+	limit := this.protocol.MaxMessageSize
+	tooLarge := false
+
+	for {
+		p, err := this.protocol.ReadPacket(this.rw)
+		if err != nil {
+			return nil, err
+		}
+
+		if p.IsAck() {
+			if len(p.GetBody()) == 4 {
+				this.release(binary.BigEndian.Uint32(p.GetBody()))
+			}
+			continue
+		}
+
+		if head == nil {
+			if !p.HasMore() {
+				return p, nil
+			}
+
+			head = p.GetBody()
+			if this.limit != nil {
+				if l := this.limit(head); l < limit {
+					limit = l
+				}
+			}
+		}
+
+		if !tooLarge && uint64(len(body)) + uint64(p.GetLength()) > uint64(limit) {
+			tooLarge = true
+			body = nil
+		}
+		if !tooLarge {
+			body = append(body, p.GetBody()...)
+		}
+
+		if !p.HasMore() {
+			packet := NewCmdPacket(body, false)
+			if tooLarge {
+				packet = NewCmdPacket(head, false)
+				packet.tooLarge = true
+			}
+			packet.unacked = p.GetLength()
+			return packet, nil
+		}
+
+		if err := this.ack(p.GetLength()); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// acknowledge the last chunk of message which was consumed
+func (this *CmdStream) Consumed(p *CmdPacket) error {
+	if p.unacked == 0 {
+		return nil
+	}
+
+	return this.ack(p.unacked)
+}
+
+// write message, messages larger than chunk size are sent in chunks
+func (this *CmdStream) WritePacket(p *CmdPacket) error {
+	body := p.GetBody()
+	if uint32(len(body)) <= this.protocol.ChunkSize {
+		return this.writeFrame(p)
+	}
+
+	for len(body) > 0 {
+		n := uint32(len(body))
+		flags := uint32(0)
+		if n > this.protocol.ChunkSize {
+			n = this.protocol.ChunkSize
+			flags = CMD_FRAME_MORE
+		}
+
+		if err := this.reserve(n); err != nil {
+			return err
+		}
+		if err := this.writeFrame(newCmdFrame(body[:n], flags)); err != nil {
+			return err
+		}
+		body = body[n:]
+	}
+
+	return nil
+}
+
+// wake up writers which wait for window
+func (this *CmdStream) Close() {
+	this.mu.Lock()
+	this.closed = true
+	this.mu.Unlock()
+
+	this.cond.Broadcast()
+}
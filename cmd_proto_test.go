@@ -0,0 +1,237 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCmdProtocol() *CmdProtocol {
+	protocol := NewCmdProtocol()
+	protocol.ChunkSize = 16
+	protocol.Window = 32
+
+	return protocol
+}
+
+// create connected streams, acknowledges received by sender are consumed
+// in background
+func newTestCmdStreams(t *testing.T, protocol *CmdProtocol) (*CmdStream, *CmdStream) {
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+
+	sender := NewCmdStream(a, protocol)
+	go func() {
+		for {
+			if _, err := sender.ReadPacket(); err != nil {
+				return
+			}
+		}
+	}()
+
+	return sender, NewCmdStream(b, protocol)
+}
+
+func inFlight(s *CmdStream) uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.inFlight
+}
+
+// wait until bytes of chunks in flight are n
+func waitInFlight(t *testing.T, s *CmdStream, n uint32) {
+	deadline := time.Now().Add(time.Second)
+	for inFlight(s) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d bytes in flight, expected %d", inFlight(s), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCmdStreamReassemblesChunks(t *testing.T) {
+	sender, receiver := newTestCmdStreams(t, newTestCmdProtocol())
+
+	body := []byte(strings.Repeat("0123456789", 4))
+	go sender.WritePacket(NewCmdPacket(body, false))
+
+	p, err := receiver.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p.GetBody(), body) || p.TooLarge() {
+		t.Fatalf("unexpected message %q", p.GetBody())
+	}
+
+	// the last chunk of 8 bytes is acknowledged once consumed
+	waitInFlight(t, sender, 8)
+	if err := receiver.Consumed(p); err != nil {
+		t.Fatal(err)
+	}
+	waitInFlight(t, sender, 0)
+}
+
+func TestCmdStreamPlainFrameIsNotAcknowledged(t *testing.T) {
+	sender, receiver := newTestCmdStreams(t, newTestCmdProtocol())
+
+	go sender.WritePacket(NewCmdPacket([]byte("short"), false))
+
+	p, err := receiver.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p.GetBody()) != "short" || p.HasMore() || p.unacked != 0 {
+		t.Fatalf("unexpected message %q", p.GetBody())
+	}
+}
+
+func TestCmdStreamWindowWaitsForConsumer(t *testing.T) {
+	sender, receiver := newTestCmdStreams(t, newTestCmdProtocol())
+
+	packets := make(chan *CmdPacket, 8)
+	go func() {
+		for {
+			p, err := receiver.ReadPacket()
+			if err != nil {
+				return
+			}
+			packets <- p
+		}
+	}()
+
+	// every message leaves its last chunk of 8 bytes unacknowledged, so the
+	// fourth one doesn't fit into window until a message is consumed
+	body := []byte(strings.Repeat("x", 24))
+	go func() {
+		for i := 0; i < 4; i++ {
+			if err := sender.WritePacket(NewCmdPacket(body, false)); err != nil {
+				return
+			}
+		}
+	}()
+
+	var received []*CmdPacket
+	for len(received) < 3 {
+		select {
+		case p := <-packets:
+			received = append(received, p)
+		case <-time.After(time.Second):
+			t.Fatalf("%d messages received", len(received))
+		}
+	}
+	select {
+	case <-packets:
+		t.Fatal("message was sent beyond window")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := receiver.Consumed(received[0]); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-packets:
+	case <-time.After(time.Second):
+		t.Fatal("message wasn't sent after consuming")
+	}
+}
+
+func TestCmdStreamDropsChunksOverCommandLimit(t *testing.T) {
+	// the head of request with its command fits into the first chunk
+	protocol := newTestCmdProtocol()
+	protocol.ChunkSize = 64
+	protocol.Window = 256
+	protocol.RequestLimits[CMD_APPLY_CONFIG] = 128
+	sender, receiver := newTestCmdStreams(t, protocol)
+	receiver.limit = protocol.requestLimitOf
+
+	for _, codec := range []kCmdCodec{kJSONCodec{}, kCBORCodec{}} {
+		req, err := EncodeCmdMessage(codec, &kCmdMessage{
+			Type:    CMD_MSG_REQUEST,
+			ID:      7,
+			Command: CMD_APPLY_CONFIG,
+			Body:    kCmdApplyArgs{Content: strings.Repeat("x", 300)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go sender.WritePacket(req)
+
+		p, err := receiver.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !p.TooLarge() || len(p.GetBody()) > int(protocol.ChunkSize) {
+			t.Fatalf("too large request was kept: %d bytes", len(p.GetBody()))
+		}
+		if id, command := peekCmdMessage(p.GetBody()); id != 7 || command != CMD_APPLY_CONFIG {
+			t.Fatalf("head decoded to %d %q", id, command)
+		}
+		receiver.Consumed(p)
+
+		// the stream is still usable after the dropped request
+		small := NewCmdPacket([]byte(strings.Repeat("y", 100)), false)
+		go sender.WritePacket(small)
+		if p, err = receiver.ReadPacket(); err != nil || p.TooLarge() || len(p.GetBody()) != 100 {
+			t.Fatalf("unexpected message after dropped request: %v", err)
+		}
+		receiver.Consumed(p)
+	}
+}
+
+func TestPeekCmdMessage(t *testing.T) {
+	msg := &kCmdMessage{
+		Type:    CMD_MSG_REQUEST,
+		ID:      42,
+		Command: CMD_APPLY_CONFIG,
+		Body:    kCmdApplyArgs{Content: strings.Repeat("x", 1000)},
+	}
+
+	for _, codec := range []kCmdCodec{kJSONCodec{}, kCBORCodec{}} {
+		body, err := codec.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if id, command := peekCmdMessage(body[:48]); id != 42 || command != CMD_APPLY_CONFIG {
+			t.Errorf("%T: head decoded to %d %q", codec, id, command)
+		}
+		if id, command := peekCmdMessage(body[:8]); id != 0 || command != "" {
+			t.Errorf("%T: short head decoded to %d %q", codec, id, command)
+		}
+	}
+
+	if _, command := peekCmdMessage([]byte("garbage")); command != "" {
+		t.Fatalf("garbage decoded to %q", command)
+	}
+}
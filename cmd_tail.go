@@ -0,0 +1,244 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tail subscription of console connection
+type kTailSubscription struct {
+	conn           *Conn
+	id             uint32
+	codec          kCmdCodec
+	group          string
+	source         string
+	match          *regexp.Regexp
+	events         chan *kEvent
+	done           chan struct{}
+	sent           uint64
+	dropped        uint64
+}
+
+// tail subscribers structure
+type kTailSubscribers struct {
+	mu             sync.RWMutex
+	subs           map[*Conn][]*kTailSubscription
+	count          int32
+}
+
+// global variable for tail subscribers
+var kTailSubs = kTailSubscribers{
+	subs:           make(map[*Conn][]*kTailSubscription),
+}
+
+// create subscription of connection
+func newTailSubscription(c *Conn, id uint32, codec kCmdCodec) *kTailSubscription {
+	return &kTailSubscription{
+		conn:           c,
+		id:             id,
+		codec:          codec,
+		events:         make(chan *kEvent, KAOHI_TAIL_QUEUE_SIZE),
+		done:           make(chan struct{}),
+	}
+}
+
+// check whether the event matches group and source of subscription, it's
+// cheap enough to be checked by publisher
+func (sub *kTailSubscription) accepts(ev *kEvent) bool {
+	if sub.group != "" && sub.group != ev.Group {
+		return false
+	}
+	if sub.source != "" && sub.source != ev.Source {
+		return false
+	}
+
+	return true
+}
+
+// queue event for subscriber without blocking, the event is dropped if the
+// queue of subscription is full
+func (sub *kTailSubscription) publish(ev *kEvent) {
+	select {
+	case sub.events <- ev:
+	default:
+		atomic.AddUint64(&sub.dropped, 1)
+	}
+}
+
+// filter and send queued events until subscription is removed
+func (sub *kTailSubscription) run() {
+	for {
+		select {
+		case <-sub.done:
+			return
+
+		case ev := <-sub.events:
+			if sub.match != nil && !sub.match.MatchString(ev.Message) {
+				continue
+			}
+			sub.send(ev)
+		}
+	}
+}
+
+// send event to subscriber without blocking, the event is dropped if half
+// of the send queue of connection is used, so responses still fit in it
+func (sub *kTailSubscription) send(ev *kEvent) {
+	if sub.conn.PendingPackets() >= KAOHI_CMD_SEND_QUEUE_SIZE / 2 {
+		atomic.AddUint64(&sub.dropped, 1)
+		return
+	}
+
+	msg := &kCmdMessage{
+		Type:           CMD_MSG_EVENT,
+		ID:             sub.id,
+		Body:           &kCmdTailEvent{
+			Time:           ev.Time.UTC().Format(time.RFC3339Nano),
+			Host:           ev.Host,
+			Group:          ev.Group,
+			Source:         ev.Source,
+			Message:        ev.Message,
+			Fields:         ev.Fields,
+			Dropped:        atomic.LoadUint64(&sub.dropped),
+		},
+	}
+
+	packet, err := EncodeCmdMessage(sub.codec, msg)
+	if err != nil {
+		atomic.AddUint64(&sub.dropped, 1)
+		return
+	}
+
+	switch sub.conn.AsyncWritePacket(packet, 0) {
+	case nil:
+		atomic.AddUint64(&sub.sent, 1)
+	case ErrWriteBlocking:
+		atomic.AddUint64(&sub.dropped, 1)
+	}
+}
+
+// publish event to subscribers, regular expressions are matched and events
+// encoded by goroutines of subscriptions
+func publishTailEvent(ev *kEvent) {
+	if atomic.LoadInt32(&kTailSubs.count) == 0 {
+		return
+	}
+
+	kTailSubs.mu.RLock()
+	defer kTailSubs.mu.RUnlock()
+
+	for _, subs := range kTailSubs.subs {
+		for _, sub := range subs {
+			if sub.accepts(ev) {
+				sub.publish(ev)
+			}
+		}
+	}
+}
+
+// add subscription
+func addTailSubscription(sub *kTailSubscription) {
+	kTailSubs.mu.Lock()
+	defer kTailSubs.mu.Unlock()
+
+	kTailSubs.subs[sub.conn] = append(kTailSubs.subs[sub.conn], sub)
+	atomic.AddInt32(&kTailSubs.count, 1)
+
+	go sub.run()
+}
+
+// remove subscription of connection, all subscriptions are removed if id is zero
+func removeTailSubscriptions(c *Conn, id uint32) int {
+	kTailSubs.mu.Lock()
+	defer kTailSubs.mu.Unlock()
+
+	var kept []*kTailSubscription
+	removed := 0
+	for _, sub := range kTailSubs.subs[c] {
+		if id != 0 && sub.id != id {
+			kept = append(kept, sub)
+			continue
+		}
+		close(sub.done)
+		DEBUG_INFO("Removed tail subscription %d of %v, sent %d, dropped %d",
+			sub.id, c.GetExtraData(), atomic.LoadUint64(&sub.sent), atomic.LoadUint64(&sub.dropped))
+		removed++
+	}
+
+	if len(kept) == 0 {
+		delete(kTailSubs.subs, c)
+	} else {
+		kTailSubs.subs[c] = kept
+	}
+	atomic.AddInt32(&kTailSubs.count, -int32(removed))
+
+	return removed
+}
+
+// subscribe to event stream, the events are sent with the request id
+func handleSubscribe(ctx *kContext, c *Conn, msg *kCmdMessage, codec kCmdCodec) (interface{}, error) {
+	var args kCmdTailArgs
+
+	if err := msg.DecodeBody(codec, &args); err != nil || msg.ID == 0 {
+		return nil, newCmdError(CMD_STATUS_BAD_REQUEST, ErrCmdInvalidArgs)
+	}
+
+	sub := newTailSubscription(c, msg.ID, codec)
+	sub.group = args.Group
+	sub.source = args.Source
+
+	if args.Match != "" {
+		match, err := regexp.Compile(args.Match)
+		if err != nil {
+			return nil, newCmdError(CMD_STATUS_BAD_REQUEST, err)
+		}
+		sub.match = match
+	}
+
+	DEBUG_INFO("Added tail subscription %d of %v", msg.ID, c.GetExtraData())
+	addTailSubscription(sub)
+
+	return nil, nil
+}
+
+// unsubscribe from event stream
+func handleUnsubscribe(ctx *kContext, c *Conn, msg *kCmdMessage, codec kCmdCodec) (interface{}, error) {
+	var args kCmdUnsubscribeArgs
+
+	if err := msg.DecodeBody(codec, &args); err != nil {
+		return nil, newCmdError(CMD_STATUS_BAD_REQUEST, ErrCmdInvalidArgs)
+	}
+
+	if removeTailSubscriptions(c, args.ID) == 0 {
+		return nil, newCmdError(CMD_STATUS_NOT_FOUND, ErrCmdNoSubscription)
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCmdListenerConfig(socket string) *kConfigScheme {
+	config := NewKaohiConfig()
+	config.configs.CmdListener.UnixSocket = socket
+
+	return config
+}
+
+func TestRebindCmdListenerAfterFailedRestore(t *testing.T) {
+	dir := t.TempDir()
+	ctx := NewKaohiContext()
+	good := newTestCmdListenerConfig(filepath.Join(dir, "kaohi.sock"))
+	bad := newTestCmdListenerConfig(filepath.Join(dir, "missing", "kaohi.sock"))
+
+	if err := startCmdListener(ctx, good); err != nil {
+		t.Fatal(err)
+	}
+	defer FinalizeCmdListener()
+
+	// neither new nor previous configuration can be bound
+	if err := RebindCmdListener(ctx, bad, bad); err == nil {
+		t.Fatal("listener was bound to missing directory")
+	}
+	if cmdListenerListening() || cmdListenerHealth().Status != HEALTH_STATUS_FAIL {
+		t.Fatal("listener is reported as listening")
+	}
+
+	// the next reload rebinds it without a running listener
+	if err := RebindCmdListener(ctx, bad, bad); err == nil {
+		t.Fatal("listener was bound to missing directory")
+	}
+	if err := RebindCmdListener(ctx, bad, good); err != nil {
+		t.Fatal(err)
+	}
+	if !cmdListenerListening() || cmdListenerHealth().Status != HEALTH_STATUS_OK {
+		t.Fatal("listener isn't reported as listening")
+	}
+}
+
+func TestCmdListenerRejectsRequestOverCommandLimit(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "kaohi.sock")
+	config := newTestCmdListenerConfig(socket)
+	config.configs.CmdListener.RequestLimits = map[string]int{CMD_APPLY_CONFIG: 1024}
+
+	if err := startCmdListener(NewKaohiContext(), config); err != nil {
+		t.Fatal(err)
+	}
+	defer FinalizeCmdListener()
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	stream := NewCmdStream(conn, NewCmdProtocol())
+	responses := make(chan *CmdPacket, 1)
+	go func() {
+		for {
+			p, err := stream.ReadPacket()
+			if err != nil {
+				close(responses)
+				return
+			}
+			responses <- p
+		}
+	}()
+
+	req, err := EncodeCmdMessage(kJSONCodec{}, &kCmdMessage{
+		Type:    CMD_MSG_REQUEST,
+		ID:      9,
+		Command: CMD_APPLY_CONFIG,
+		Body:    kCmdApplyArgs{Content: strings.Repeat("x", 3 * KAOHI_DEFAULT_CMD_CHUNK_SIZE)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.WritePacket(req); err != nil {
+		t.Fatal(err)
+	}
+
+	p, ok := <-responses
+	if !ok {
+		t.Fatal("connection was closed")
+	}
+	resp, _, err := DecodeCmdMessage(p.GetBody())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != CMD_STATUS_TOO_LARGE || resp.ID != 9 || resp.Command != CMD_APPLY_CONFIG {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+}
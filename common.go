@@ -27,17 +27,80 @@ package main
 
 import (
 	"errors"
+	"time"
+)
+
+// version
+const (
+	KAOHI_VERSION                    = "0.1.0"
+)
+
+// log levels, messages above the level are not printed
+const (
+	LOG_LEVEL_ERR                    = 0
+	LOG_LEVEL_WARN                   = 1
+	LOG_LEVEL_INFO                   = 2
+	LOG_LEVEL_DEBUG                  = 3
+)
+
+var kLogLevelNames = []string{"error", "warn", "info", "debug"}
+
+// exit status of daemon
+const (
+	KAOHI_EXIT_OK                    = 0
+	KAOHI_EXIT_FAILURE               = 1
+	KAOHI_EXIT_NOT_RUNNING           = 3 // service status, as in LSB init scripts
+	KAOHI_EXIT_FORCED                = 4 // shutdown was forced by second signal
+	KAOHI_EXIT_UNDELIVERED           = 5 // some events could not be delivered until shutdown deadline
 )
 
 // default option values
 const (
 	KAOHI_DEFAULT_CONFIG_FILE        = "/etc/kaohi.conf"
+	KAOHI_DEFAULT_INCLUDE_DIR        = "kaohi.d" // next to configuration file
 	KAOHI_HCLOPT_FNAME               = "config.mel"
 
+	KAOHI_DEFAULT_CONTAINERS_DIR     = "/var/log/containers"
+	KAOHI_DEFAULT_PODS_DIR           = "/var/log/pods"
+
+	KAOHI_DEFAULT_STATE_DIR          = "/var/lib/kaohi"
+	KAOHI_DEFAULT_JOURNALCTL         = "journalctl"
+	KAOHI_DEFAULT_AUDIT_LOG          = "/var/log/audit/audit.log"
+
 	KAOHI_DEFAULT_LOG_DIR            = "/var/log/kaohi"
 	KAOHI_DEFAULT_LOG_LEVEL          = "NORMAL"
+	KAOHI_DEFAULT_LOG_MAX_SIZE       = 10 // MB
+	KAOHI_DEFAULT_LOG_MAX_FILES      = 5
+
+	KAOHI_DEFAULT_METRICS_PATH       = "/metrics"
+	KAOHI_METRICS_TIMEOUT            = 10 * time.Second
+	KAOHI_HEALTHZ_PATH               = "/healthz"
+	KAOHI_READYZ_PATH                = "/readyz"
+	KAOHI_DEFAULT_HIGH_WATER_MARK    = 80 // percent of queue capacity
+	KAOHI_HEALTH_WATCHER_TIMEOUT     = 10 * time.Second
+
+	KAOHI_DEFAULT_INTERNAL_QUEUE_SIZE = 1024
+	KAOHI_INTERNAL_DROP_CHECK_INTERVAL = 10 * time.Second
+	KAOHI_INTERNAL_CALLER_LIMIT      = 10
+	KAOHI_INTERNAL_CALLER_INTERVAL   = time.Minute
+
+	KAOHI_SERVICE_NAME               = "kaohi"
+	KAOHI_SERVICE_UNIT_DIR           = "/etc/systemd/system"
+	KAOHI_SERVICE_WATCHDOG           = 30 * time.Second
+	KAOHI_SERVICE_STOP_MARGIN        = 15 * time.Second // on top of shutdown timeout
 
 	KAOHI_DEFAULT_LISTEN_ADDR        = "127.0.0.1:6688"
+	KAOHI_DEFAULT_SHUTDOWN_TIMEOUT   = 30 * time.Second
+	KAOHI_DEFAULT_SOCKET_MODE        = 0660
+	KAOHI_DEFAULT_TCP_ROLE           = "none"
+	KAOHI_CMD_HANDSHAKE_TIMEOUT      = 10 * time.Second
+	KAOHI_DEFAULT_CMD_MAX_FRAME_SIZE = 64 * 1024
+	KAOHI_DEFAULT_CMD_MAX_MESSAGE_SIZE = 16 * 1024 * 1024
+	KAOHI_DEFAULT_CMD_REQUEST_SIZE   = 1024
+	KAOHI_DEFAULT_CMD_CHUNK_SIZE     = 16 * 1024
+	KAOHI_DEFAULT_CMD_WINDOW         = 256 * 1024
+	KAOHI_CMD_SEND_QUEUE_SIZE        = 256
+	KAOHI_TAIL_QUEUE_SIZE            = 256
 
 	KAOHI_RA_SOCK_PATH               = "/var/run/.kaohi_ra"
 
@@ -47,12 +110,37 @@ const (
 	KAOHI_DEFAULT_SYSLOG_STATUE      = 0
 	KAOHI_DEFAULT_SYSLOG_LISTEN_ADDR = "0.0.0.0:5443"
 	KAOHI_DEFAULT_SYSLOG_PROTO       = "tcp"
+
+	KAOHI_DEFAULT_OUTPUT_QUEUE_SIZE  = 4096
+	KAOHI_DEFAULT_OUTPUT_FLUSH_TIMEOUT = 5 * time.Second
+	KAOHI_DEFAULT_OUTPUT_BATCH_SIZE  = 500
+	KAOHI_DEFAULT_OUTPUT_FLUSH_INTERVAL = 5 * time.Second
+
+	KAOHI_DEFAULT_SYSLOG_FACILITY    = 1
+	KAOHI_DEFAULT_SYSLOG_SEVERITY    = 5
+	KAOHI_DEFAULT_SYSLOG_APPNAME     = "kaohi"
+
+	KAOHI_DEFAULT_HTTP_ENCODER       = "ndjson"
+	KAOHI_DEFAULT_HTTP_TIMEOUT       = 30
+	KAOHI_DEFAULT_HTTP_MAX_RETRIES   = 5
+	KAOHI_DEFAULT_HTTP_RETRY_INTERVAL = 1
+	KAOHI_HTTP_MAX_RETRY_WAIT        = 5 * time.Minute
+
+	KAOHI_DEFAULT_ELASTIC_INDEX      = "kaohi-%{+2006.01.02}"
+	ELASTIC_INDEX_INVALID_CHARS      = "\\/*?\"<>| ,#"
+
+	KAOHI_DEFAULT_KAFKA_CLIENT_ID    = "kaohi"
+	KAOHI_DEFAULT_KAFKA_MAX_RETRIES  = 10
+
+	KAOHI_DEFAULT_FILE_FLUSH_INTERVAL = 1 * time.Second
 )
 
 var (
 	ErrUnsupportedSystem = errors.New("Unsupported system")
 
 	ErrRootPriveleges = errors.New("You must have root user privileges. Possibly using 'sudo' command should help")
+	// missing capabilities
+	ErrMissingCapabilities = errors.New("Missing capabilities required by configuration")
 
 	ErrAlreadyInstalled = errors.New("Service has already been installed")
 
@@ -75,11 +163,19 @@ var (
 
 	ErrConfigSaveFailed = errors.New("The configuration file could not be opened for writting")
 
+	ErrConfigInvalid = errors.New("Invalid configuration")
+
+	ErrShuttingDown = errors.New("Kaohi is shutting down")
+
 	// errors related with logger
 	ErrCreateLogDir = errors.New("Could not create log directory")
 
 	ErrCreateLogFile = errors.New("Could not create log file")
 
+	ErrInvalidLogLevel = errors.New("Invalid log level, expected 0 ~ 3 or error, warn, info, debug")
+
+	ErrInvalidLogFormat = errors.New("Invalid log format, expected text or json")
+
 	// errors related with command listener
 	ErrResolveAddr = errors.New("Could not resolve address for listen")
 
@@ -91,6 +187,80 @@ var (
 
 	ErrReadBlocking  = errors.New("read packet was blocking")
 
+	ErrCmdInvalidMessage = errors.New("Invalid command message")
+
+	ErrCmdUnknownCommand = errors.New("Unknown command")
+
+	ErrCmdInvalidArgs = errors.New("Invalid command arguments")
+
+	ErrCmdInputNotFound = errors.New("The input isn't exist")
+
+	ErrCmdNoSubscription = errors.New("No such subscription")
+
+	ErrCmdPermissionDenied = errors.New("Permission denied")
+
+	ErrCmdPacketTooLarge = errors.New("The size of packet is larger than the limit")
+
+	ErrCmdInvalidRole = errors.New("Invalid command role")
+
+	ErrCmdInvalidSocketMode = errors.New("Invalid socket mode")
+
+	ErrCmdPeerCredUnsupported = errors.New("Peer credentials are not supported on this platform")
+
+	// errors related with console
+	ErrConsoleInvalidArgs = errors.New("Invalid arguments")
+
+	ErrConsoleTimeout = errors.New("Timed out waiting for response")
+
 	// errors related with watcher
 	ErrWatchedFileDeleted = errors.New("The wathed file was deleted")
+
+	// errors related with outputs
+	ErrOutputQueueFull = errors.New("The output queue is full")
+
+	ErrOutputFlushTimeout = errors.New("Timed out while flushing output")
+
+	ErrInvalidCACert = errors.New("Could not load CA certificates")
+
+	ErrSyslogNoDestination = errors.New("No destination is specified for syslog output")
+
+	ErrSyslogInvalidDestination = errors.New("Invalid syslog destination, expected udp://, tcp:// or tls://host:port")
+
+	ErrSyslogInvalidFacility = errors.New("Invalid syslog facility, expected 0 ~ 23")
+
+	ErrSyslogInvalidSeverity = errors.New("Invalid syslog severity, expected 0 ~ 7")
+
+	ErrSyslogInvalidSdID = errors.New("Invalid syslog SD-ID, expected name@<private enterprise number>")
+
+	ErrUnknownEncoder = errors.New("Unknown event encoder, expected ndjson or json")
+
+	ErrUnknownCompression = errors.New("Unknown compression method")
+
+	ErrHTTPNoURL = errors.New("No URL is specified for HTTP output")
+
+	ErrHTTPRejected = errors.New("The request was rejected by server")
+
+	ErrHTTPRetriesExhausted = errors.New("All retries of the request have failed")
+
+	ErrElasticNoURL = errors.New("No URL is specified for elasticsearch output")
+
+	ErrElasticInvalidResponse = errors.New("Invalid response of bulk request")
+
+	ErrKafkaNoBroker = errors.New("No broker is specified for kafka output")
+
+	ErrKafkaNoTopic = errors.New("No topic is specified for kafka output")
+
+	ErrKafkaInvalidAcks = errors.New("Invalid kafka acks, expected all, leader or none")
+
+	ErrKafkaInvalidPartitioner = errors.New("Invalid kafka partitioner, expected hash, random or roundrobin")
+
+	ErrKafkaInvalidMaxRetries = errors.New("Invalid kafka max retries, expected a positive number")
+
+	ErrSpoolCorruptSegment = errors.New("Spool segment could not be decoded and was moved aside")
+
+	ErrFileOutputNoPath = errors.New("No path is specified for file output")
+
+	ErrFileOutputInvalidFormat = errors.New("Invalid file output format, expected json or raw")
+
+	ErrTemplateInvalidPath = errors.New("The expanded path is outside of the template directory")
 )
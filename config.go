@@ -26,14 +26,27 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
 	"github.com/riboseinc/go-nereon"
 )
 
 type kGlobalConfig struct {
 	LogDir         string             `hcl:"log_directory"`
 	LogLevel       int                `hcl:"log_level"`
+	LogFormat      string             `hcl:"log_format"`
+	LogMaxSize     int                `hcl:"log_max_size"`
+	LogMaxFiles    int                `hcl:"log_max_files"`
 
 	ListenAddr     string             `hcl:"listen_address"`
+
+	ShutdownTimeout int               `hcl:"shutdown_timeout"`
+	IncludeDir     string             `hcl:"include_dir"`
 }
 
 type kFilesConfig struct {
@@ -41,6 +54,27 @@ type kFilesConfig struct {
 	Files          []string           `hcl:"files"`
 }
 
+type kContainersConfig struct {
+	Name           string             `hcl:",key"`
+	ContainersDir  string             `hcl:"containers_dir"`
+	PodsDir        string             `hcl:"pods_dir"`
+	Namespaces     []string           `hcl:"namespaces"`
+	ExcludeNamespaces []string        `hcl:"exclude_namespaces"`
+}
+
+type kJournalConfig struct {
+	Name           string             `hcl:",key"`
+	Units          []string           `hcl:"units"`
+	Matches        []string           `hcl:"matches"`
+	CursorFile     string             `hcl:"cursor_file"`
+	Journalctl     string             `hcl:"journalctl"`
+}
+
+type kAuditConfig struct {
+	Name           string             `hcl:",key"`
+	File           string             `hcl:"file"`
+}
+
 type kCommandsConfig struct {
 	Name           string             `hcl:",key"`
 	Uid            int                `hcl:"uid"`
@@ -53,20 +87,155 @@ type kRsyslogConfig struct {
 	Protocol       string             `hcl:"protocol"`
 }
 
+type kInternalEventsConfig struct {
+	Enabled        bool               `hcl:"enabled"`
+	Level          string             `hcl:"level"`
+}
+
+type kMetricsConfig struct {
+	ListenAddr     string             `hcl:"listen_address"`
+	Path           string             `hcl:"path"`
+	HighWaterMark  int                `hcl:"queue_high_water_mark"`
+}
+
+type kTLSConfig struct {
+	CAFile         string             `hcl:"ca_file"`
+	CertFile       string             `hcl:"cert_file"`
+	KeyFile        string             `hcl:"key_file"`
+	ServerName     string             `hcl:"server_name"`
+	SkipVerify     bool               `hcl:"skip_verify"`
+}
+
+type kCmdListenerConfig struct {
+	UnixSocket     string             `hcl:"unix_socket"`
+	SocketMode     string             `hcl:"socket_mode"`
+	AllowUids      []int              `hcl:"allow_uids"`
+	AllowGids      []int              `hcl:"allow_gids"`
+	AdminUids      []int              `hcl:"admin_uids"`
+	AdminGids      []int              `hcl:"admin_gids"`
+	TLS            kTLSConfig         `hcl:"tls"`
+	AllowNames     []string           `hcl:"allow_names"`
+	AdminNames     []string           `hcl:"admin_names"`
+	TCPRole        string             `hcl:"tcp_role"`
+	MaxFrameSize   int                `hcl:"max_frame_size"`
+	MaxMessageSize int                `hcl:"max_message_size"`
+	StreamWindow   int                `hcl:"stream_window"`
+	RequestLimits  map[string]int     `hcl:"request_limits"`
+}
+
+type kSyslogOutputConfig struct {
+	Name           string             `hcl:",key"`
+	Destinations   []string           `hcl:"destinations"`
+	Facility       *int               `hcl:"facility"`
+	Severity       *int               `hcl:"severity"`
+	AppName        string             `hcl:"app_name"`
+	SdID           string             `hcl:"sd_id"`
+	QueueSize      int                `hcl:"queue_size"`
+	TLS            kTLSConfig         `hcl:"tls"`
+}
+
+type kHTTPOutputConfig struct {
+	Name           string             `hcl:",key"`
+	URL            string             `hcl:"url"`
+	Encoder        string             `hcl:"encoder"`
+	Compression    string             `hcl:"compression"`
+	Headers        map[string]string  `hcl:"headers"`
+	Username       string             `hcl:"username"`
+	Password       string             `hcl:"password"`
+	BearerToken    string             `hcl:"bearer_token"`
+	Timeout        int                `hcl:"timeout"`
+	BatchSize      int                `hcl:"batch_size"`
+	FlushInterval  int                `hcl:"flush_interval"`
+	QueueSize      int                `hcl:"queue_size"`
+	MaxRetries     int                `hcl:"max_retries"`
+	RetryInterval  int                `hcl:"retry_interval"`
+	DeadLetterFile string             `hcl:"dead_letter_file"`
+	TLS            kTLSConfig         `hcl:"tls"`
+}
+
+type kElasticOutputConfig struct {
+	Name           string             `hcl:",key"`
+	URL            string             `hcl:"url"`
+	Index          string             `hcl:"index"`
+	IDFromHash     bool               `hcl:"id_from_hash"`
+	Compression    string             `hcl:"compression"`
+	Username       string             `hcl:"username"`
+	Password       string             `hcl:"password"`
+	BearerToken    string             `hcl:"bearer_token"`
+	Timeout        int                `hcl:"timeout"`
+	BatchSize      int                `hcl:"batch_size"`
+	FlushInterval  int                `hcl:"flush_interval"`
+	QueueSize      int                `hcl:"queue_size"`
+	MaxRetries     int                `hcl:"max_retries"`
+	RetryInterval  int                `hcl:"retry_interval"`
+	DeadLetterFile string             `hcl:"dead_letter_file"`
+	TLS            kTLSConfig         `hcl:"tls"`
+}
+
+type kKafkaOutputConfig struct {
+	Name           string             `hcl:",key"`
+	Brokers        []string           `hcl:"brokers"`
+	Topic          string             `hcl:"topic"`
+	KeyField       string             `hcl:"key_field"`
+	ClientID       string             `hcl:"client_id"`
+	Version        string             `hcl:"version"`
+	Acks           string             `hcl:"acks"`
+	Compression    string             `hcl:"compression"`
+	Partitioner    string             `hcl:"partitioner"`
+	BatchSize      int                `hcl:"batch_size"`
+	FlushInterval  int                `hcl:"flush_interval"`
+	QueueSize      int                `hcl:"queue_size"`
+	MaxRetries     int                `hcl:"max_retries"`
+	RetryInterval  int                `hcl:"retry_interval"`
+	DeadLetterFile string             `hcl:"dead_letter_file"`
+	SpoolDir       string             `hcl:"spool_dir"`
+	TLS            kTLSConfig         `hcl:"tls"`
+}
+
+type kFileOutputConfig struct {
+	Name           string             `hcl:",key"`
+	Path           string             `hcl:"path"`
+	Format         string             `hcl:"format"`
+	MaxSize        int                `hcl:"max_size"`
+	RotateInterval int                `hcl:"rotate_interval"`
+	Compression    string             `hcl:"compression"`
+	MaxFiles       int                `hcl:"max_files"`
+	MaxAge         int                `hcl:"max_age"`
+	BatchSize      int                `hcl:"batch_size"`
+	FlushInterval  int                `hcl:"flush_interval"`
+	QueueSize      int                `hcl:"queue_size"`
+}
+
 type kConfig struct {
 	Globals        kGlobalConfig       `hcl:"global"`
 	ConfigFiles    []kFilesConfig      `hcl:"config-files"`
 	Commands       []kCommandsConfig   `hcl:"commands"`
+	Containers     []kContainersConfig `hcl:"containers"`
+	Journals       []kJournalConfig    `hcl:"journal"`
+	Audits         []kAuditConfig      `hcl:"audit"`
 	Rsyslog        kRsyslogConfig      `hcl:"rsyslog"`
+	CmdListener    kCmdListenerConfig  `hcl:"command-listener"`
+	InternalEvents kInternalEventsConfig `hcl:"internal-events"`
+	Metrics        kMetricsConfig      `hcl:"metrics"`
+
+	SyslogOutputs  []kSyslogOutputConfig `hcl:"syslog-output"`
+	HTTPOutputs    []kHTTPOutputConfig   `hcl:"http-output"`
+	ElasticOutputs []kElasticOutputConfig `hcl:"elasticsearch-output"`
+	KafkaOutputs   []kKafkaOutputConfig  `hcl:"kafka-output"`
+	FileOutputs    []kFileOutputConfig   `hcl:"file-output"`
 }
 
 type kConfigScheme struct {
 	configs        *kConfig
+	path           string
+	includes       []string
+	origins        map[string]string
 }
 
 func NewKaohiConfig() *kConfigScheme {
 	return &kConfigScheme{
 		configs:   &kConfig{},
+		origins:   make(map[string]string),
 	}
 }
 
@@ -77,10 +246,146 @@ func (config *kConfigScheme) ParseConfig(cfg_path string) error {
 		return err
 	}
 
+	return config.mergeIncludes(cfg_path)
+}
+
+// parse configuration file without printing usage of command line on error
+func (config *kConfigScheme) ParseConfigFile(cfg_path string) error {
+	cfg := mconfig.NewConfigScheme()
+	if err := cfg.ParseConfig(CONFIG_HCL_OPTS, cfg_path, config.configs); err != nil {
+		return err
+	}
+
+	return config.mergeIncludes(cfg_path)
+}
+
+// merge *.conf files of include directory in lexical order, only list
+// sections like config-files and commands are taken from included files
+func (config *kConfigScheme) mergeIncludes(cfg_path string) error {
+	config.path = cfg_path
+	if err := config.addOrigins(config, cfg_path); err != nil {
+		return err
+	}
+
+	dir := config.configs.Globals.IncludeDir
+	if dir == "" {
+		dir = filepath.Join(filepath.Dir(cfg_path), KAOHI_DEFAULT_INCLUDE_DIR)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.conf"))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		included := NewKaohiConfig()
+
+		cfg := mconfig.NewConfigScheme()
+		if err := cfg.ParseConfig(CONFIG_HCL_OPTS, file, included.configs); err != nil {
+			return &kConfigError{File: file, Err: err}
+		}
+
+		if err := config.addOrigins(included, file); err != nil {
+			return err
+		}
+		mergeConfig(config.configs, included.configs)
+	}
+	config.includes = files
+
+	return nil
+}
+
+// remember file of each input and output section, names of sections
+// must be unique across files
+func (config *kConfigScheme) addOrigins(src *kConfigScheme, file string) error {
+	for _, entry := range configEntries(src) {
+		key := entry.Kind + "/" + entry.Type + "/" + entry.Name
+		if origin, ok := config.origins[key]; ok {
+			return &kConfigError{file, entrySection(entry), fmt.Errorf("%v, first defined in %s",
+				ErrConfigItemExist, origin)}
+		}
+		config.origins[key] = file
+	}
+
 	return nil
 }
 
+// append list sections of src to dst
+func mergeConfig(dst *kConfig, src *kConfig) {
+	dv := reflect.ValueOf(dst).Elem()
+	sv := reflect.ValueOf(src).Elem()
+
+	for i := 0; i < dv.NumField(); i++ {
+		if dv.Field(i).Kind() == reflect.Slice {
+			dv.Field(i).Set(reflect.AppendSlice(dv.Field(i), sv.Field(i)))
+		}
+	}
+}
+
+// get path of configuration file from --config option or KAOHI_CONFIG
+func GetConfigPath(args []string) string {
+	for i, arg := range args {
+		switch {
+		case arg == "-c" || arg == "--config":
+			if i + 1 < len(args) {
+				return args[i + 1]
+			}
+		case strings.HasPrefix(arg, "--config="):
+			return strings.TrimPrefix(arg, "--config=")
+		case strings.HasPrefix(arg, "-c="):
+			return strings.TrimPrefix(arg, "-c=")
+		}
+	}
+
+	if path := os.Getenv("KAOHI_CONFIG"); path != "" {
+		return path
+	}
+
+	return KAOHI_DEFAULT_CONFIG_FILE
+}
+
+// check whether --check-config option is given
+func IsCheckConfig(args []string) bool {
+	for _, arg := range args {
+		if arg == "--check-config" || arg == "-C" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (config *kConfigScheme) GetPath() string {
+	return config.path
+}
+
+// set path of configuration which was parsed from another file, the
+// sections defined in that file are moved to the path
+func (config *kConfigScheme) SetPath(path string) {
+	for key, origin := range config.origins {
+		if origin == config.path {
+			config.origins[key] = path
+		}
+	}
+	config.path = path
+}
+
+// get file where input or output section was defined
+func (config *kConfigScheme) GetOrigin(entry kConfigEntry) string {
+	if origin, ok := config.origins[entry.Kind + "/" + entry.Type + "/" + entry.Name]; ok {
+		return origin
+	}
+	return config.path
+}
+
+func (config *kConfigScheme) GetIncludes() []string {
+	return config.includes
+}
+
 func (config *kConfigScheme) GetLogDir() string {
+	if config.configs.Globals.LogDir == "" {
+		return KAOHI_DEFAULT_LOG_DIR
+	}
 	return config.configs.Globals.LogDir
 }
 
@@ -88,6 +393,81 @@ func (config *kConfigScheme) GetLogLevel() int {
 	return config.configs.Globals.LogLevel
 }
 
+func (config *kConfigScheme) GetLogMaxSize() int {
+	return config.configs.Globals.LogMaxSize
+}
+
+func (config *kConfigScheme) GetLogMaxFiles() int {
+	return config.configs.Globals.LogMaxFiles
+}
+
+func (config *kConfigScheme) GetLogFormat() string {
+	return config.configs.Globals.LogFormat
+}
+
 func (config *kConfigScheme) GetListenAddr() string {
 	return config.configs.Globals.ListenAddr
 }
+
+func (config *kConfigScheme) GetShutdownTimeout() time.Duration {
+	if config.configs.Globals.ShutdownTimeout <= 0 {
+		return KAOHI_DEFAULT_SHUTDOWN_TIMEOUT
+	}
+	return time.Duration(config.configs.Globals.ShutdownTimeout) * time.Second
+}
+
+func (config *kConfigScheme) GetRsyslog() kRsyslogConfig {
+	return config.configs.Rsyslog
+}
+
+func (config *kConfigScheme) GetCmdListener() kCmdListenerConfig {
+	return config.configs.CmdListener
+}
+
+func (config *kConfigScheme) GetInternalEvents() kInternalEventsConfig {
+	return config.configs.InternalEvents
+}
+
+func (config *kConfigScheme) GetMetrics() kMetricsConfig {
+	return config.configs.Metrics
+}
+
+func (config *kConfigScheme) GetConfigFiles() []kFilesConfig {
+	return config.configs.ConfigFiles
+}
+
+func (config *kConfigScheme) GetCommands() []kCommandsConfig {
+	return config.configs.Commands
+}
+
+func (config *kConfigScheme) GetContainers() []kContainersConfig {
+	return config.configs.Containers
+}
+
+func (config *kConfigScheme) GetJournals() []kJournalConfig {
+	return config.configs.Journals
+}
+
+func (config *kConfigScheme) GetAudits() []kAuditConfig {
+	return config.configs.Audits
+}
+
+func (config *kConfigScheme) GetSyslogOutputs() []kSyslogOutputConfig {
+	return config.configs.SyslogOutputs
+}
+
+func (config *kConfigScheme) GetHTTPOutputs() []kHTTPOutputConfig {
+	return config.configs.HTTPOutputs
+}
+
+func (config *kConfigScheme) GetElasticOutputs() []kElasticOutputConfig {
+	return config.configs.ElasticOutputs
+}
+
+func (config *kConfigScheme) GetKafkaOutputs() []kKafkaOutputConfig {
+	return config.configs.KafkaOutputs
+}
+
+func (config *kConfigScheme) GetFileOutputs() []kFileOutputConfig {
+	return config.configs.FileOutputs
+}
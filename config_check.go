@@ -0,0 +1,499 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// sections of configuration for input and output types
+var kConfigSections = map[string]string{
+	"files":          "config-files",
+	"commands":       "commands",
+	"containers":     "containers",
+	"journal":        "journal",
+	"audit":          "audit",
+	"syslog":         "syslog-output",
+	"http":           "http-output",
+	"elasticsearch":  "elasticsearch-output",
+	"kafka":          "kafka-output",
+	"file":           "file-output",
+}
+
+// problem of configuration, qualified by file and path of the option
+type kConfigError struct {
+	File           string
+	Path           string
+	Err            error
+}
+
+func (e *kConfigError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("%s: %v", e.File, e.Err)
+	}
+	return fmt.Sprintf("%s: %s: %v", e.File, e.Path, e.Err)
+}
+
+// all problems found by validation
+type kConfigErrors []error
+
+func (errs kConfigErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// address which is listened by kaohi
+type kListenAddr struct {
+	path           string
+	network        string
+	host           string
+	port           string
+}
+
+// collects problems while validating configuration
+type kConfigValidator struct {
+	config         *kConfigScheme
+	errs           kConfigErrors
+	listens        []kListenAddr
+}
+
+// path of input or output section like config-files "name"
+func entrySection(entry kConfigEntry) string {
+	return fmt.Sprintf("%s %q", kConfigSections[entry.Type], entry.Name)
+}
+
+func (v *kConfigValidator) addError(file string, path string, err error) {
+	v.errs = append(v.errs, &kConfigError{file, path, err})
+}
+
+// check configuration for semantic problems which parser doesn't catch,
+// returns nil if configuration is valid
+func (config *kConfigScheme) Validate() error {
+	v := &kConfigValidator{config: config}
+
+	v.checkGlobals()
+	v.checkRsyslog()
+	v.checkCmdListener()
+	v.checkInternalEvents()
+	v.checkMetrics()
+
+	for _, entry := range configEntries(config) {
+		file := config.GetOrigin(entry)
+		section := entrySection(entry)
+
+		if entry.Name == "" {
+			v.addError(file, section, fmt.Errorf("name is empty"))
+		}
+
+		switch cfg := entry.Config.(type) {
+		case kFilesConfig:
+			v.checkConfigFiles(file, section, cfg)
+		case kCommandsConfig:
+			v.checkCommands(file, section, cfg)
+		case kContainersConfig:
+			v.checkContainers(file, section, cfg)
+		case kJournalConfig:
+			v.checkJournal(file, section, cfg)
+		case kAuditConfig:
+			v.checkTailedFile(file, section + ".file", auditConfigDefaults(cfg).File)
+		default:
+			v.checkOutput(file, section, cfg)
+		}
+	}
+
+	v.checkListenConflicts()
+
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return v.errs
+}
+
+func (v *kConfigValidator) checkGlobals() {
+	file := v.config.GetPath()
+	globals := v.config.configs.Globals
+
+	if globals.LogLevel < LOG_LEVEL_ERR || globals.LogLevel > LOG_LEVEL_DEBUG {
+		v.addError(file, "global.log_level", fmt.Errorf("%d: expected 0 ~ 3", globals.LogLevel))
+	}
+
+	if globals.LogMaxSize < 0 {
+		v.addError(file, "global.log_max_size", fmt.Errorf("%d: must not be negative", globals.LogMaxSize))
+	}
+	if globals.LogMaxFiles < 0 {
+		v.addError(file, "global.log_max_files", fmt.Errorf("%d: must not be negative", globals.LogMaxFiles))
+	}
+
+	switch globals.LogFormat {
+	case "", LOG_FORMAT_TEXT, LOG_FORMAT_JSON:
+	default:
+		v.addError(file, "global.log_format", fmt.Errorf("%q: %v", globals.LogFormat, ErrInvalidLogFormat))
+	}
+
+	if globals.LogDir != "" {
+		if err := checkDirPath(globals.LogDir); err != nil {
+			v.addError(file, "global.log_directory", err)
+		}
+	}
+
+	if globals.IncludeDir != "" {
+		if fi, err := os.Stat(globals.IncludeDir); err != nil || !fi.IsDir() {
+			v.addError(file, "global.include_dir", fmt.Errorf("%s: not a directory", globals.IncludeDir))
+		}
+	}
+
+	if globals.ShutdownTimeout < 0 {
+		v.addError(file, "global.shutdown_timeout", fmt.Errorf("%d: must not be negative",
+			globals.ShutdownTimeout))
+	}
+
+	if globals.ListenAddr != "" {
+		v.addListen(file, "global.listen_address", "tcp", globals.ListenAddr)
+	}
+}
+
+func (v *kConfigValidator) checkRsyslog() {
+	file := v.config.GetPath()
+	rsyslog := v.config.GetRsyslog()
+
+	network := rsyslog.Protocol
+	switch network {
+	case "":
+		network = KAOHI_DEFAULT_SYSLOG_PROTO
+	case "tcp", "udp":
+	default:
+		v.addError(file, "rsyslog.protocol", fmt.Errorf("%q: expected tcp or udp", rsyslog.Protocol))
+		return
+	}
+
+	if rsyslog.ListenAddr != "" {
+		v.addListen(file, "rsyslog.listen_address", network, rsyslog.ListenAddr)
+	}
+}
+
+func (v *kConfigValidator) checkCmdListener() {
+	file := v.config.GetPath()
+	cfg := v.config.GetCmdListener()
+
+	if cfg.UnixSocket != "" {
+		if err := checkDirPath(filepath.Dir(cfg.UnixSocket)); err != nil {
+			v.addError(file, "command-listener.unix_socket", err)
+		}
+	}
+
+	if _, err := parseSocketMode(cfg.SocketMode); err != nil {
+		v.addError(file, "command-listener.socket_mode", fmt.Errorf("%q: %v", cfg.SocketMode, err))
+	}
+
+	if cfg.TCPRole != "" {
+		if _, ok := kCmdRoleNames[cfg.TCPRole]; !ok {
+			v.addError(file, "command-listener.tcp_role", fmt.Errorf("%q: %v", cfg.TCPRole, ErrCmdInvalidRole))
+		}
+	}
+
+	if cfg.TLS.CertFile != "" || cfg.TLS.KeyFile != "" {
+		if _, err := newCmdListenerTLSConfig(cfg.TLS); err != nil {
+			v.addError(file, "command-listener.tls", err)
+		}
+	}
+
+	for command, limit := range cfg.RequestLimits {
+		path := fmt.Sprintf("command-listener.request_limits.%s", command)
+		if !kCmdCommands[command] {
+			v.addError(file, path, ErrCmdUnknownCommand)
+		} else if limit <= 0 {
+			v.addError(file, path, fmt.Errorf("%d: must be positive", limit))
+		}
+	}
+}
+
+func (v *kConfigValidator) checkInternalEvents() {
+	cfg := v.config.GetInternalEvents()
+
+	switch cfg.Level {
+	case "", kLogLevelNames[LOG_LEVEL_ERR], kLogLevelNames[LOG_LEVEL_WARN]:
+	default:
+		v.addError(v.config.GetPath(), "internal-events.level", fmt.Errorf("%q: expected error or warn", cfg.Level))
+	}
+}
+
+func (v *kConfigValidator) checkMetrics() {
+	cfg := v.config.GetMetrics()
+
+	if cfg.ListenAddr != "" {
+		v.addListen(v.config.GetPath(), "metrics.listen_address", "tcp", cfg.ListenAddr)
+	}
+	if cfg.Path != "" && cfg.Path[0] != '/' {
+		v.addError(v.config.GetPath(), "metrics.path", fmt.Errorf("%q: must start with /", cfg.Path))
+	}
+	if cfg.HighWaterMark < 0 || cfg.HighWaterMark > 100 {
+		v.addError(v.config.GetPath(), "metrics.queue_high_water_mark", fmt.Errorf("%d: expected 0-100", cfg.HighWaterMark))
+	}
+}
+
+func (v *kConfigValidator) checkConfigFiles(file string, section string, cfg kFilesConfig) {
+	if len(cfg.Files) == 0 {
+		v.addError(file, section + ".files", fmt.Errorf("no file is specified"))
+	}
+
+	for i, path := range cfg.Files {
+		v.checkTailedFile(file, fmt.Sprintf("%s.files[%d]", section, i), path)
+	}
+}
+
+// missing files are fine as they are watched until created
+func (v *kConfigValidator) checkTailedFile(file string, option string, path string) {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return
+	}
+
+	if err == nil && fi.IsDir() {
+		v.addError(file, option, fmt.Errorf("%s: is a directory", path))
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		v.addError(file, option, fmt.Errorf("%s: not readable", path))
+		return
+	}
+	f.Close()
+}
+
+func (v *kConfigValidator) checkCommands(file string, section string, cfg kCommandsConfig) {
+	if len(cfg.Cmds) == 0 {
+		v.addError(file, section + ".cmds", fmt.Errorf("no command is specified"))
+	}
+
+	if cfg.Uid != os.Geteuid() {
+		if _, err := user.LookupId(strconv.Itoa(cfg.Uid)); err != nil {
+			v.addError(file, section + ".uid", fmt.Errorf("%d: unknown user", cfg.Uid))
+		}
+	}
+}
+
+func (v *kConfigValidator) checkContainers(file string, section string, cfg kContainersConfig) {
+	if cfg.ContainersDir != "" && !filepath.IsAbs(cfg.ContainersDir) {
+		v.addError(file, section + ".containers_dir", fmt.Errorf("%s: must be absolute path", cfg.ContainersDir))
+	}
+	if cfg.PodsDir != "" && !filepath.IsAbs(cfg.PodsDir) {
+		v.addError(file, section + ".pods_dir", fmt.Errorf("%s: must be absolute path", cfg.PodsDir))
+	}
+
+	included := make(map[string]bool)
+	for _, ns := range cfg.Namespaces {
+		included[ns] = true
+	}
+	for i, ns := range cfg.ExcludeNamespaces {
+		if included[ns] {
+			v.addError(file, fmt.Sprintf("%s.exclude_namespaces[%d]", section, i),
+				fmt.Errorf("%q: is included by namespaces as well", ns))
+		}
+	}
+}
+
+func (v *kConfigValidator) checkJournal(file string, section string, cfg kJournalConfig) {
+	cfg = journalConfigDefaults(cfg)
+
+	if _, err := exec.LookPath(cfg.Journalctl); err != nil {
+		v.addError(file, section + ".journalctl", fmt.Errorf("%s: not found", cfg.Journalctl))
+	}
+	if !filepath.IsAbs(cfg.CursorFile) {
+		v.addError(file, section + ".cursor_file", fmt.Errorf("%s: must be absolute path", cfg.CursorFile))
+	}
+	for i, match := range cfg.Matches {
+		// "+" separates alternatives of matches
+		if match != "+" && strings.IndexByte(match, '=') <= 0 {
+			v.addError(file, fmt.Sprintf("%s.matches[%d]", section, i), fmt.Errorf("%q: expected FIELD=value", match))
+		}
+	}
+}
+
+// check options of outputs without connecting to destinations
+func (v *kConfigValidator) checkOutput(file string, section string, cfg interface{}) {
+	check := func(option string, err error) {
+		if err != nil {
+			v.addError(file, section + "." + option, err)
+		}
+	}
+
+	switch cfg := cfg.(type) {
+	case kSyslogOutputConfig:
+		if cfg.Facility != nil && (*cfg.Facility < 0 || *cfg.Facility > 23) {
+			check("facility", ErrSyslogInvalidFacility)
+		}
+		if cfg.Severity != nil && (*cfg.Severity < 0 || *cfg.Severity > 7) {
+			check("severity", ErrSyslogInvalidSeverity)
+		}
+		check("sd_id", checkSyslogSdID(cfg.SdID))
+		if len(cfg.Destinations) == 0 {
+			check("destinations", ErrSyslogNoDestination)
+		}
+		for i, dest := range cfg.Destinations {
+			u, err := url.Parse(dest)
+			if err != nil || u.Host == "" || (u.Scheme != "udp" && u.Scheme != "tcp" && u.Scheme != "tls") {
+				check(fmt.Sprintf("destinations[%d]", i), fmt.Errorf("%q: %v", dest, ErrSyslogInvalidDestination))
+			}
+		}
+		check("tls", checkOutputTLS(cfg.TLS))
+
+	case kHTTPOutputConfig:
+		if cfg.URL == "" {
+			check("url", ErrHTTPNoURL)
+		} else {
+			check("url", checkHTTPURL(cfg.URL))
+		}
+		if _, err := NewEventEncoder(cfg.Encoder); err != nil {
+			check("encoder", fmt.Errorf("%q: %v", cfg.Encoder, err))
+		}
+		check("compression", checkCompression(cfg.Compression, "gzip"))
+		check("tls", checkOutputTLS(cfg.TLS))
+
+	case kElasticOutputConfig:
+		if cfg.URL == "" {
+			check("url", ErrElasticNoURL)
+		} else {
+			check("url", checkHTTPURL(cfg.URL))
+		}
+		check("compression", checkCompression(cfg.Compression, "gzip"))
+		check("tls", checkOutputTLS(cfg.TLS))
+
+	case kKafkaOutputConfig:
+		if len(cfg.Brokers) == 0 {
+			check("brokers", ErrKafkaNoBroker)
+		}
+		if cfg.Topic == "" {
+			check("topic", ErrKafkaNoTopic)
+		}
+		if cfg.MaxRetries < 0 {
+			check("max_retries", ErrKafkaInvalidMaxRetries)
+		}
+		if _, err := newKafkaConfig(cfg); err != nil {
+			v.addError(file, section, err)
+		}
+
+	case kFileOutputConfig:
+		if cfg.Path == "" {
+			check("path", ErrFileOutputNoPath)
+		}
+		switch cfg.Format {
+		case "", "json", "raw":
+		default:
+			check("format", fmt.Errorf("%q: %v", cfg.Format, ErrFileOutputInvalidFormat))
+		}
+		check("compression", checkCompression(cfg.Compression, "gzip", "zstd"))
+	}
+}
+
+// check that host and port of address are valid and remember it for
+// checking conflicts
+func (v *kConfigValidator) addListen(file string, path string, network string, addr string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err == nil {
+		_, err = net.LookupPort(network, port)
+	}
+	if err != nil {
+		v.addError(file, path, fmt.Errorf("%q: %v", addr, ErrResolveAddr))
+		return
+	}
+
+	v.listens = append(v.listens, kListenAddr{path, network, host, port})
+}
+
+// addresses of same network and port conflict unless they are bound to different hosts
+func (v *kConfigValidator) checkListenConflicts() {
+	wildcard := func(host string) bool {
+		return host == "" || host == "*" || host == "0.0.0.0" || host == "::"
+	}
+
+	for i, a := range v.listens {
+		for _, b := range v.listens[:i] {
+			if a.network != b.network || a.port != b.port {
+				continue
+			}
+			if a.host == b.host || wildcard(a.host) || wildcard(b.host) {
+				v.addError(v.config.GetPath(), a.path, fmt.Errorf("%s:%s conflicts with %s",
+					a.host, a.port, b.path))
+			}
+		}
+	}
+}
+
+// check that directory exists or could be created under an existing directory
+func checkDirPath(dir string) error {
+	for path := dir; ; path = filepath.Dir(path) {
+		fi, err := os.Stat(path)
+		if err == nil {
+			if !fi.IsDir() {
+				return fmt.Errorf("%s: not a directory", path)
+			}
+			return nil
+		}
+		if !os.IsNotExist(err) || path == filepath.Dir(path) {
+			return fmt.Errorf("%s: %v", dir, err)
+		}
+	}
+}
+
+func checkHTTPURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("%q: expected http:// or https:// URL", rawURL)
+	}
+	return nil
+}
+
+func checkCompression(method string, supported ...string) error {
+	if method == "" || method == "none" {
+		return nil
+	}
+	for _, m := range supported {
+		if method == m {
+			return nil
+		}
+	}
+	return fmt.Errorf("%q: %v", method, ErrUnknownCompression)
+}
+
+func checkOutputTLS(cfg kTLSConfig) error {
+	if cfg.CAFile == "" && cfg.CertFile == "" && cfg.KeyFile == "" {
+		return nil
+	}
+	_, err := newOutputTLSConfig(cfg)
+	return err
+}
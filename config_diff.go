@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"reflect"
+)
+
+// actions of configuration changes
+const (
+	CONFIG_CHANGE_ADD              = "add"
+	CONFIG_CHANGE_REMOVE           = "remove"
+	CONFIG_CHANGE_MODIFY           = "modify"
+)
+
+// input or output section of configuration
+type kConfigEntry struct {
+	Kind           string
+	Type           string
+	Name           string
+	Config         interface{}
+}
+
+// list inputs and outputs of configuration
+func configEntries(config *kConfigScheme) []kConfigEntry {
+	var entries []kConfigEntry
+
+	for _, cfg := range config.GetConfigFiles() {
+		entries = append(entries, kConfigEntry{"input", "files", cfg.Name, cfg})
+	}
+	for _, cfg := range config.GetCommands() {
+		entries = append(entries, kConfigEntry{"input", "commands", cfg.Name, cfg})
+	}
+	for _, cfg := range config.GetContainers() {
+		entries = append(entries, kConfigEntry{"input", "containers", cfg.Name, cfg})
+	}
+	for _, cfg := range config.GetJournals() {
+		entries = append(entries, kConfigEntry{"input", "journal", cfg.Name, cfg})
+	}
+	for _, cfg := range config.GetAudits() {
+		entries = append(entries, kConfigEntry{"input", "audit", cfg.Name, cfg})
+	}
+
+	for _, cfg := range config.GetSyslogOutputs() {
+		entries = append(entries, kConfigEntry{"output", "syslog", cfg.Name, cfg})
+	}
+	for _, cfg := range config.GetHTTPOutputs() {
+		entries = append(entries, kConfigEntry{"output", "http", cfg.Name, cfg})
+	}
+	for _, cfg := range config.GetElasticOutputs() {
+		entries = append(entries, kConfigEntry{"output", "elasticsearch", cfg.Name, cfg})
+	}
+	for _, cfg := range config.GetKafkaOutputs() {
+		entries = append(entries, kConfigEntry{"output", "kafka", cfg.Name, cfg})
+	}
+	for _, cfg := range config.GetFileOutputs() {
+		entries = append(entries, kConfigEntry{"output", "file", cfg.Name, cfg})
+	}
+
+	return entries
+}
+
+// compare inputs and outputs of two configurations
+func diffConfigs(old *kConfigScheme, new *kConfigScheme) []kCmdConfigChange {
+	changes := []kCmdConfigChange{}
+
+	oldEntries := make(map[string]kConfigEntry)
+	for _, entry := range configEntries(old) {
+		oldEntries[entry.Kind + "/" + entry.Type + "/" + entry.Name] = entry
+	}
+
+	for _, entry := range configEntries(new) {
+		key := entry.Kind + "/" + entry.Type + "/" + entry.Name
+		change := kCmdConfigChange{Kind: entry.Kind, Type: entry.Type, Name: entry.Name}
+
+		oldEntry, ok := oldEntries[key]
+		if !ok {
+			change.Action = CONFIG_CHANGE_ADD
+		} else if !reflect.DeepEqual(oldEntry.Config, entry.Config) {
+			change.Action = CONFIG_CHANGE_MODIFY
+		}
+		delete(oldEntries, key)
+
+		if change.Action != "" {
+			changes = append(changes, change)
+		}
+	}
+
+	for _, entry := range configEntries(old) {
+		if _, ok := oldEntries[entry.Kind + "/" + entry.Type + "/" + entry.Name]; ok {
+			changes = append(changes, kCmdConfigChange{
+				Kind:           entry.Kind,
+				Type:           entry.Type,
+				Name:           entry.Name,
+				Action:         CONFIG_CHANGE_REMOVE,
+			})
+		}
+	}
+
+	return changes
+}
+
+// get keys (type/name) of inputs and outputs which were added or modified
+func changedConfigEntries(old *kConfigScheme, new *kConfigScheme) map[string]bool {
+	changed := make(map[string]bool)
+
+	if old == nil {
+		old = NewKaohiConfig()
+	}
+	for _, change := range diffConfigs(old, new) {
+		if change.Action != CONFIG_CHANGE_REMOVE {
+			changed[change.Type + "/" + change.Name] = true
+		}
+	}
+
+	return changed
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// dead-letter file which keeps the events rejected permanently by outputs
+type kDeadLetter struct {
+	mu             sync.Mutex
+	path           string
+}
+
+// dead-letter record
+type kDeadLetterRecord struct {
+	Time           string                 `json:"time"`
+	Output         string                 `json:"output"`
+	Reason         string                 `json:"reason"`
+	Event          map[string]interface{} `json:"event"`
+}
+
+// create dead-letter file
+func NewDeadLetter(path string) (*kDeadLetter, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	// make sure that dead-letter file is writable
+	f, err := os.OpenFile(path, os.O_APPEND | os.O_WRONLY | os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	return &kDeadLetter{path: path}, nil
+}
+
+// get size of dead-letter file
+func (dl *kDeadLetter) Size() int64 {
+	if dl == nil {
+		return 0
+	}
+
+	fi, err := os.Stat(dl.path)
+	if err != nil {
+		return 0
+	}
+
+	return fi.Size()
+}
+
+// append events into dead-letter file
+func (dl *kDeadLetter) Write(output string, reason string, events []*kEvent) error {
+	if dl == nil {
+		DEBUG_ERR("Output '%s' dropped %d event(s): %s", output, len(events), reason)
+		return nil
+	}
+
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	f, err := os.OpenFile(dl.path, os.O_APPEND | os.O_WRONLY | os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	enc := json.NewEncoder(f)
+	for _, ev := range events {
+		rec := kDeadLetterRecord{
+			Time:           now,
+			Output:         output,
+			Reason:         reason,
+			Event:          ev.ToMap(),
+		}
+		if err := enc.Encode(&rec); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
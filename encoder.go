@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+)
+
+// event encoder interface
+type kEventEncoder interface {
+	// Encode encodes batch of events into request body
+	Encode(events []*kEvent) ([]byte, error)
+
+	// ContentType returns the MIME type of encoded body
+	ContentType() string
+}
+
+// registered encoders
+var kEventEncoders = map[string]func() kEventEncoder{
+	"ndjson":       func() kEventEncoder { return &kNDJSONEncoder{} },
+	"json":         func() kEventEncoder { return &kJSONArrayEncoder{} },
+}
+
+// get encoder by name
+func NewEventEncoder(name string) (kEventEncoder, error) {
+	if name == "" {
+		name = KAOHI_DEFAULT_HTTP_ENCODER
+	}
+
+	newEncoder, ok := kEventEncoders[name]
+	if !ok {
+		return nil, ErrUnknownEncoder
+	}
+
+	return newEncoder(), nil
+}
+
+// newline-delimited JSON encoder
+type kNDJSONEncoder struct{}
+
+func (e *kNDJSONEncoder) Encode(events []*kEvent) ([]byte, error) {
+	var buf bytes.Buffer
+
+	enc := json.NewEncoder(&buf)
+	for _, ev := range events {
+		if err := enc.Encode(ev.ToMap()); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (e *kNDJSONEncoder) ContentType() string {
+	return "application/x-ndjson"
+}
+
+// JSON array encoder
+type kJSONArrayEncoder struct{}
+
+func (e *kJSONArrayEncoder) Encode(events []*kEvent) ([]byte, error) {
+	arr := make([]map[string]interface{}, len(events))
+	for i, ev := range events {
+		arr[i] = ev.ToMap()
+	}
+
+	return json.Marshal(arr)
+}
+
+func (e *kJSONArrayEncoder) ContentType() string {
+	return "application/json"
+}
+
+// compress body with gzip
+func gzipBody(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"sort"
+	"time"
+)
+
+// kaohi event structure
+type kEvent struct {
+	Time           time.Time
+	Host           string
+	Group          string
+	Source         string
+	Message        string
+	Fields         map[string]string
+}
+
+// local host name which is set to events
+var kHostName string
+
+func init() {
+	kHostName, _ = os.Hostname()
+	if kHostName == "" {
+		kHostName = "localhost"
+	}
+}
+
+// create new event
+func NewKaohiEvent(group string, source string, message string) *kEvent {
+	return &kEvent {
+		Time:           time.Now(),
+		Host:           kHostName,
+		Group:          group,
+		Source:         source,
+		Message:        message,
+		Fields:         make(map[string]string),
+	}
+}
+
+// set structured field
+func (ev *kEvent) SetField(name string, value string) {
+	if ev.Fields == nil {
+		ev.Fields = make(map[string]string)
+	}
+	ev.Fields[name] = value
+}
+
+// get field by name, the builtin names are resolved before structured fields
+func (ev *kEvent) GetField(name string) (string, bool) {
+	switch name {
+	case "host":
+		return ev.Host, true
+	case "group":
+		return ev.Group, true
+	case "source":
+		return ev.Source, true
+	case "message":
+		return ev.Message, true
+	}
+
+	value, ok := ev.Fields[name]
+	return value, ok
+}
+
+// convert event to map which is used for JSON encoding
+func (ev *kEvent) ToMap() map[string]interface{} {
+	m := map[string]interface{}{
+		"timestamp":    ev.Time.UTC().Format(time.RFC3339Nano),
+		"host":         ev.Host,
+		"group":        ev.Group,
+		"source":       ev.Source,
+		"message":      ev.Message,
+	}
+	if len(ev.Fields) > 0 {
+		m["fields"] = ev.Fields
+	}
+
+	return m
+}
+
+// compute hash of event content which can be used as idempotent id
+func (ev *kEvent) Hash() string {
+	h := sha256.New()
+
+	write := func(s string) {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+
+	write(ev.Time.UTC().Format(time.RFC3339Nano))
+	write(ev.Host)
+	write(ev.Group)
+	write(ev.Source)
+	write(ev.Message)
+
+	names := make([]string, 0, len(ev.Fields))
+	for name := range ev.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		write(name)
+		write(ev.Fields[name])
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
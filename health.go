@@ -0,0 +1,174 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	HEALTH_STATUS_OK              = "ok"
+	HEALTH_STATUS_FAIL            = "fail"
+)
+
+// result of a health check of one component
+type kHealthCheck struct {
+	Status         string             `json:"status"`
+	Detail         string             `json:"detail,omitempty"`
+}
+
+// health report which is returned as JSON body
+type kHealthReport struct {
+	Status         string             `json:"status"`
+	Checks         map[string]kHealthCheck `json:"checks"`
+}
+
+// interface of inputs which can report their own health
+type kHealthReporter interface {
+	Health() kHealthCheck
+}
+
+func healthOK(format string, args ...interface{}) kHealthCheck {
+	return kHealthCheck{Status: HEALTH_STATUS_OK, Detail: fmt.Sprintf(format, args...)}
+}
+
+func healthFail(format string, args ...interface{}) kHealthCheck {
+	return kHealthCheck{Status: HEALTH_STATUS_FAIL, Detail: fmt.Sprintf(format, args...)}
+}
+
+// add check to report, any failed check fails the whole report
+func (r *kHealthReport) add(name string, check kHealthCheck) {
+	r.Checks[name] = check
+	if check.Status != HEALTH_STATUS_OK {
+		r.Status = HEALTH_STATUS_FAIL
+	}
+}
+
+// check that polling loop of watcher is still ticking
+func watcherHealth() kHealthCheck {
+	if kWatcher == nil {
+		return healthFail("watcher is not running")
+	}
+
+	since := time.Since(kWatcher.LastCycle())
+	if since > KAOHI_HEALTH_WATCHER_TIMEOUT {
+		return healthFail("last cycle %s ago", since.Round(time.Second))
+	}
+
+	return healthOK("%d files watched", kWatcher.FileCount())
+}
+
+// check that command listener accepts connections, it's not the case if
+// neither new nor previous configuration could be bound on reload
+func cmdListenerHealth() kHealthCheck {
+	if !cmdListenerListening() {
+		return healthFail("command listener is not listening")
+	}
+
+	return healthOK("")
+}
+
+// check input, the inputs which can't report health are considered bound
+func inputHealth(in kInput) kHealthCheck {
+	check := healthOK("")
+	if hr, ok := in.(kHealthReporter); ok {
+		check = hr.Health()
+	}
+
+	if in.IsPaused() {
+		if check.Detail != "" {
+			check.Detail += ", "
+		}
+		check.Detail += "paused"
+	}
+
+	return check
+}
+
+// check that output delivers events and its queue is below high-water mark
+func outputHealth(out kOutput, highWaterMark int) kHealthCheck {
+	stats := out.Stats()
+
+	if stats.Failing {
+		return healthFail("delivery is failing, %d events queued", stats.Queued)
+	}
+	if stats.Capacity > 0 && stats.Queued * 100 >= stats.Capacity * int64(highWaterMark) {
+		return healthFail("queue is above high-water mark, %d of %d events queued", stats.Queued, stats.Capacity)
+	}
+
+	return healthOK("%d events queued", stats.Queued)
+}
+
+// write report as JSON, status code is 503 if any check has failed
+func writeHealthReport(w http.ResponseWriter, report *kHealthReport) {
+	code := http.StatusOK
+	if report.Status != HEALTH_STATUS_OK {
+		code = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(report)
+}
+
+func newHealthReport() *kHealthReport {
+	return &kHealthReport{Status: HEALTH_STATUS_OK, Checks: make(map[string]kHealthCheck)}
+}
+
+// liveness, daemon is alive as long as watcher loop is ticking
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	report := newHealthReport()
+	report.add("watcher", watcherHealth())
+
+	writeHealthReport(w, report)
+}
+
+// readiness, all inputs are bound, outputs are reachable and their queues
+// are below high-water mark
+func newReadyzHandler(highWaterMark int) http.HandlerFunc {
+	if highWaterMark <= 0 {
+		highWaterMark = KAOHI_DEFAULT_HIGH_WATER_MARK
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := newHealthReport()
+		report.add("watcher", watcherHealth())
+		report.add("command-listener", cmdListenerHealth())
+
+		for _, in := range GetInputs() {
+			report.add(strings.Join([]string{"input", in.Type(), in.Name()}, "/"), inputHealth(in))
+		}
+		for _, out := range GetOutputs() {
+			report.add(strings.Join([]string{"output", out.Type(), out.Name()}, "/"), outputHealth(out, highWaterMark))
+		}
+
+		writeHealthReport(w, report)
+	}
+}
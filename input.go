@@ -0,0 +1,333 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// input interface
+type kInput interface {
+	// Name returns the name of input group
+	Name() string
+
+	// Type returns the type of input
+	Type() string
+
+	// Start starts collecting events
+	Start() error
+
+	// Stop stops collecting events
+	Stop()
+
+	// Pause suspends collecting events until Resume is called
+	Pause()
+
+	// Resume resumes collecting events
+	Resume()
+
+	// IsPaused indicates whether or not the input is paused
+	IsPaused() bool
+
+	// Stats returns the collecting statistics
+	Stats() kInputStats
+}
+
+// input which can apply modified configuration while running
+type kReconfigurableInput interface {
+	kInput
+
+	// Reconfigure applies modified configuration of the same type
+	Reconfigure(cfg interface{})
+}
+
+// input which tails files and handles watcher events of them
+type kWatcherEventHandler interface {
+	HandleEvent(ev Event)
+}
+
+// input statistics
+type kInputStats struct {
+	Events         uint64
+	Bytes          uint64
+	Errors         uint64
+}
+
+// common input state which is embedded into inputs
+type kInputState struct {
+	paused         int32
+	events         uint64
+	bytes          uint64
+	errors         uint64
+}
+
+func (s *kInputState) Pause() {
+	atomic.StoreInt32(&s.paused, 1)
+}
+
+func (s *kInputState) Resume() {
+	atomic.StoreInt32(&s.paused, 0)
+}
+
+func (s *kInputState) IsPaused() bool {
+	return atomic.LoadInt32(&s.paused) == 1
+}
+
+func (s *kInputState) addEvents(n int) {
+	atomic.AddUint64(&s.events, uint64(n))
+}
+
+func (s *kInputState) addBytes(n int) {
+	atomic.AddUint64(&s.bytes, uint64(n))
+}
+
+func (s *kInputState) addErrors(n int) {
+	atomic.AddUint64(&s.errors, uint64(n))
+}
+
+func (s *kInputState) Stats() kInputStats {
+	return kInputStats{
+		Events:         atomic.LoadUint64(&s.events),
+		Bytes:          atomic.LoadUint64(&s.bytes),
+		Errors:         atomic.LoadUint64(&s.errors),
+	}
+}
+
+// kaohi inputs structure
+type KaohiInputs struct {
+	mu             sync.RWMutex
+	inputs         []kInput
+	stop           chan struct{}
+	wg             sync.WaitGroup
+}
+
+// global variable for inputs
+var kInputs KaohiInputs
+
+// create input of configuration entry
+func newInput(entry kConfigEntry) kInput {
+	switch cfg := entry.Config.(type) {
+	case kFilesConfig:
+		return NewFilesInput(cfg)
+	case kCommandsConfig:
+		return NewCommandsInput(cfg)
+	case kContainersConfig:
+		return NewContainersInput(cfg)
+	case kJournalConfig:
+		return NewJournalInput(cfg)
+	case kAuditConfig:
+		return NewAuditInput(cfg)
+	}
+
+	return nil
+}
+
+// create inputs from configuration
+func newInputsFromConfig(config *kConfigScheme) []kInput {
+	var inputs []kInput
+
+	for _, entry := range configEntries(config) {
+		if entry.Kind == "input" {
+			inputs = append(inputs, newInput(entry))
+		}
+	}
+
+	return inputs
+}
+
+// start list of inputs, the started inputs are stopped on failure
+func startInputs(inputs []kInput) error {
+	for i, in := range inputs {
+		if err := in.Start(); err != nil {
+			stopInputs(inputs[:i])
+			return err
+		}
+	}
+
+	return nil
+}
+
+// stop list of inputs
+func stopInputs(inputs []kInput) {
+	for _, in := range inputs {
+		in.Stop()
+	}
+}
+
+// get list of inputs
+func GetInputs() []kInput {
+	kInputs.mu.RLock()
+	defer kInputs.mu.RUnlock()
+
+	return append([]kInput{}, kInputs.inputs...)
+}
+
+// find input by type and name, empty type matches any type
+func FindInput(typ string, name string) kInput {
+	kInputs.mu.RLock()
+	defer kInputs.mu.RUnlock()
+
+	for _, in := range kInputs.inputs {
+		if in.Name() == name && (typ == "" || in.Type() == typ) {
+			return in
+		}
+	}
+
+	return nil
+}
+
+// route watcher events to file inputs
+func dispatchWatcherEvents() {
+	defer kInputs.wg.Done()
+
+	for {
+		select {
+		case <-kInputs.stop:
+			return
+
+		case <-kWatcher.Closed:
+			return
+
+		case ev := <-kWatcher.Event:
+			kInputs.mu.RLock()
+			for _, in := range kInputs.inputs {
+				if h, ok := in.(kWatcherEventHandler); ok {
+					h.HandleEvent(ev)
+				}
+			}
+			kInputs.mu.RUnlock()
+
+		case err := <-kWatcher.Error:
+			DEBUG_ERR("Watcher error: %v", err)
+		}
+	}
+}
+
+// reconcile running inputs with configuration, inputs whose configuration
+// is not changed keep running and modified ones are reconfigured if possible,
+// previous inputs keep running if new ones can't be started
+func reconcileInputs(old *kConfigScheme, config *kConfigScheme) error {
+	var inputs, started, replaced []kInput
+	var reconfigured []kReconfigurableInput
+	var cfgs []interface{}
+
+	running := make(map[string]kInput)
+	for _, in := range GetInputs() {
+		running[in.Type() + "/" + in.Name()] = in
+	}
+	changed := changedConfigEntries(old, config)
+
+	for _, entry := range configEntries(config) {
+		if entry.Kind != "input" {
+			continue
+		}
+
+		key := entry.Type + "/" + entry.Name
+		cur, ok := running[key]
+		delete(running, key)
+
+		if ok && !changed[key] {
+			inputs = append(inputs, cur)
+			continue
+		}
+		if rin, isRin := cur.(kReconfigurableInput); ok && isRin {
+			inputs = append(inputs, cur)
+			reconfigured = append(reconfigured, rin)
+			cfgs = append(cfgs, entry.Config)
+			continue
+		}
+
+		in := newInput(entry)
+		if ok {
+			if cur.IsPaused() {
+				in.Pause()
+			}
+			replaced = append(replaced, cur)
+		}
+		inputs = append(inputs, in)
+		started = append(started, in)
+	}
+
+	// replaced inputs are stopped first not to collect events twice
+	stopInputs(replaced)
+	if err := startInputs(started); err != nil {
+		if rerr := startInputs(replaced); rerr != nil {
+			DEBUG_ERR("Could not restart inputs: %v", rerr)
+		}
+		return err
+	}
+
+	for i, rin := range reconfigured {
+		rin.Reconfigure(cfgs[i])
+	}
+
+	// stop inputs which were removed from configuration
+	for _, in := range running {
+		in.Stop()
+	}
+
+	kInputs.mu.Lock()
+	kInputs.inputs = inputs
+	kInputs.mu.Unlock()
+
+	return nil
+}
+
+// init kaohi inputs
+func InitKaohiInputs(ctx *kContext) error {
+	DEBUG_INFO("Initializing Kaohi inputs")
+
+	inputs := newInputsFromConfig(ctx.config)
+	if err := startInputs(inputs); err != nil {
+		return err
+	}
+
+	kInputs.mu.Lock()
+	kInputs.inputs = inputs
+	kInputs.stop = make(chan struct{})
+	kInputs.mu.Unlock()
+
+	kInputs.wg.Add(1)
+	go dispatchWatcherEvents()
+
+	return nil
+}
+
+// finalize kaohi inputs
+func FinalizeKaohiInputs() {
+	DEBUG_INFO("Finalizing Kaohi inputs")
+
+	close(kInputs.stop)
+	kInputs.wg.Wait()
+
+	kInputs.mu.Lock()
+	inputs := kInputs.inputs
+	kInputs.inputs = nil
+	kInputs.mu.Unlock()
+
+	stopInputs(inputs)
+}
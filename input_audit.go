@@ -0,0 +1,492 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// audit input constants
+const (
+	AUDIT_INPUT_FLUSH_TIMEOUT     = 2 * time.Second
+	AUDIT_INPUT_FLUSH_INTERVAL    = 500 * time.Millisecond
+	AUDIT_INPUT_MAX_PENDING       = 1024
+	AUDIT_INPUT_ENRICHED_SEP      = "\x1d"
+)
+
+// header of audit record "type=SYSCALL msg=audit(1364481363.243:24287): "
+var kAuditHeader = regexp.MustCompile(`^type=(\S+) msg=audit\((\d+)\.(\d+):(\d+)\):\s*`)
+
+// fields whose values are hex encoded when they contain special characters
+var kAuditEncodedFields = map[string]bool{
+	"name":         true,
+	"comm":         true,
+	"exe":          true,
+	"cwd":          true,
+	"path":         true,
+	"proctitle":    true,
+	"key":          true,
+	"data":         true,
+	"acct":         true,
+	"cmd":          true,
+}
+
+var kAuditExecveArg = regexp.MustCompile(`^a\d+$`)
+
+// chunk of long EXECVE argument "a1[0]", chunks follow its length "a1_len"
+var kAuditExecveChunk = regexp.MustCompile(`^a\d+(\[\d+\]|_len)$`)
+
+// audit input structure which tails audit log and joins the records of an
+// event by their audit id, the file is tailed by a files input which isn't
+// registered itself
+type kAuditInput struct {
+	name           string
+	log            kFieldLogger
+	files          *kFilesInput
+	mu             sync.Mutex
+	pending        map[string]*kAuditEvent
+	events         uint64
+	stop           chan struct{}
+	wg             sync.WaitGroup
+}
+
+// records of audit event which weren't emitted yet
+type kAuditEvent struct {
+	id             string
+	path           string
+	time           time.Time
+	updated        time.Time
+	records        []kAuditRecord
+}
+
+// parsed audit record
+type kAuditRecord struct {
+	Type           string
+	Raw            string
+	Fields         [][2]string
+}
+
+// create audit input
+func NewAuditInput(cfg kAuditConfig) *kAuditInput {
+	cfg = auditConfigDefaults(cfg)
+
+	in := &kAuditInput{
+		name:           cfg.Name,
+		log:            LogWith(kLogFields{LOG_FIELD_GROUP: cfg.Name}),
+		pending:        make(map[string]*kAuditEvent),
+	}
+	in.files = NewFilesInput(kFilesConfig{Name: cfg.Name, Files: []string{cfg.File}})
+	in.files.emitLine = in.emitLine
+
+	return in
+}
+
+// set default audit log
+func auditConfigDefaults(cfg kAuditConfig) kAuditConfig {
+	if cfg.File == "" {
+		cfg.File = KAOHI_DEFAULT_AUDIT_LOG
+	}
+
+	return cfg
+}
+
+func (in *kAuditInput) Name() string {
+	return in.name
+}
+
+func (in *kAuditInput) Type() string {
+	return "audit"
+}
+
+// start tailing audit log from its current end
+func (in *kAuditInput) Start() error {
+	in.log.Info("Starting audit input '%s'", in.name)
+
+	if err := in.files.Start(); err != nil {
+		return err
+	}
+
+	in.stop = make(chan struct{})
+	in.wg.Add(1)
+	go in.run()
+
+	return nil
+}
+
+// stop tailing and emit the events which are still incomplete
+func (in *kAuditInput) Stop() {
+	in.log.Info("Stopping audit input '%s'", in.name)
+
+	close(in.stop)
+	in.wg.Wait()
+
+	in.files.Stop()
+	in.flush(time.Time{})
+}
+
+// apply modified audit log path
+func (in *kAuditInput) Reconfigure(cfg interface{}) {
+	auditCfg, ok := cfg.(kAuditConfig)
+	if !ok {
+		return
+	}
+
+	in.files.Reconfigure(kFilesConfig{Name: in.name, Files: []string{auditConfigDefaults(auditCfg).File}})
+}
+
+func (in *kAuditInput) Pause() {
+	in.files.Pause()
+}
+
+func (in *kAuditInput) Resume() {
+	in.files.Resume()
+}
+
+func (in *kAuditInput) IsPaused() bool {
+	return in.files.IsPaused()
+}
+
+// bytes and errors are counted by files input, events only here since
+// records are joined
+func (in *kAuditInput) Stats() kInputStats {
+	stats := in.files.Stats()
+	stats.Events = atomic.LoadUint64(&in.events)
+
+	return stats
+}
+
+func (in *kAuditInput) HandleEvent(ev Event) {
+	in.files.HandleEvent(ev)
+}
+
+func (in *kAuditInput) Health() kHealthCheck {
+	return in.files.Health()
+}
+
+// emit the events which didn't get records for a while, as not every
+// event is terminated by EOE record
+func (in *kAuditInput) run() {
+	defer in.wg.Done()
+
+	ticker := time.NewTicker(AUDIT_INPUT_FLUSH_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-in.stop:
+			return
+
+		case <-ticker.C:
+			in.flush(time.Now().Add(-AUDIT_INPUT_FLUSH_TIMEOUT))
+		}
+	}
+}
+
+// emit pending events which were updated before the time, or all of them
+// if the time is zero
+func (in *kAuditInput) flush(before time.Time) {
+	var events []*kAuditEvent
+
+	in.mu.Lock()
+	for id, ev := range in.pending {
+		if before.IsZero() || ev.updated.Before(before) {
+			events = append(events, ev)
+			delete(in.pending, id)
+		}
+	}
+	in.mu.Unlock()
+
+	in.emitEvents(events)
+}
+
+// emit events in order of audit time and serial
+func (in *kAuditInput) emitEvents(events []*kAuditEvent) {
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].time.Equal(events[j].time) {
+			return events[i].time.Before(events[j].time)
+		}
+		return events[i].id < events[j].id
+	})
+
+	for _, ev := range events {
+		atomic.AddUint64(&in.events, 1)
+		EmitEvent(ev.toKaohiEvent(in.name))
+	}
+}
+
+// add record to the event of its audit id, called by files input
+func (in *kAuditInput) emitLine(path string, line []byte) {
+	rec, t, id, ok := parseAuditRecord(string(line))
+	if !ok {
+		in.files.addErrors(1)
+		return
+	}
+
+	var done []*kAuditEvent
+
+	in.mu.Lock()
+	ev := in.pending[id]
+	if ev == nil {
+		// too many incomplete events, emit the oldest one
+		if len(in.pending) >= AUDIT_INPUT_MAX_PENDING {
+			var oldest *kAuditEvent
+			for _, p := range in.pending {
+				if oldest == nil || p.updated.Before(oldest.updated) {
+					oldest = p
+				}
+			}
+			delete(in.pending, oldest.id)
+			done = append(done, oldest)
+		}
+
+		ev = &kAuditEvent{id: id, path: path, time: t}
+		in.pending[id] = ev
+	}
+	ev.updated = time.Now()
+
+	// EOE only terminates multi-record events
+	if rec.Type == "EOE" {
+		delete(in.pending, id)
+		done = append(done, ev)
+	} else {
+		ev.records = append(ev.records, rec)
+	}
+	in.mu.Unlock()
+
+	in.emitEvents(done)
+}
+
+// parse audit record, returns the record with its time and audit id
+func parseAuditRecord(line string) (kAuditRecord, time.Time, string, bool) {
+	m := kAuditHeader.FindStringSubmatch(line)
+	if m == nil {
+		return kAuditRecord{}, time.Time{}, "", false
+	}
+
+	sec, _ := strconv.ParseInt(m[2], 10, 64)
+	msec, _ := strconv.ParseInt(m[3], 10, 64)
+	t := time.Unix(sec, msec * int64(time.Millisecond))
+
+	// enriched fields of log_format=ENRICHED follow the separator
+	body := line[len(m[0]):]
+	enriched := ""
+	if i := strings.Index(body, AUDIT_INPUT_ENRICHED_SEP); i >= 0 {
+		enriched = body[i + 1:]
+		body = body[:i]
+	}
+
+	rec := kAuditRecord{Type: m[1], Raw: line}
+	for _, kv := range splitAuditFields(body) {
+		// records of user space programs nest their fields in msg='...'
+		if kv[0] == "msg" && len(kv[1]) >= 2 && kv[1][0] == '\'' && kv[1][len(kv[1]) - 1] == '\'' {
+			for _, nested := range splitAuditFields(kv[1][1:len(kv[1]) - 1]) {
+				nested[1] = decodeAuditValue(rec.Type, nested[0], nested[1])
+				rec.Fields = append(rec.Fields, nested)
+			}
+			continue
+		}
+
+		kv[1] = decodeAuditValue(rec.Type, kv[0], kv[1])
+		rec.Fields = append(rec.Fields, kv)
+	}
+	for _, kv := range splitAuditFields(enriched) {
+		kv[1] = strings.Trim(kv[1], `"`)
+		rec.Fields = append(rec.Fields, kv)
+	}
+
+	return rec, t, m[2] + "." + m[3] + ":" + m[4], true
+}
+
+// split "key=value key='value with spaces' key="quoted"" into pairs
+func splitAuditFields(s string) [][2]string {
+	var fields [][2]string
+
+	for {
+		s = strings.TrimLeft(s, " ")
+		if s == "" {
+			return fields
+		}
+
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return fields
+		}
+		key := s[:eq]
+		s = s[eq + 1:]
+
+		end := strings.IndexByte(s, ' ')
+		if len(s) > 0 && (s[0] == '\'' || s[0] == '"') {
+			if close := strings.IndexByte(s[1:], s[0]); close >= 0 {
+				end = close + 2
+			}
+		}
+		if end < 0 {
+			end = len(s)
+		}
+
+		fields = append(fields, [2]string{key, s[:end]})
+		s = s[end:]
+	}
+}
+
+// unquote value, or decode it if it's hex encoded, chunks of EXECVE
+// arguments are kept as they are until they are joined
+func decodeAuditValue(typ string, key string, value string) string {
+	if typ == "EXECVE" && kAuditExecveChunk.MatchString(key) {
+		return value
+	}
+	if len(value) >= 2 && value[0] == '"' && value[len(value) - 1] == '"' {
+		return value[1:len(value) - 1]
+	}
+
+	if !kAuditEncodedFields[key] && !(typ == "EXECVE" && kAuditExecveArg.MatchString(key)) {
+		return value
+	}
+	if value == "(null)" || value == "(none)" || strings.ToUpper(value) != value {
+		return value
+	}
+
+	decoded, err := hex.DecodeString(value)
+	if err != nil {
+		return value
+	}
+
+	// arguments of process title are separated by NUL
+	return strings.Replace(strings.TrimRight(string(decoded), "\x00"), "\x00", " ", -1)
+}
+
+// convert joined records to event, fields are named by lowercase record
+// type like syscall.exe, and numbered if the type repeats like path.0.name;
+// EXECVE records are merged, as long command lines are split into several
+func (ev *kAuditEvent) toKaohiEvent(group string) *kEvent {
+	var raw, types []string
+	counts := make(map[string]int)
+	for _, rec := range ev.records {
+		counts[rec.Type]++
+	}
+
+	e := NewKaohiEvent(group, ev.path, "")
+	e.Time = ev.time
+	e.SetField("audit.id", ev.id)
+
+	seen := make(map[string]int)
+	execve := make(map[string]string)
+	for _, rec := range ev.records {
+		raw = append(raw, rec.Raw)
+		types = append(types, rec.Type)
+
+		if rec.Type == "EXECVE" {
+			for _, kv := range rec.Fields {
+				execve[kv[0]] = kv[1]
+			}
+			continue
+		}
+
+		prefix := strings.ToLower(rec.Type)
+		if counts[rec.Type] > 1 {
+			prefix += "." + strconv.Itoa(seen[rec.Type])
+		}
+		seen[rec.Type]++
+
+		for _, kv := range rec.Fields {
+			e.SetField(prefix + "." + kv[0], kv[1])
+		}
+	}
+	if len(execve) > 0 {
+		setExecveFields(e, execve)
+	}
+
+	e.SetField("audit.types", strings.Join(types, ","))
+	e.Message = strings.Join(raw, "\n")
+
+	return e
+}
+
+// set merged fields of EXECVE records and join arguments of executed command
+func setExecveFields(e *kEvent, fields map[string]string) {
+	for key, value := range fields {
+		if !kAuditExecveChunk.MatchString(key) {
+			e.SetField("execve." + key, value)
+		}
+	}
+
+	argc, err := strconv.Atoi(fields["argc"])
+	if err != nil || argc < 0 {
+		return
+	}
+
+	// every argument is at least one field, so argc can't exceed them
+	if argc > len(fields) {
+		argc = len(fields)
+	}
+	args := make([]string, 0, argc)
+	for i := 0; i < argc; i++ {
+		name := "a" + strconv.Itoa(i)
+		arg, ok := fields[name]
+		if !ok {
+			if arg, ok = joinExecveChunks(fields, name); !ok {
+				break
+			}
+			e.SetField("execve." + name, arg)
+		}
+		args = append(args, arg)
+	}
+	e.SetField("execve.cmdline", strings.Join(args, " "))
+}
+
+// join chunks of long EXECVE argument, the chunks are either quoted or
+// hex encoded and decoded after they are joined
+func joinExecveChunks(fields map[string]string, name string) (string, bool) {
+	if _, ok := fields[name + "_len"]; !ok {
+		return "", false
+	}
+
+	var joined []string
+	quoted := false
+	for i := 0; ; i++ {
+		chunk, ok := fields[name + "[" + strconv.Itoa(i) + "]"]
+		if !ok {
+			break
+		}
+		if len(chunk) >= 2 && chunk[0] == '"' && chunk[len(chunk) - 1] == '"' {
+			chunk = chunk[1:len(chunk) - 1]
+			quoted = true
+		}
+		joined = append(joined, chunk)
+	}
+
+	if quoted {
+		return strings.Join(joined, ""), true
+	}
+	return decodeAuditValue("EXECVE", name, strings.Join(joined, "")), true
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// records of an audit event as auditd writes them
+var kTestAuditRecords = []string{
+	`type=SYSCALL msg=audit(1364481363.243:24287): arch=c000003e syscall=2 success=no exit=-13 a0=7fffd19c5592 a1=0 a2=7fffd19c4b50 a3=a items=1 ppid=2686 pid=3538 auid=1000 uid=1000 gid=1000 euid=1000 suid=1000 fsuid=1000 egid=1000 sgid=1000 fsgid=1000 tty=pts0 ses=1 comm="cat" exe="/bin/cat" subj=unconfined_u:unconfined_r:unconfined_t:s0-s0:c0.c1023 key="sshd_config"`,
+	`type=CWD msg=audit(1364481363.243:24287):  cwd="/home/shadowman"`,
+	`type=PATH msg=audit(1364481363.243:24287): item=0 name="/etc/ssh/sshd_config" inode=409248 dev=fd:00 mode=0100600 ouid=0 ogid=0 rdev=00:00 obj=system_u:object_r:etc_t:s0 objtype=NORMAL cap_fp=none cap_fi=none cap_fe=0 cap_fver=0`,
+	`type=PATH msg=audit(1364481363.243:24287): item=1 name=2F746D702F6D792066696C65 inode=409249 dev=fd:00 mode=0100644 ouid=0 ogid=0 rdev=00:00 objtype=NORMAL`,
+	`type=PROCTITLE msg=audit(1364481363.243:24287): proctitle=636174002F6574632F7373682F737368645F636F6E666967`,
+}
+
+func parseTestAuditEvent(t *testing.T, lines ...string) *kAuditEvent {
+	ev := &kAuditEvent{path: "/var/log/audit/audit.log"}
+
+	for _, line := range lines {
+		rec, tm, id, ok := parseAuditRecord(line)
+		if !ok {
+			t.Fatalf("could not parse %q", line)
+		}
+		if ev.id != "" && ev.id != id {
+			t.Fatalf("audit id %s of %q, expected %s", id, line, ev.id)
+		}
+		ev.id = id
+		ev.time = tm
+		ev.records = append(ev.records, rec)
+	}
+
+	return ev
+}
+
+func TestParseAuditRecord(t *testing.T) {
+	rec, tm, id, ok := parseAuditRecord(kTestAuditRecords[0])
+	if !ok {
+		t.Fatal("record wasn't parsed")
+	}
+	if rec.Type != "SYSCALL" || id != "1364481363.243:24287" ||
+		!tm.Equal(time.Unix(1364481363, 243 * int64(time.Millisecond))) {
+		t.Fatalf("unexpected header: %s %s %v", rec.Type, id, tm)
+	}
+
+	fields := make(map[string]string)
+	for _, kv := range rec.Fields {
+		fields[kv[0]] = kv[1]
+	}
+	for key, value := range map[string]string{
+		"syscall": "2",
+		"exit":    "-13",
+		"a0":      "7fffd19c5592",
+		"comm":    "cat",
+		"exe":     "/bin/cat",
+		"key":     "sshd_config",
+		"subj":    "unconfined_u:unconfined_r:unconfined_t:s0-s0:c0.c1023",
+	} {
+		if fields[key] != value {
+			t.Errorf("%s=%q, expected %q", key, fields[key], value)
+		}
+	}
+
+	for _, line := range []string{"", "type=SYSCALL", "type=SYSCALL msg=audit(1364481363.243): a=b", "random text"} {
+		if _, _, _, ok := parseAuditRecord(line); ok {
+			t.Errorf("%q was parsed", line)
+		}
+	}
+}
+
+func TestParseAuditRecordNestedAndEnriched(t *testing.T) {
+	rec, _, _, ok := parseAuditRecord(`type=USER_LOGIN msg=audit(1614788400.100:3400): pid=1234 uid=0 auid=1000 ses=3 msg='op=login id=1000 exe="/usr/sbin/sshd" hostname=? addr=10.0.0.1 terminal=/dev/pts/0 res=success'` +
+		"\x1dAUID=\"alice\" UID=\"root\"")
+	if !ok {
+		t.Fatal("record wasn't parsed")
+	}
+
+	fields := make(map[string]string)
+	for _, kv := range rec.Fields {
+		fields[kv[0]] = kv[1]
+	}
+	for key, value := range map[string]string{
+		"pid":      "1234",
+		"op":       "login",
+		"exe":      "/usr/sbin/sshd",
+		"addr":     "10.0.0.1",
+		"terminal": "/dev/pts/0",
+		"res":      "success",
+		"AUID":     "alice",
+		"UID":      "root",
+	} {
+		if fields[key] != value {
+			t.Errorf("%s=%q, expected %q", key, fields[key], value)
+		}
+	}
+	if _, ok := fields["msg"]; ok {
+		t.Error("nested msg wasn't expanded")
+	}
+}
+
+func TestDecodeAuditValue(t *testing.T) {
+	for _, c := range []struct {
+		typ, key, value, expected string
+	}{
+		{"SYSCALL", "comm", `"cat"`, "cat"},
+		{"SYSCALL", "exe", "2F746D702F6D79206578650A", "/tmp/my exe\n"},
+		{"PROCTITLE", "proctitle", "636174002F6574632F706173737764", "cat /etc/passwd"},
+		{"EXECVE", "a1", "2F746D702F6D7920646972", "/tmp/my dir"},
+		{"SYSCALL", "a1", "0", "0"},
+		{"SYSCALL", "a0", "7fffd19c5592", "7fffd19c5592"},
+		{"SYSCALL", "key", "(null)", "(null)"},
+		{"PATH", "name", "(none)", "(none)"},
+		{"PATH", "name", "ABC", "ABC"},
+		{"SYSCALL", "arch", "C000003E", "C000003E"},
+		{"EXECVE", "a1[0]", "2D65", "2D65"},
+	} {
+		if decoded := decodeAuditValue(c.typ, c.key, c.value); decoded != c.expected {
+			t.Errorf("%s %s=%s decoded to %q, expected %q", c.typ, c.key, c.value, decoded, c.expected)
+		}
+	}
+}
+
+func TestAuditEventFields(t *testing.T) {
+	e := parseTestAuditEvent(t, kTestAuditRecords...).toKaohiEvent("audit")
+
+	for key, value := range map[string]string{
+		"audit.id":            "1364481363.243:24287",
+		"audit.types":         "SYSCALL,CWD,PATH,PATH,PROCTITLE",
+		"syscall.exe":         "/bin/cat",
+		"syscall.key":         "sshd_config",
+		"cwd.cwd":             "/home/shadowman",
+		"path.0.name":         "/etc/ssh/sshd_config",
+		"path.1.name":         "/tmp/my file",
+		"proctitle.proctitle": "cat /etc/ssh/sshd_config",
+	} {
+		if e.Fields[key] != value {
+			t.Errorf("%s=%q, expected %q", key, e.Fields[key], value)
+		}
+	}
+	if e.Source != "/var/log/audit/audit.log" || e.Group != "audit" {
+		t.Errorf("unexpected source %s and group %s", e.Source, e.Group)
+	}
+	if !e.Time.Equal(time.Unix(1364481363, 243 * int64(time.Millisecond))) {
+		t.Errorf("unexpected time %v", e.Time)
+	}
+}
+
+func TestAuditExecveRecordsAreMerged(t *testing.T) {
+	e := parseTestAuditEvent(t,
+		`type=SYSCALL msg=audit(1614788500.000:3500): arch=c000003e syscall=59 success=yes exit=0 items=2 ppid=1 pid=4242 comm="perl" exe="/usr/bin/perl"`,
+		`type=EXECVE msg=audit(1614788500.000:3500): argc=4 a0="perl" a1_len=10 a1[0]=2D65207072 a1[1]=696E74203A`,
+		`type=EXECVE msg=audit(1614788500.000:3500): a2=2F746D702F6D7920646972 a3_len=6 a3[0]="abc" a3[1]="def"`,
+	).toKaohiEvent("audit")
+
+	for key, value := range map[string]string{
+		"execve.argc":    "4",
+		"execve.a0":      "perl",
+		"execve.a1":      "-e print :",
+		"execve.a2":      "/tmp/my dir",
+		"execve.a3":      "abcdef",
+		"execve.cmdline": "perl -e print : /tmp/my dir abcdef",
+	} {
+		if e.Fields[key] != value {
+			t.Errorf("%s=%q, expected %q", key, e.Fields[key], value)
+		}
+	}
+	for _, key := range []string{"execve.0.argc", "execve.1.a2", "execve.a1[0]", "execve.a1_len"} {
+		if _, ok := e.Fields[key]; ok {
+			t.Errorf("unexpected field %s", key)
+		}
+	}
+}
+
+func TestAuditExecveArgcIsBounded(t *testing.T) {
+	e := parseTestAuditEvent(t,
+		`type=EXECVE msg=audit(1614788500.000:3501): argc=2147483647 a0="sh" a1="-c"`,
+	).toKaohiEvent("audit")
+
+	if e.Fields["execve.cmdline"] != "sh -c" {
+		t.Errorf("unexpected cmdline %q", e.Fields["execve.cmdline"])
+	}
+}
@@ -0,0 +1,248 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// commands input structure which runs the commands of commands group
+type kCommandsInput struct {
+	name           string
+	log            kFieldLogger
+	uid            int
+	interval       time.Duration
+	cmds           []string
+	stop           chan struct{}
+	wg             sync.WaitGroup
+	duration       kHistogram
+	exitMu         sync.Mutex
+	exitCodes      map[int]uint64
+
+	kInputState
+}
+
+// create commands input
+func NewCommandsInput(cfg kCommandsConfig) *kCommandsInput {
+	return &kCommandsInput{
+		name:           cfg.Name,
+		log:            LogWith(kLogFields{LOG_FIELD_GROUP: cfg.Name}),
+		uid:            cfg.Uid,
+		interval:       time.Duration(cfg.Interval) * time.Second,
+		cmds:           cfg.Cmds,
+		exitCodes:      make(map[int]uint64),
+	}
+}
+
+func (in *kCommandsInput) Name() string {
+	return in.name
+}
+
+func (in *kCommandsInput) Type() string {
+	return "commands"
+}
+
+// start a scheduler for each command
+func (in *kCommandsInput) Start() error {
+	in.log.Info("Starting commands input '%s'", in.name)
+
+	in.stop = make(chan struct{})
+	for _, cmd := range in.cmds {
+		in.wg.Add(1)
+		go in.schedule(cmd)
+	}
+
+	return nil
+}
+
+// stop schedulers and kill running commands
+func (in *kCommandsInput) Stop() {
+	in.log.Info("Stopping commands input '%s'", in.name)
+
+	close(in.stop)
+	in.wg.Wait()
+}
+
+// run command at every interval, or once if interval isn't positive
+func (in *kCommandsInput) schedule(cmd string) {
+	defer in.wg.Done()
+
+	for {
+		if !in.IsPaused() {
+			in.run(cmd)
+		}
+
+		if in.interval <= 0 {
+			return
+		}
+
+		select {
+		case <-in.stop:
+			return
+		case <-time.After(in.interval):
+		}
+	}
+}
+
+// input fails if the user who runs commands can't be resolved
+func (in *kCommandsInput) Health() kHealthCheck {
+	if _, err := in.credential(); err != nil {
+		return healthFail("user %d: %v", in.uid, err)
+	}
+
+	return healthOK("%d commands", len(in.cmds))
+}
+
+// get credential of the user who runs commands
+func (in *kCommandsInput) credential() (*syscall.Credential, error) {
+	if in.uid == os.Geteuid() {
+		return nil, nil
+	}
+
+	u, err := user.LookupId(strconv.Itoa(in.uid))
+	if err != nil {
+		return nil, err
+	}
+
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return nil, err
+	}
+
+	return &syscall.Credential{Uid: uint32(in.uid), Gid: uint32(gid)}, nil
+}
+
+// run command and emit an event per output line
+func (in *kCommandsInput) run(cmdline string) {
+	in.log.Debug("Running command '%s' of group '%s'", cmdline, in.name)
+
+	cred, err := in.credential()
+	if err != nil {
+		in.log.Err("Could not get credential of uid %d: %v", in.uid, err)
+		in.addErrors(1)
+		return
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", cmdline)
+	if cred != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		in.addErrors(1)
+		return
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		in.addErrors(1)
+		return
+	}
+
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		in.log.Err("Could not run command '%s': %v", cmdline, err)
+		in.addErrors(1)
+		return
+	}
+
+	// kill command if input is stopped while running
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-in.stop:
+			cmd.Process.Kill()
+		case <-exited:
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go in.readOutput(cmdline, "stdout", stdout, &wg)
+	go in.readOutput(cmdline, "stderr", stderr, &wg)
+	wg.Wait()
+
+	err = cmd.Wait()
+	close(exited)
+
+	in.duration.Observe(time.Since(start))
+	in.exitMu.Lock()
+	in.exitCodes[cmd.ProcessState.ExitCode()]++
+	in.exitMu.Unlock()
+
+	if err != nil {
+		in.log.Warn("Command '%s' of group '%s' exited: %v", cmdline, in.name, err)
+		in.addErrors(1)
+	}
+}
+
+// emit an event per line of command output
+func (in *kCommandsInput) readOutput(cmdline string, stream string, r io.Reader, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, FILES_INPUT_READ_SIZE), FILES_INPUT_MAX_LINE_LEN)
+	for scanner.Scan() {
+		line := scanner.Text()
+		in.addBytes(len(line) + 1)
+		if in.IsPaused() || line == "" {
+			continue
+		}
+
+		ev := NewKaohiEvent(in.name, cmdline, line)
+		ev.SetField("stream", stream)
+		in.addEvents(1)
+		EmitEvent(ev)
+	}
+
+	// keep draining so that the command never blocks on a full pipe
+	if scanner.Err() != nil {
+		in.addErrors(1)
+		io.Copy(ioutil.Discard, r)
+	}
+}
+
+// get run time and exit codes of commands
+func (in *kCommandsInput) CommandStats() kCommandStats {
+	stats := kCommandStats{Duration: in.duration.Snapshot(), ExitCodes: make(map[int]uint64)}
+
+	in.exitMu.Lock()
+	for code, n := range in.exitCodes {
+		stats.ExitCodes[code] = n
+	}
+	in.exitMu.Unlock()
+
+	return stats
+}
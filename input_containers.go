@@ -0,0 +1,502 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// container input constants
+const (
+	CONTAINERS_INPUT_SCAN_INTERVAL = 2 * time.Second
+	CONTAINERS_INPUT_MAX_MESSAGE_LEN = 1024 * 1024
+	CONTAINERS_INPUT_PARTIAL_TIMEOUT = 5 * time.Second
+	CONTAINERS_INPUT_ID_LEN       = 64
+)
+
+// containers input structure which tails log files of kubernetes containers,
+// the files are tailed by a files input which isn't registered itself
+type kContainersInput struct {
+	name           string
+	cfg            kContainersConfig
+	log            kFieldLogger
+	files          *kFilesInput
+	mu             sync.Mutex
+	meta           map[string]kContainerMeta
+	partials       map[string]*kContainerPartial
+	events         uint64
+	stop           chan struct{}
+	wg             sync.WaitGroup
+}
+
+// metadata of container log file which is taken from its path
+type kContainerMeta struct {
+	Namespace      string
+	Pod            string
+	PodUid         string
+	Container      string
+	ContainerId    string
+	RestartCount   string
+}
+
+// partial message of container stream which isn't complete yet
+type kContainerPartial struct {
+	path           string
+	stream         string
+	meta           kContainerMeta
+	time           time.Time
+	updated        time.Time
+	message        []byte
+}
+
+// set default log directories
+func containersConfigDefaults(cfg kContainersConfig) kContainersConfig {
+	if cfg.ContainersDir == "" {
+		cfg.ContainersDir = KAOHI_DEFAULT_CONTAINERS_DIR
+	}
+	if cfg.PodsDir == "" {
+		cfg.PodsDir = KAOHI_DEFAULT_PODS_DIR
+	}
+
+	return cfg
+}
+
+// create containers input
+func NewContainersInput(cfg kContainersConfig) *kContainersInput {
+	in := &kContainersInput{
+		name:           cfg.Name,
+		cfg:            containersConfigDefaults(cfg),
+		log:            LogWith(kLogFields{LOG_FIELD_GROUP: cfg.Name}),
+		meta:           make(map[string]kContainerMeta),
+		partials:       make(map[string]*kContainerPartial),
+	}
+	in.files = NewFilesInput(kFilesConfig{Name: cfg.Name})
+	in.files.emitLine = in.emitLine
+
+	return in
+}
+
+func (in *kContainersInput) Name() string {
+	return in.name
+}
+
+func (in *kContainersInput) Type() string {
+	return "containers"
+}
+
+// start tailing container logs from their current end, containers which
+// appear later are read from beginning
+func (in *kContainersInput) Start() error {
+	in.log.Info("Starting containers input '%s'", in.name)
+
+	in.mu.Lock()
+	in.meta = discoverContainerLogs(in.cfg)
+	paths := containerLogPaths(in.meta)
+	in.mu.Unlock()
+
+	in.files.files = paths
+	if err := in.files.Start(); err != nil {
+		return err
+	}
+	in.files.fromStart = true
+
+	in.stop = make(chan struct{})
+	in.wg.Add(1)
+	go in.run()
+
+	return nil
+}
+
+func (in *kContainersInput) Stop() {
+	in.log.Info("Stopping containers input '%s'", in.name)
+
+	close(in.stop)
+	in.wg.Wait()
+
+	in.files.Stop()
+	in.flushPartials(time.Time{})
+}
+
+// apply modified directories and namespace filters
+func (in *kContainersInput) Reconfigure(cfg interface{}) {
+	containersCfg, ok := cfg.(kContainersConfig)
+	if !ok {
+		return
+	}
+
+	in.log.Info("Reconfiguring containers input '%s'", in.name)
+
+	in.mu.Lock()
+	in.cfg = containersConfigDefaults(containersCfg)
+	in.mu.Unlock()
+
+	in.rescan()
+}
+
+func (in *kContainersInput) Pause() {
+	in.files.Pause()
+}
+
+func (in *kContainersInput) Resume() {
+	in.files.Resume()
+}
+
+func (in *kContainersInput) IsPaused() bool {
+	return in.files.IsPaused()
+}
+
+// bytes and errors are counted by files input, events only here since
+// partial lines are joined
+func (in *kContainersInput) Stats() kInputStats {
+	stats := in.files.Stats()
+	stats.Events = atomic.LoadUint64(&in.events)
+
+	return stats
+}
+
+func (in *kContainersInput) HandleEvent(ev Event) {
+	in.files.HandleEvent(ev)
+}
+
+// input fails if none of log directories exists
+func (in *kContainersInput) Health() kHealthCheck {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	_, cerr := os.Stat(in.cfg.ContainersDir)
+	_, perr := os.Stat(in.cfg.PodsDir)
+	if cerr != nil && perr != nil {
+		return healthFail("neither %s nor %s exists", in.cfg.ContainersDir, in.cfg.PodsDir)
+	}
+
+	return healthOK("%d container logs tailed", len(in.meta))
+}
+
+// discover containers which were started or removed, and emit partial
+// messages which weren't continued for a while
+func (in *kContainersInput) run() {
+	defer in.wg.Done()
+
+	ticker := time.NewTicker(CONTAINERS_INPUT_SCAN_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-in.stop:
+			return
+
+		case <-ticker.C:
+			in.rescan()
+			in.flushPartials(time.Now().Add(-CONTAINERS_INPUT_PARTIAL_TIMEOUT))
+		}
+	}
+}
+
+// update list of tailed files if containers were changed
+func (in *kContainersInput) rescan() {
+	in.mu.Lock()
+	meta := discoverContainerLogs(in.cfg)
+	changed := !reflect.DeepEqual(meta, in.meta)
+	var removed []*kContainerPartial
+	if changed {
+		// partial messages of removed containers won't be continued
+		removed = in.takePartials(func(p *kContainerPartial) bool {
+			_, ok := meta[p.path]
+			return !ok
+		})
+		in.meta = meta
+	}
+	in.mu.Unlock()
+
+	in.emitPartials(removed)
+	if changed {
+		in.log.Debug("Tailing %d container logs", len(meta))
+		in.files.Reconfigure(kFilesConfig{Name: in.name, Files: containerLogPaths(meta)})
+	}
+}
+
+// parse line of CRI log format "<time> <stream> <P|F> <message>", or of
+// docker json-file format; a message is partial if it's continued by the
+// next line of same stream
+func parseContainerLine(line []byte) (t time.Time, stream string, partial bool, message []byte, ok bool) {
+	if len(line) > 0 && line[0] == '{' {
+		var entry struct {
+			Log    string `json:"log"`
+			Stream string `json:"stream"`
+			Time   string `json:"time"`
+		}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return
+		}
+		t, _ = time.Parse(time.RFC3339Nano, entry.Time)
+		partial = !strings.HasSuffix(entry.Log, "\n")
+		return t, entry.Stream, partial, []byte(strings.TrimSuffix(entry.Log, "\n")), true
+	}
+
+	parts := bytes.SplitN(line, []byte(" "), 4)
+	if len(parts) < 3 {
+		return
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, string(parts[0]))
+	if err != nil {
+		return
+	}
+
+	// the tag may have further flags after ':'
+	tag := parts[2]
+	if i := bytes.IndexByte(tag, ':'); i >= 0 {
+		tag = tag[:i]
+	}
+	if len(parts) == 4 {
+		message = parts[3]
+	}
+
+	return t, string(parts[1]), string(tag) == "P", message, true
+}
+
+// join partial lines and emit complete messages, called by files input
+func (in *kContainersInput) emitLine(path string, line []byte) {
+	t, stream, partial, message, ok := parseContainerLine(line)
+	if !ok {
+		in.files.addErrors(1)
+		return
+	}
+
+	in.mu.Lock()
+	meta := in.meta[path]
+	key := path + "\x00" + stream
+	p := in.partials[key]
+	if p != nil {
+		message = append(p.message, message...)
+		t = p.time
+	}
+
+	if partial && len(message) < CONTAINERS_INPUT_MAX_MESSAGE_LEN {
+		if p == nil {
+			// line is a view into read buffer of files input, which
+			// is overwritten by the next read
+			message = append([]byte(nil), message...)
+			p = &kContainerPartial{path: path, stream: stream, meta: meta, time: t}
+			in.partials[key] = p
+		}
+		p.message = message
+		p.updated = time.Now()
+		in.mu.Unlock()
+		return
+	}
+	delete(in.partials, key)
+	in.mu.Unlock()
+
+	in.emitMessage(path, stream, meta, t, message)
+}
+
+// remove partial messages for which remove returns true, in.mu must be held
+func (in *kContainersInput) takePartials(remove func(p *kContainerPartial) bool) []*kContainerPartial {
+	var taken []*kContainerPartial
+	for key, p := range in.partials {
+		if remove(p) {
+			taken = append(taken, p)
+			delete(in.partials, key)
+		}
+	}
+
+	return taken
+}
+
+// emit partial messages which weren't continued since the time, or all of
+// them if the time is zero
+func (in *kContainersInput) flushPartials(before time.Time) {
+	in.mu.Lock()
+	partials := in.takePartials(func(p *kContainerPartial) bool {
+		return before.IsZero() || p.updated.Before(before)
+	})
+	in.mu.Unlock()
+
+	in.emitPartials(partials)
+}
+
+// emit partial messages as they are in order of their time
+func (in *kContainersInput) emitPartials(partials []*kContainerPartial) {
+	sort.Slice(partials, func(i, j int) bool {
+		return partials[i].time.Before(partials[j].time)
+	})
+
+	for _, p := range partials {
+		in.emitMessage(p.path, p.stream, p.meta, p.time, p.message)
+	}
+}
+
+// emit complete message of container stream
+func (in *kContainersInput) emitMessage(path string, stream string, meta kContainerMeta, t time.Time, message []byte) {
+	ev := NewKaohiEvent(in.name, path, string(message))
+	if !t.IsZero() {
+		ev.Time = t
+	}
+	ev.SetField("stream", stream)
+	for name, value := range map[string]string{
+		"namespace":        meta.Namespace,
+		"pod":              meta.Pod,
+		"pod_uid":          meta.PodUid,
+		"container":        meta.Container,
+		"container_id":     meta.ContainerId,
+		"restart_count":    meta.RestartCount,
+	} {
+		if value != "" {
+			ev.SetField(name, value)
+		}
+	}
+
+	atomic.AddUint64(&in.events, 1)
+	EmitEvent(ev)
+}
+
+// parse name of /var/log/containers file "<pod>_<namespace>_<container>-<id>.log"
+func parseContainersName(name string) (kContainerMeta, bool) {
+	parts := strings.SplitN(strings.TrimSuffix(name, ".log"), "_", 3)
+	if len(parts) != 3 || len(parts[2]) <= CONTAINERS_INPUT_ID_LEN + 1 {
+		return kContainerMeta{}, false
+	}
+
+	sep := len(parts[2]) - CONTAINERS_INPUT_ID_LEN - 1
+	if parts[2][sep] != '-' {
+		return kContainerMeta{}, false
+	}
+
+	return kContainerMeta{
+		Namespace:      parts[1],
+		Pod:            parts[0],
+		Container:      parts[2][:sep],
+		ContainerId:    parts[2][sep + 1:],
+	}, true
+}
+
+// parse path under pods directory "<namespace>_<pod>_<uid>/<container>/<restart>.log"
+func parsePodsPath(rel string) (kContainerMeta, bool) {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if len(parts) != 3 {
+		return kContainerMeta{}, false
+	}
+
+	pod := strings.SplitN(parts[0], "_", 3)
+	if len(pod) != 3 {
+		return kContainerMeta{}, false
+	}
+
+	return kContainerMeta{
+		Namespace:      pod[0],
+		Pod:            pod[1],
+		PodUid:         pod[2],
+		Container:      parts[1],
+		RestartCount:   strings.TrimSuffix(parts[2], ".log"),
+	}, true
+}
+
+// check namespace filters of configuration
+func containerNamespaceAllowed(cfg kContainersConfig, ns string) bool {
+	for _, excluded := range cfg.ExcludeNamespaces {
+		if ns == excluded {
+			return false
+		}
+	}
+	if len(cfg.Namespaces) == 0 {
+		return true
+	}
+	for _, included := range cfg.Namespaces {
+		if ns == included {
+			return true
+		}
+	}
+
+	return false
+}
+
+// find container log files by their real path, the files of containers
+// directory are usually symlinks to pods directory, so metadata of both
+// is merged
+func discoverContainerLogs(cfg kContainersConfig) map[string]kContainerMeta {
+	logs := make(map[string]kContainerMeta)
+
+	podFiles, _ := filepath.Glob(filepath.Join(cfg.PodsDir, "*", "*", "*.log"))
+	for _, path := range podFiles {
+		rel, err := filepath.Rel(cfg.PodsDir, path)
+		if err != nil {
+			continue
+		}
+		meta, ok := parsePodsPath(rel)
+		if !ok {
+			continue
+		}
+		if real, err := filepath.EvalSymlinks(path); err == nil {
+			logs[real] = meta
+		}
+	}
+
+	containerFiles, _ := filepath.Glob(filepath.Join(cfg.ContainersDir, "*.log"))
+	for _, path := range containerFiles {
+		meta, ok := parseContainersName(filepath.Base(path))
+		if !ok {
+			continue
+		}
+		real, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			continue
+		}
+		if podMeta, ok := logs[real]; ok {
+			podMeta.ContainerId = meta.ContainerId
+			meta = podMeta
+		}
+		logs[real] = meta
+	}
+
+	for path, meta := range logs {
+		if !containerNamespaceAllowed(cfg, meta.Namespace) {
+			delete(logs, path)
+		}
+	}
+
+	return logs
+}
+
+// sorted paths of container logs
+func containerLogPaths(logs map[string]kContainerMeta) []string {
+	paths := make([]string, 0, len(logs))
+	for path := range logs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	return paths
+}
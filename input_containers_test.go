@@ -0,0 +1,261 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// output which keeps written events
+type kTestOutput struct {
+	mu             sync.Mutex
+	events         []*kEvent
+}
+
+func (out *kTestOutput) Name() string                      { return "test" }
+func (out *kTestOutput) Type() string                      { return "test" }
+func (out *kTestOutput) Flush(timeout time.Duration) error { return nil }
+func (out *kTestOutput) Stats() kOutputStats               { return kOutputStats{} }
+func (out *kTestOutput) Close()                            {}
+
+func (out *kTestOutput) Write(ev *kEvent) error {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+
+	out.events = append(out.events, ev)
+	return nil
+}
+
+func (out *kTestOutput) Events() []*kEvent {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+
+	return append([]*kEvent(nil), out.events...)
+}
+
+// capture emitted events until the test ends
+func captureEvents(t *testing.T) *kTestOutput {
+	out := &kTestOutput{}
+	prev := swapOutputs([]kOutput{out})
+	t.Cleanup(func() { swapOutputs(prev) })
+
+	return out
+}
+
+const kTestContainerId = "5e6a1a2c1f4dbb0ac1a5e1b6f9c0c3b8d7e6f5a4b3c2d1e0f9a8b7c6d5e4f3a2"
+
+func TestParseContainerLineCRI(t *testing.T) {
+	for _, c := range []struct {
+		line, stream, message string
+		partial               bool
+	}{
+		{"2023-10-06T00:17:09.669794202Z stdout F Hello from the container", "stdout", "Hello from the container", false},
+		{"2023-10-06T00:17:09.669794202Z stderr P {\"level\":\"info\",", "stderr", "{\"level\":\"info\",", true},
+		{"2023-10-06T00:17:09.669794202Z stdout F ", "stdout", "", false},
+		{"2023-10-06T00:17:09.669794202Z stdout F", "stdout", "", false},
+		{"2023-10-06T00:17:09.669794202+02:00 stdout P:extra partial with flags", "stdout", "partial with flags", true},
+	} {
+		tm, stream, partial, message, ok := parseContainerLine([]byte(c.line))
+		if !ok {
+			t.Errorf("%q wasn't parsed", c.line)
+			continue
+		}
+		if stream != c.stream || partial != c.partial || string(message) != c.message {
+			t.Errorf("%q parsed to %s %v %q", c.line, stream, partial, message)
+		}
+		if tm.UnixNano() % int64(time.Second) != 669794202 {
+			t.Errorf("%q has time %v", c.line, tm)
+		}
+	}
+
+	for _, line := range []string{"", "stdout F message", "yesterday stdout F message", "2023-10-06T00:17:09Z stdout"} {
+		if _, _, _, _, ok := parseContainerLine([]byte(line)); ok {
+			t.Errorf("%q was parsed", line)
+		}
+	}
+}
+
+func TestParseContainerLineDocker(t *testing.T) {
+	tm, stream, partial, message, ok := parseContainerLine(
+		[]byte(`{"log":"GET /healthz 200\n","stream":"stdout","time":"2023-10-06T00:17:09.669794202Z"}`))
+	if !ok || stream != "stdout" || partial || string(message) != "GET /healthz 200" {
+		t.Fatalf("unexpected result: %s %v %q %v", stream, partial, message, ok)
+	}
+	if !tm.Equal(time.Date(2023, 10, 6, 0, 17, 9, 669794202, time.UTC)) {
+		t.Fatalf("unexpected time %v", tm)
+	}
+
+	_, _, partial, message, ok = parseContainerLine([]byte(`{"log":"first 16k of line","stream":"stderr","time":"2023-10-06T00:17:09Z"}`))
+	if !ok || !partial || string(message) != "first 16k of line" {
+		t.Fatalf("unexpected partial result: %v %q %v", partial, message, ok)
+	}
+
+	if _, _, _, _, ok := parseContainerLine([]byte(`{"log":`)); ok {
+		t.Fatal("invalid json was parsed")
+	}
+}
+
+func TestParseContainersName(t *testing.T) {
+	meta, ok := parseContainersName("coredns-5d78c9869d-7xk2p_kube-system_coredns-" + kTestContainerId + ".log")
+	if !ok {
+		t.Fatal("name wasn't parsed")
+	}
+	expected := kContainerMeta{Namespace: "kube-system", Pod: "coredns-5d78c9869d-7xk2p", Container: "coredns", ContainerId: kTestContainerId}
+	if meta != expected {
+		t.Fatalf("parsed to %+v", meta)
+	}
+
+	for _, name := range []string{
+		"coredns_kube-system.log",
+		"coredns-5d78c9869d-7xk2p_kube-system_coredns-5e6a1a2c.log",
+		"coredns-5d78c9869d-7xk2p_kube-system_coredns_" + kTestContainerId + ".log",
+	} {
+		if _, ok := parseContainersName(name); ok {
+			t.Errorf("%q was parsed", name)
+		}
+	}
+}
+
+func TestParsePodsPath(t *testing.T) {
+	meta, ok := parsePodsPath("kube-system_coredns-5d78c9869d-7xk2p_1b2c3d4e-5f60-7182-93a4-b5c6d7e8f901/coredns/2.log")
+	if !ok {
+		t.Fatal("path wasn't parsed")
+	}
+	expected := kContainerMeta{Namespace: "kube-system", Pod: "coredns-5d78c9869d-7xk2p",
+		PodUid: "1b2c3d4e-5f60-7182-93a4-b5c6d7e8f901", Container: "coredns", RestartCount: "2"}
+	if meta != expected {
+		t.Fatalf("parsed to %+v", meta)
+	}
+
+	for _, rel := range []string{"kube-system_coredns/coredns/0.log", "kube-system_coredns_uid/0.log", "a_b_c/d/e/0.log"} {
+		if _, ok := parsePodsPath(rel); ok {
+			t.Errorf("%q was parsed", rel)
+		}
+	}
+}
+
+func newTestContainersInput(t *testing.T, path string) *kContainersInput {
+	in := NewContainersInput(kContainersConfig{Name: "k8s", ContainersDir: t.TempDir(), PodsDir: t.TempDir()})
+	in.meta[path] = kContainerMeta{Namespace: "default", Pod: "web", Container: "nginx"}
+
+	return in
+}
+
+func TestContainerPartialLinesAreJoined(t *testing.T) {
+	out := captureEvents(t)
+	path := "/var/log/pods/default_web_uid/nginx/0.log"
+	in := newTestContainersInput(t, path)
+
+	in.emitLine(path, []byte("2023-10-06T00:17:09.000000001Z stdout P first "))
+	in.emitLine(path, []byte("2023-10-06T00:17:09.000000002Z stderr F error line"))
+	in.emitLine(path, []byte("2023-10-06T00:17:09.000000003Z stdout P second "))
+	in.emitLine(path, []byte("2023-10-06T00:17:09.000000004Z stdout F third"))
+
+	events := out.Events()
+	if len(events) != 2 || events[0].Message != "error line" || events[1].Message != "first second third" {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+	ev := events[1]
+	if ev.Time.Nanosecond() != 1 || ev.Fields["stream"] != "stdout" || ev.Fields["namespace"] != "default" ||
+		ev.Fields["pod"] != "web" || ev.Fields["container"] != "nginx" || ev.Source != path {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+	if stats := in.Stats(); stats.Events != 2 {
+		t.Fatalf("%d events counted", stats.Events)
+	}
+}
+
+func TestContainerPartialSurvivesReadBufferReuse(t *testing.T) {
+	out := captureEvents(t)
+	path := "/var/log/pods/default_web_uid/nginx/0.log"
+	in := newTestContainersInput(t, path)
+	tail := &kFileTail{}
+
+	// the partial line ends the first read, the read buffer is reused
+	// for the second one
+	buf := make([]byte, 128)
+	n := copy(buf, "2023-10-06T00:17:09Z stdout P hello-part-one\n")
+	in.files.emitLines(path, tail, buf[:n])
+
+	for i := range buf {
+		buf[i] = 'X'
+	}
+	n = copy(buf, "2023-10-06T00:17:09Z stdout F  hello-part-two\n")
+	in.files.emitLines(path, tail, buf[:n])
+
+	events := out.Events()
+	if len(events) != 1 || events[0].Message != "hello-part-one hello-part-two" {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+}
+
+func TestContainerPartialIsFlushedAfterTimeout(t *testing.T) {
+	out := captureEvents(t)
+	path := "/var/log/pods/default_web_uid/nginx/0.log"
+	in := newTestContainersInput(t, path)
+
+	in.emitLine(path, []byte("2023-10-06T00:17:09Z stdout P never finished"))
+
+	in.flushPartials(time.Now().Add(-CONTAINERS_INPUT_PARTIAL_TIMEOUT))
+	if events := out.Events(); len(events) != 0 {
+		t.Fatalf("recent partial was flushed: %+v", events)
+	}
+
+	for _, p := range in.partials {
+		p.updated = p.updated.Add(-2 * CONTAINERS_INPUT_PARTIAL_TIMEOUT)
+	}
+	in.flushPartials(time.Now().Add(-CONTAINERS_INPUT_PARTIAL_TIMEOUT))
+
+	events := out.Events()
+	if len(events) != 1 || events[0].Message != "never finished" || events[0].Fields["pod"] != "web" {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+	if len(in.partials) != 0 {
+		t.Fatal("flushed partial wasn't removed")
+	}
+}
+
+func TestContainerPartialIsEmittedOnRemoval(t *testing.T) {
+	out := captureEvents(t)
+	path := "/var/log/pods/default_web_uid/nginx/0.log"
+	in := newTestContainersInput(t, path)
+
+	in.emitLine(path, []byte("2023-10-06T00:17:09Z stderr P panic: "))
+
+	// the log directories are empty, so the container was removed
+	in.rescan()
+
+	events := out.Events()
+	if len(events) != 1 || events[0].Message != "panic: " || events[0].Fields["container"] != "nginx" ||
+		events[0].Fields["stream"] != "stderr" {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+	if len(in.meta) != 0 || len(in.partials) != 0 {
+		t.Fatal("removed container wasn't forgotten")
+	}
+}
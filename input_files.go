@@ -0,0 +1,407 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// file input constants
+const (
+	FILES_INPUT_READ_SIZE         = 32 * 1024
+	FILES_INPUT_MAX_LINE_LEN      = 64 * 1024
+	FILES_INPUT_RETRY_INTERVAL    = time.Second
+)
+
+// files input structure which tails the files of config-files group
+type kFilesInput struct {
+	name           string
+	files          []string
+	log            kFieldLogger
+	mu             sync.Mutex
+	tails          map[string]*kFileTail
+	stop           chan struct{}
+	wg             sync.WaitGroup
+	emitLine       func(path string, line []byte) // replaces emitting an event per line
+	fromStart      bool           // files added by Reconfigure are read from beginning
+
+	kInputState
+}
+
+// tailing state of file
+type kFileTail struct {
+	offset         int64
+	info           os.FileInfo
+	partial        []byte
+	watched        bool
+}
+
+// create files input
+func NewFilesInput(cfg kFilesConfig) *kFilesInput {
+	in := &kFilesInput{
+		name:           cfg.Name,
+		log:            LogWith(kLogFields{LOG_FIELD_GROUP: cfg.Name}),
+		tails:          make(map[string]*kFileTail),
+	}
+
+	in.files = absFilePaths(cfg.Files)
+
+	return in
+}
+
+// get absolute paths of files
+func absFilePaths(files []string) []string {
+	var paths []string
+
+	for _, file := range files {
+		if path, err := filepath.Abs(file); err == nil {
+			paths = append(paths, path)
+		}
+	}
+
+	return paths
+}
+
+// create tailing state which starts from current end of file
+func newFileTail(path string) *kFileTail {
+	tail := &kFileTail{}
+	if info, err := os.Stat(path); err == nil {
+		tail.offset = info.Size()
+		tail.info = info
+	}
+
+	return tail
+}
+
+func (in *kFilesInput) Name() string {
+	return in.name
+}
+
+func (in *kFilesInput) Type() string {
+	return "files"
+}
+
+// start tailing files from their current end
+func (in *kFilesInput) Start() error {
+	in.log.Info("Starting files input '%s'", in.name)
+
+	in.mu.Lock()
+	for _, path := range in.files {
+		in.tails[path] = newFileTail(path)
+	}
+	in.mu.Unlock()
+
+	in.watchFiles()
+
+	in.stop = make(chan struct{})
+	in.wg.Add(1)
+	go in.run()
+
+	return nil
+}
+
+func (in *kFilesInput) Stop() {
+	in.log.Info("Stopping files input '%s'", in.name)
+
+	close(in.stop)
+	in.wg.Wait()
+
+	in.mu.Lock()
+	var paths []string
+	for path, tail := range in.tails {
+		if tail.watched {
+			paths = append(paths, path)
+			tail.watched = false
+		}
+	}
+	in.mu.Unlock()
+
+	// watcher lock must not be taken while holding in.mu, since the
+	// watcher holds it while waiting for events to be handled
+	for _, path := range paths {
+		kWatcher.RemoveFile(path)
+	}
+}
+
+// apply modified file list, the files which are kept stay at their offsets
+func (in *kFilesInput) Reconfigure(cfg interface{}) {
+	filesCfg, ok := cfg.(kFilesConfig)
+	if !ok {
+		return
+	}
+
+	in.log.Info("Reconfiguring files input '%s'", in.name)
+
+	paths := absFilePaths(filesCfg.Files)
+	keep := make(map[string]bool)
+	for _, path := range paths {
+		keep[path] = true
+	}
+
+	in.mu.Lock()
+	var removed []string
+	for path, tail := range in.tails {
+		if !keep[path] {
+			if tail.watched {
+				removed = append(removed, path)
+			}
+			delete(in.tails, path)
+		}
+	}
+	for _, path := range paths {
+		if _, ok := in.tails[path]; ok {
+			continue
+		}
+		if in.fromStart {
+			in.tails[path] = &kFileTail{}
+		} else {
+			in.tails[path] = newFileTail(path)
+		}
+	}
+	in.files = paths
+	in.mu.Unlock()
+
+	for _, path := range removed {
+		kWatcher.RemoveFile(path)
+	}
+	in.watchFiles()
+}
+
+// resume input and read the data written while paused
+func (in *kFilesInput) Resume() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	in.kInputState.Resume()
+	for path, tail := range in.tails {
+		if tail.watched {
+			in.readFile(path, tail)
+		}
+	}
+}
+
+// check whether the file belongs to this input
+func (in *kFilesInput) OwnsFile(path string) bool {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	_, ok := in.tails[path]
+	return ok
+}
+
+// report files which are not watched, input fails if none is watched
+func (in *kFilesInput) Health() kHealthCheck {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	var missing []string
+	for path, tail := range in.tails {
+		if !tail.watched {
+			missing = append(missing, path)
+		}
+	}
+	sort.Strings(missing)
+
+	watched := len(in.tails) - len(missing)
+	if watched == 0 {
+		return healthFail("no file is watched, missing: %s", strings.Join(missing, ", "))
+	}
+	if len(missing) > 0 {
+		return healthOK("%d of %d files watched, missing: %s", watched, len(in.tails), strings.Join(missing, ", "))
+	}
+
+	return healthOK("%d files watched", watched)
+}
+
+// add the files which are not watched yet to watcher
+func (in *kFilesInput) watchFiles() {
+	in.mu.Lock()
+	var paths []string
+	for path, tail := range in.tails {
+		if !tail.watched {
+			paths = append(paths, path)
+		}
+	}
+	in.mu.Unlock()
+
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if err := kWatcher.AddFile(path); err != nil {
+			in.log.Warn("Could not watch file '%s': %v", path, err)
+			continue
+		}
+
+		in.mu.Lock()
+		if tail, ok := in.tails[path]; ok {
+			tail.watched = true
+
+			// the file has appeared after start, so read it from beginning
+			if tail.info == nil && !in.IsPaused() {
+				in.readFile(path, tail)
+			}
+		}
+		in.mu.Unlock()
+	}
+}
+
+// retry watching files which do not exist yet or were removed
+func (in *kFilesInput) run() {
+	defer in.wg.Done()
+
+	ticker := time.NewTicker(FILES_INPUT_RETRY_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-in.stop:
+			return
+
+		case <-ticker.C:
+			in.watchFiles()
+		}
+	}
+}
+
+// handle watcher event
+func (in *kFilesInput) HandleEvent(ev Event) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	tail, ok := in.tails[ev.Path]
+	if !ok {
+		return
+	}
+
+	switch ev.Op {
+	case Remove, Rename, Move:
+		// read rest of data is impossible, wait until the file appears again
+		tail.watched = false
+		tail.info = nil
+		tail.offset = 0
+		tail.partial = nil
+
+	case Write, Create:
+		if !in.IsPaused() {
+			in.readFile(ev.Path, tail)
+		}
+	}
+}
+
+// read appended data of file and emit an event per line, in.mu must be held
+func (in *kFilesInput) readFile(path string, tail *kFileTail) {
+	f, err := os.Open(path)
+	if err != nil {
+		in.addErrors(1)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		in.addErrors(1)
+		return
+	}
+
+	// the file was replaced or truncated
+	if (tail.info != nil && !os.SameFile(tail.info, info)) || info.Size() < tail.offset {
+		in.log.Info("File '%s' was rotated or truncated, reading from beginning", path)
+		tail.offset = 0
+		tail.partial = nil
+	}
+	tail.info = info
+
+	if _, err := f.Seek(tail.offset, io.SeekStart); err != nil {
+		in.addErrors(1)
+		return
+	}
+
+	buf := make([]byte, FILES_INPUT_READ_SIZE)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			tail.offset += int64(n)
+			in.addBytes(n)
+			in.emitLines(path, tail, buf[:n])
+		}
+		if err != nil {
+			if err != io.EOF {
+				in.addErrors(1)
+			}
+			return
+		}
+	}
+}
+
+// split data into lines, the incomplete last line is kept for next read
+func (in *kFilesInput) emitLines(path string, tail *kFileTail, data []byte) {
+	for {
+		idx := bytes.IndexByte(data, '\n')
+		if idx < 0 {
+			break
+		}
+
+		line := data[:idx]
+		if len(tail.partial) > 0 {
+			line = append(tail.partial, line...)
+			tail.partial = nil
+		}
+		in.emit(path, line)
+
+		data = data[idx + 1:]
+	}
+
+	if len(data) > 0 {
+		tail.partial = append(tail.partial, data...)
+		if len(tail.partial) >= FILES_INPUT_MAX_LINE_LEN {
+			in.emit(path, tail.partial)
+			tail.partial = nil
+		}
+	}
+}
+
+func (in *kFilesInput) emit(path string, line []byte) {
+	if in.emitLine != nil {
+		in.emitLine(path, line)
+		return
+	}
+
+	line = bytes.TrimRight(line, "\r")
+	if len(line) == 0 {
+		return
+	}
+
+	in.addEvents(1)
+	EmitEvent(NewKaohiEvent(in.name, path, string(line)))
+}
@@ -0,0 +1,412 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// journal input constants
+const (
+	JOURNAL_INPUT_RESTART_INTERVAL = 5 * time.Second
+	JOURNAL_INPUT_SAVE_INTERVAL   = time.Second
+	JOURNAL_INPUT_PAUSE_INTERVAL  = 100 * time.Millisecond
+	JOURNAL_INPUT_MAX_FIELD_LEN   = 1024 * 1024
+	JOURNAL_INPUT_SOURCE          = "journal"
+)
+
+var errJournalInvalidField = errors.New("journal field has invalid size")
+
+// journal input structure which reads entries from journalctl in export
+// format, the cursor of the last entry is saved so restarts resume after it
+type kJournalInput struct {
+	name           string
+	log            kFieldLogger
+	journalctl     string
+	units          []string
+	matches        []string
+	cursorFile     string
+	mu             sync.Mutex
+	cursor         string
+	saved          string
+	running        int32
+	lastErr        error
+	stop           chan struct{}
+	wg             sync.WaitGroup
+
+	kInputState
+}
+
+// create journal input
+func NewJournalInput(cfg kJournalConfig) *kJournalInput {
+	cfg = journalConfigDefaults(cfg)
+
+	return &kJournalInput{
+		name:           cfg.Name,
+		log:            LogWith(kLogFields{LOG_FIELD_GROUP: cfg.Name}),
+		journalctl:     cfg.Journalctl,
+		units:          cfg.Units,
+		matches:        cfg.Matches,
+		cursorFile:     cfg.CursorFile,
+	}
+}
+
+// set default journalctl and cursor file
+func journalConfigDefaults(cfg kJournalConfig) kJournalConfig {
+	if cfg.Journalctl == "" {
+		cfg.Journalctl = KAOHI_DEFAULT_JOURNALCTL
+	}
+	if cfg.CursorFile == "" {
+		cfg.CursorFile = filepath.Join(KAOHI_DEFAULT_STATE_DIR, "journal-" + cfg.Name + ".cursor")
+	}
+
+	return cfg
+}
+
+func (in *kJournalInput) Name() string {
+	return in.name
+}
+
+func (in *kJournalInput) Type() string {
+	return "journal"
+}
+
+// start reading journal after saved cursor, or from its end if there's none
+func (in *kJournalInput) Start() error {
+	in.log.Info("Starting journal input '%s'", in.name)
+
+	if err := os.MkdirAll(filepath.Dir(in.cursorFile), 0755); err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(in.cursorFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	in.cursor = strings.TrimSpace(string(data))
+	in.saved = in.cursor
+
+	in.stop = make(chan struct{})
+	in.wg.Add(2)
+	go in.run()
+	go in.checkpoint()
+
+	return nil
+}
+
+// stop journalctl and save cursor of the last read entry
+func (in *kJournalInput) Stop() {
+	in.log.Info("Stopping journal input '%s'", in.name)
+
+	close(in.stop)
+	in.wg.Wait()
+
+	in.saveCursor()
+}
+
+// input fails if journalctl isn't running
+func (in *kJournalInput) Health() kHealthCheck {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	if atomic.LoadInt32(&in.running) == 0 {
+		if in.lastErr != nil {
+			return healthFail("journalctl isn't running: %v", in.lastErr)
+		}
+		return healthFail("journalctl isn't running")
+	}
+
+	return healthOK("reading after cursor %s", in.cursor)
+}
+
+// arguments of journalctl
+func (in *kJournalInput) args(cursor string) []string {
+	args := []string{"--output=export", "--follow", "--no-pager"}
+	if cursor != "" {
+		args = append(args, "--after-cursor=" + cursor)
+	} else {
+		args = append(args, "--lines=0")
+	}
+
+	// matches of different fields are ANDed, of the same field ORed
+	for _, unit := range in.units {
+		args = append(args, "_SYSTEMD_UNIT=" + unit)
+	}
+	args = append(args, in.matches...)
+
+	return args
+}
+
+// run journalctl and restart it if it exits
+func (in *kJournalInput) run() {
+	defer in.wg.Done()
+
+	for {
+		in.mu.Lock()
+		cursor := in.cursor
+		in.mu.Unlock()
+
+		err := in.follow(cursor)
+
+		select {
+		case <-in.stop:
+			return
+		default:
+		}
+
+		in.log.Warn("journalctl of group '%s' exited, restarting in %s: %v", in.name, JOURNAL_INPUT_RESTART_INTERVAL, err)
+		in.addErrors(1)
+
+		select {
+		case <-in.stop:
+			return
+		case <-time.After(JOURNAL_INPUT_RESTART_INTERVAL):
+		}
+	}
+}
+
+// run journalctl once and emit its entries until it exits or input stops
+func (in *kJournalInput) follow(cursor string) error {
+	cmd := exec.Command(in.journalctl, in.args(cursor)...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		in.setRunning(false, err)
+		return err
+	}
+	in.setRunning(true, nil)
+
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-in.stop:
+			cmd.Process.Kill()
+		case <-exited:
+		}
+	}()
+
+	err = in.readEntries(stdout)
+	if err != nil {
+		// journalctl follows forever, so it's killed and restarted from cursor
+		cmd.Process.Kill()
+	}
+
+	werr := cmd.Wait()
+	close(exited)
+
+	if werr != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			werr = errors.New(msg)
+		}
+		err = werr
+	}
+	if err == nil {
+		err = io.EOF
+	}
+	in.setRunning(false, err)
+
+	return err
+}
+
+func (in *kJournalInput) setRunning(running bool, err error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	if running {
+		atomic.StoreInt32(&in.running, 1)
+	} else {
+		atomic.StoreInt32(&in.running, 0)
+	}
+	in.lastErr = err
+}
+
+// read entries of export format, reading is suspended while input is paused
+// so that no entry is lost
+func (in *kJournalInput) readEntries(r io.Reader) error {
+	br := bufio.NewReaderSize(r, FILES_INPUT_READ_SIZE)
+
+	for {
+		for in.IsPaused() {
+			select {
+			case <-in.stop:
+				return nil
+			case <-time.After(JOURNAL_INPUT_PAUSE_INTERVAL):
+			}
+		}
+
+		fields, n, err := readJournalEntry(br)
+		in.addBytes(n)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if len(fields) > 0 {
+			in.emit(fields)
+		}
+	}
+}
+
+// read an entry of journal export format, fields are "NAME=value" lines or
+// "NAME" followed by 64-bit little endian size and binary value, and an
+// entry ends with empty line; binary values which are too large are skipped
+func readJournalEntry(br *bufio.Reader) (map[string]string, int, error) {
+	fields := make(map[string]string)
+	n := 0
+
+	for {
+		line, err := br.ReadString('\n')
+		n += len(line)
+		if err != nil {
+			if err == io.EOF && len(fields) > 0 {
+				return fields, n, nil
+			}
+			return nil, n, err
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return fields, n, nil
+		}
+
+		if i := strings.IndexByte(line, '='); i >= 0 {
+			fields[line[:i]] = line[i + 1:]
+			continue
+		}
+
+		var size uint64
+		if err := binary.Read(br, binary.LittleEndian, &size); err != nil {
+			return nil, n, err
+		}
+		if size > math.MaxInt32 {
+			return nil, n, errJournalInvalidField
+		}
+		if size > JOURNAL_INPUT_MAX_FIELD_LEN {
+			skipped, err := io.CopyN(ioutil.Discard, br, int64(size) + 1)
+			n += 8 + int(skipped)
+			if err != nil {
+				return nil, n, err
+			}
+			continue
+		}
+
+		value := make([]byte, size + 1)
+		if _, err := io.ReadFull(br, value); err != nil {
+			return nil, n, err
+		}
+		n += 8 + len(value)
+		fields[line] = string(value[:size])
+	}
+}
+
+// emit entry as event, all fields but MESSAGE are kept as structured fields
+func (in *kJournalInput) emit(fields map[string]string) {
+	ev := NewKaohiEvent(in.name, JOURNAL_INPUT_SOURCE, fields["MESSAGE"])
+	if usec, err := strconv.ParseInt(fields["__REALTIME_TIMESTAMP"], 10, 64); err == nil {
+		ev.Time = time.Unix(0, usec * int64(time.Microsecond))
+	}
+	if unit := fields["_SYSTEMD_UNIT"]; unit != "" {
+		ev.Source = unit
+	}
+
+	for name, value := range fields {
+		if name != "MESSAGE" {
+			ev.SetField(name, value)
+		}
+	}
+
+	in.addEvents(1)
+	EmitEvent(ev)
+
+	if cursor := fields["__CURSOR"]; cursor != "" {
+		in.mu.Lock()
+		in.cursor = cursor
+		in.mu.Unlock()
+	}
+}
+
+// save cursor periodically
+func (in *kJournalInput) checkpoint() {
+	defer in.wg.Done()
+
+	ticker := time.NewTicker(JOURNAL_INPUT_SAVE_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-in.stop:
+			return
+
+		case <-ticker.C:
+			in.saveCursor()
+		}
+	}
+}
+
+// write cursor to temporary file and rename it over cursor file, so the
+// cursor file is never partially written
+func (in *kJournalInput) saveCursor() {
+	in.mu.Lock()
+	cursor := in.cursor
+	in.mu.Unlock()
+
+	if cursor == "" || cursor == in.saved {
+		return
+	}
+
+	tmp := in.cursorFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(cursor + "\n"), 0600); err != nil {
+		in.log.Err("Could not save journal cursor to '%s': %v", in.cursorFile, err)
+		return
+	}
+	if err := os.Rename(tmp, in.cursorFile); err != nil {
+		in.log.Err("Could not save journal cursor to '%s': %v", in.cursorFile, err)
+		return
+	}
+
+	in.saved = cursor
+}
@@ -0,0 +1,177 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// entries of journalctl --output=export
+const kTestJournalExport = `__CURSOR=s=739ad463348b4ceca5a9e69c95a3c93f;i=4ece7;b=6c7c6013a8ad48c8a0fe2ebd6dbe7bd5;m=9e6c4a3b;t=4e43fd6c3d8a2;x=f81d6d6bd3b1a7e8
+__REALTIME_TIMESTAMP=1379409839576226
+__MONOTONIC_TIMESTAMP=2658945595
+_BOOT_ID=6c7c6013a8ad48c8a0fe2ebd6dbe7bd5
+PRIORITY=6
+_PID=1
+_UID=0
+_COMM=systemd
+_SYSTEMD_UNIT=init.scope
+_HOSTNAME=node1
+MESSAGE=Started Session 2 of user root.
+
+__CURSOR=s=739ad463348b4ceca5a9e69c95a3c93f;i=4ece8;b=6c7c6013a8ad48c8a0fe2ebd6dbe7bd5;m=9e6c5a1c;t=4e43fd6c4d883;x=3b4b36e2ac04a2d7
+__REALTIME_TIMESTAMP=1379409839641731
+PRIORITY=3
+_SYSTEMD_UNIT=sshd.service
+MESSAGE=error: PAM: Authentication failure for root
+
+`
+
+// binary field of export format
+func journalBinaryField(name string, value []byte) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString(name + "\n")
+	binary.Write(&buf, binary.LittleEndian, uint64(len(value)))
+	buf.Write(value)
+	buf.WriteByte('\n')
+
+	return buf.Bytes()
+}
+
+func TestReadJournalEntry(t *testing.T) {
+	br := bufio.NewReader(strings.NewReader(kTestJournalExport))
+
+	fields, n, err := readJournalEntry(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields["MESSAGE"] != "Started Session 2 of user root." || fields["_SYSTEMD_UNIT"] != "init.scope" ||
+		fields["__REALTIME_TIMESTAMP"] != "1379409839576226" || len(fields) != 11 {
+		t.Fatalf("unexpected fields: %v", fields)
+	}
+	if n != strings.Index(kTestJournalExport, "\n\n") + 2 {
+		t.Fatalf("%d bytes read", n)
+	}
+
+	fields, _, err = readJournalEntry(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields["MESSAGE"] != "error: PAM: Authentication failure for root" || fields["PRIORITY"] != "3" {
+		t.Fatalf("unexpected fields: %v", fields)
+	}
+
+	if _, _, err = readJournalEntry(br); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestReadJournalEntryBinaryField(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("__CURSOR=s=1;i=2\n")
+	buf.Write(journalBinaryField("MESSAGE", []byte("line one\nline two\x00")))
+	buf.WriteString("PRIORITY=4\n\n")
+
+	fields, n, err := readJournalEntry(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields["MESSAGE"] != "line one\nline two\x00" || fields["PRIORITY"] != "4" {
+		t.Fatalf("unexpected fields: %q", fields)
+	}
+	if n != 17 + 8 + 8 + 18 + 1 + 11 + 1 {
+		t.Fatalf("%d bytes read", n)
+	}
+}
+
+func TestReadJournalEntrySkipsOversizedField(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("__CURSOR=s=1;i=3\n")
+	buf.Write(journalBinaryField("COREDUMP", bytes.Repeat([]byte{0xff}, JOURNAL_INPUT_MAX_FIELD_LEN + 1)))
+	buf.WriteString("MESSAGE=Process 1234 (app) dumped core.\n\n")
+	buf.WriteString("__CURSOR=s=1;i=4\nMESSAGE=next entry\n\n")
+
+	br := bufio.NewReader(&buf)
+	fields, _, err := readJournalEntry(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fields["COREDUMP"]; ok || fields["MESSAGE"] != "Process 1234 (app) dumped core." {
+		t.Fatalf("unexpected fields: %d %q", len(fields["COREDUMP"]), fields["MESSAGE"])
+	}
+
+	// the stream is still in sync after the skipped field
+	fields, _, err = readJournalEntry(br)
+	if err != nil || fields["MESSAGE"] != "next entry" {
+		t.Fatalf("unexpected next entry: %v %v", fields, err)
+	}
+}
+
+func TestReadJournalEntryTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("__CURSOR=s=1;i=5\nMESSAGE\n")
+	binary.Write(&buf, binary.LittleEndian, uint64(100))
+	buf.WriteString("short")
+
+	if _, _, err := readJournalEntry(bufio.NewReader(&buf)); err == nil {
+		t.Fatal("truncated entry was read")
+	}
+}
+
+func TestJournalEmit(t *testing.T) {
+	out := captureEvents(t)
+	in := NewJournalInput(kJournalConfig{Name: "journal", CursorFile: t.TempDir() + "/cursor"})
+
+	br := bufio.NewReader(strings.NewReader(kTestJournalExport))
+	fields, _, err := readJournalEntry(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in.emit(fields)
+
+	events := out.Events()
+	if len(events) != 1 {
+		t.Fatalf("%d events", len(events))
+	}
+	ev := events[0]
+	if ev.Message != "Started Session 2 of user root." || ev.Source != "init.scope" || ev.Group != "journal" ||
+		!ev.Time.Equal(time.Unix(0, 1379409839576226 * int64(time.Microsecond))) {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+	if _, ok := ev.Fields["MESSAGE"]; ok || ev.Fields["_PID"] != "1" || ev.Fields["PRIORITY"] != "6" {
+		t.Fatalf("unexpected fields: %v", ev.Fields)
+	}
+	if in.cursor != fields["__CURSOR"] {
+		t.Fatalf("cursor %q wasn't updated", in.cursor)
+	}
+}
@@ -0,0 +1,218 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// source and group of events which are emitted by kaohi itself
+const (
+	KAOHI_INTERNAL_SOURCE = "kaohi.internal"
+	KAOHI_INTERNAL_GROUP  = "kaohi"
+)
+
+// emitter of kaohi's own warnings and errors as events, so they are
+// delivered to the outputs like any other event
+type kInternalEvents struct {
+	level          int32 // highest log level which is emitted, -1 if disabled
+	queue          chan *kEvent
+	dropped        uint64
+	suppressed     uint64
+	limitMu        sync.Mutex
+	limits         map[string]*kInternalLimit
+	stop           chan struct{}
+	wg             sync.WaitGroup
+}
+
+// events emitted by a caller in the current interval
+type kInternalLimit struct {
+	start          time.Time
+	count          int
+}
+
+var kInternal = &kInternalEvents{level: -1, limits: make(map[string]*kInternalLimit)}
+
+// check whether log messages of level are emitted as events
+func internalEventsEnabled(level int) bool {
+	return int32(level) <= atomic.LoadInt32(&kInternal.level)
+}
+
+// check whether caller may emit another event in its interval, an output
+// which fails to deliver internal events logs a warning for each of them,
+// so events of a caller are limited to break the loop
+func (ie *kInternalEvents) allow(caller string, now time.Time) bool {
+	ie.limitMu.Lock()
+	defer ie.limitMu.Unlock()
+
+	limit := ie.limits[caller]
+	if limit == nil || now.Sub(limit.start) >= KAOHI_INTERNAL_CALLER_INTERVAL {
+		// forget callers whose interval is over
+		for c, l := range ie.limits {
+			if now.Sub(l.start) >= KAOHI_INTERNAL_CALLER_INTERVAL {
+				delete(ie.limits, c)
+			}
+		}
+		limit = &kInternalLimit{start: now}
+		ie.limits[caller] = limit
+	}
+
+	if limit.count >= KAOHI_INTERNAL_CALLER_LIMIT {
+		return false
+	}
+	limit.count++
+
+	return true
+}
+
+// queue log message as event, it never blocks so that logging callers
+// including outputs can't be stalled by the pipeline
+func emitInternalEvent(level int, fields kLogFields, msg string, info *callerInfo, tt time.Time) {
+	caller := info.fileName + ":" + strconv.Itoa(info.line)
+	if !kInternal.allow(caller, tt) {
+		atomic.AddUint64(&kInternal.suppressed, 1)
+		return
+	}
+
+	ev := NewKaohiEvent(KAOHI_INTERNAL_GROUP, KAOHI_INTERNAL_SOURCE, msg)
+	ev.Time = tt
+	ev.SetField("level", kLogLevelNames[level])
+	ev.SetField(LOG_FIELD_COMPONENT, strings.TrimSuffix(info.fileName, ".go"))
+	ev.SetField("caller", caller)
+	for key, value := range fields {
+		// group is builtin field of event
+		if key == LOG_FIELD_GROUP {
+			key = "input_group"
+		}
+		ev.SetField(key, value)
+	}
+
+	select {
+	case kInternal.queue <- ev:
+	default:
+		atomic.AddUint64(&kInternal.dropped, 1)
+	}
+}
+
+// set which log messages are emitted as events
+func ConfigureInternalEvents(cfg kInternalEventsConfig) {
+	level := int32(-1)
+	if cfg.Enabled {
+		level = LOG_LEVEL_WARN
+		if cfg.Level == kLogLevelNames[LOG_LEVEL_ERR] {
+			level = LOG_LEVEL_ERR
+		}
+	}
+
+	atomic.StoreInt32(&kInternal.level, level)
+}
+
+// send queued events to outputs and report dropped events periodically
+func (ie *kInternalEvents) run() {
+	defer ie.wg.Done()
+
+	ticker := time.NewTicker(KAOHI_INTERNAL_DROP_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	dropped := make(map[kOutput]uint64)
+	var internalDropped, internalSuppressed uint64
+
+	for {
+		select {
+		case ev := <-ie.queue:
+			EmitEvent(ev)
+
+		case <-ticker.C:
+			dropped = reportDroppedEvents(dropped)
+
+			if n := atomic.LoadUint64(&ie.dropped); n > internalDropped {
+				DEBUG_WARN("Dropped %d internal event(s) as queue was full", n - internalDropped)
+				internalDropped = n
+			}
+			if n := atomic.LoadUint64(&ie.suppressed); n > internalSuppressed {
+				DEBUG_WARN("Suppressed %d internal event(s) of messages which repeated more than %d times a minute",
+					n - internalSuppressed, KAOHI_INTERNAL_CALLER_LIMIT)
+				internalSuppressed = n
+			}
+
+		case <-ie.stop:
+			for {
+				select {
+				case ev := <-ie.queue:
+					EmitEvent(ev)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// warn about events which were dropped by outputs since last check and
+// return current counts
+func reportDroppedEvents(prev map[kOutput]uint64) map[kOutput]uint64 {
+	counts := make(map[kOutput]uint64)
+
+	for _, out := range GetOutputs() {
+		stats := out.Stats()
+		if n := stats.Dropped - prev[out]; n > 0 {
+			LogWith(kLogFields{"output": out.Name(), "dropped": strconv.FormatUint(n, 10)}).Warn(
+				"Output '%s' dropped %d event(s) as its queue was full", out.Name(), n)
+		}
+		counts[out] = stats.Dropped
+	}
+
+	return counts
+}
+
+// init emitter of internal events
+func InitInternalEvents(ctx *kContext) {
+	DEBUG_INFO("Initializing internal events")
+
+	kInternal.queue = make(chan *kEvent, KAOHI_DEFAULT_INTERNAL_QUEUE_SIZE)
+	kInternal.stop = make(chan struct{})
+	ConfigureInternalEvents(ctx.config.GetInternalEvents())
+
+	kInternal.wg.Add(1)
+	go kInternal.run()
+}
+
+// finalize emitter of internal events, queued events are passed to outputs
+func FinalizeInternalEvents() {
+	DEBUG_INFO("Finalizing internal events")
+
+	if kInternal.stop == nil {
+		return
+	}
+
+	atomic.StoreInt32(&kInternal.level, -1)
+	close(kInternal.stop)
+	kInternal.wg.Wait()
+}
@@ -27,21 +27,30 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 )
 
 // kaohi context structure
 type kContext struct {
-	config *kConfigScheme
-	logger *kLogger
+	config     *kConfigScheme
+	configPath string
+	startTime  time.Time
+	mu         sync.Mutex
+
+	shuttingDown bool
 }
 
 func NewKaohiContext() *kContext {
 	return &kContext {
 		config:             NewKaohiConfig(),
-		logger:             nil,
+		configPath:         KAOHI_DEFAULT_CONFIG_FILE,
+		startTime:          time.Now(),
 	}
 }
 
@@ -55,14 +64,23 @@ func (ctx *kContext) Init() error {
 	var err error
 
 	// init logging
-	if err = InitLogger(ctx.config.GetLogDir(), ctx.config.GetLogLevel()); err != nil {
+	if err = InitLogger(ctx.config.GetLogDir(), ctx.config.GetLogLevel(), ctx.config.GetLogFormat(),
+		ctx.config.GetLogMaxSize(), ctx.config.GetLogMaxFiles()); err != nil {
 		return err
 	}
 
 	DEBUG_INFO("Initializing Kaohi context")
 
-	// init command listener
-	if err = InitCmdListener(ctx); err != nil {
+	// init outputs
+	if err = InitKaohiOutputs(ctx); err != nil {
+		return err
+	}
+
+	// init internal events
+	InitInternalEvents(ctx)
+
+	// init metrics
+	if err = InitMetrics(ctx); err != nil {
 		return err
 	}
 
@@ -71,30 +89,259 @@ func (ctx *kContext) Init() error {
 		return err
 	}
 
+	// init inputs
+	if err = InitKaohiInputs(ctx); err != nil {
+		return err
+	}
+
+	// init command listener
+	if err = InitCmdListener(ctx); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// error of configuration which could not be parsed
+type kConfigInvalidError struct {
+	err error
+}
+
+func (e *kConfigInvalidError) Error() string {
+	return ErrConfigInvalid.Error() + ": " + e.err.Error()
+}
+
+// reconcile running state with configuration, unchanged inputs and outputs
+// keep running with their offsets and queues, previous state is restored
+// if it fails
+func (ctx *kContext) switchConfig(config *kConfigScheme) error {
+	old := ctx.config
+
+	outputs, err := reconcileOutputs(old, config)
+	if err != nil {
+		return err
+	}
+	prevOutputs := swapOutputs(outputs)
+
+	if err := reconcileInputs(old, config); err != nil {
+		swapOutputs(prevOutputs)
+		retireOutputs(outputsNotIn(outputs, prevOutputs))
+		return err
+	}
+
+	// rebind command listener only if its configuration was changed
+	if cmdListenerChanged(old, config) {
+		if err := RebindCmdListener(ctx, old, config); err != nil {
+			if rerr := reconcileInputs(config, old); rerr != nil {
+				DEBUG_ERR("Could not restore inputs: %v", rerr)
+			}
+			swapOutputs(prevOutputs)
+			retireOutputs(outputsNotIn(outputs, prevOutputs))
+			return err
+		}
+	} else if !cmdListenerListening() {
+		// the previous rebind couldn't restore the listener
+		if err := RebindCmdListener(ctx, old, config); err != nil {
+			DEBUG_ERR("Could not bind command listener: %v", err)
+		}
+	}
+	retireOutputs(outputsNotIn(prevOutputs, outputs))
+
+	// level which was changed at runtime is kept unless configuration changes it
+	if old.GetLogLevel() != config.GetLogLevel() {
+		SetLogLevel(config.GetLogLevel())
+	}
+	ReconfigureMetrics(old, config)
+	if old.GetInternalEvents() != config.GetInternalEvents() {
+		ConfigureInternalEvents(config.GetInternalEvents())
+	}
+	if old.GetLogFormat() != config.GetLogFormat() {
+		SetLogFormat(config.GetLogFormat())
+	}
+	if old.GetLogDir() != config.GetLogDir() || old.GetLogMaxSize() != config.GetLogMaxSize() ||
+		old.GetLogMaxFiles() != config.GetLogMaxFiles() {
+		if err := SetLogFile(config.GetLogDir(), config.GetLogMaxSize(), config.GetLogMaxFiles()); err != nil {
+			DEBUG_ERR("Could not open log file in '%s': %v", config.GetLogDir(), err)
+		}
+	}
+
+	ctx.config = config
+
 	return nil
 }
 
-// finalize kaohi context
-func (ctx *kContext) Finalize() {
+// reload configuration file and reconcile running state with it
+func (ctx *kContext) ReloadConfig() error {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if ctx.shuttingDown {
+		return ErrShuttingDown
+	}
+
+	DEBUG_INFO("Reloading configuration file '%s'", ctx.configPath)
+
+	config := NewKaohiConfig()
+	if err := config.ParseConfigFile(ctx.configPath); err != nil {
+		return err
+	}
+	if err := config.Validate(); err != nil {
+		return &kConfigInvalidError{err}
+	}
+
+	// capabilities were dropped at startup, so new needs can't be met
+	if _, err := checkPrivileges(config); err != nil {
+		return err
+	}
+
+	return ctx.switchConfig(config)
+}
+
+// validate configuration and apply it, the configuration file is replaced
+// only after inputs and outputs were switched to it
+func (ctx *kContext) ApplyConfig(content []byte, dryRun bool) ([]kCmdConfigChange, error) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if ctx.shuttingDown {
+		return nil, ErrShuttingDown
+	}
+
+	// write to temporary file next to configuration file, so it can be renamed over it
+	tmp, err := ioutil.TempFile(filepath.Dir(ctx.configPath), ".kaohi.conf.")
+	if err != nil {
+		return nil, ErrConfigSaveFailed
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(content)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, ErrConfigSaveFailed
+	}
+
+	config := NewKaohiConfig()
+	if err := config.ParseConfigFile(tmp.Name()); err != nil {
+		return nil, &kConfigInvalidError{err}
+	}
+	if err := config.Validate(); err != nil {
+		return nil, &kConfigInvalidError{err}
+	}
+	if _, err := checkPrivileges(config); err != nil {
+		return nil, err
+	}
+
+	changes := diffConfigs(ctx.config, config)
+	if dryRun {
+		return changes, nil
+	}
+
+	DEBUG_INFO("Applying configuration with %d change(s)", len(changes))
+
+	old := ctx.config
+	if err := ctx.switchConfig(config); err != nil {
+		return nil, err
+	}
+
+	// save as last known-good configuration, roll back if it can't be saved
+	if fi, err := os.Stat(ctx.configPath); err == nil {
+		os.Chmod(tmp.Name(), fi.Mode())
+	}
+	if err := os.Rename(tmp.Name(), ctx.configPath); err != nil {
+		DEBUG_ERR("Could not save configuration file '%s': %v", ctx.configPath, err)
+		if rerr := ctx.switchConfig(old); rerr != nil {
+			DEBUG_ERR("Could not roll back configuration: %v", rerr)
+		}
+		return nil, ErrConfigSaveFailed
+	}
+	config.SetPath(ctx.configPath)
+
+	return changes, nil
+}
+
+// finalize kaohi context, inputs are stopped first and outputs are drained
+// until shutdown deadline, returns false if some events were not delivered
+func (ctx *kContext) Finalize() bool {
 	DEBUG_INFO("Finalizing Kaohi context")
 
+	// refuse reloading from now on
+	ctx.mu.Lock()
+	ctx.shuttingDown = true
+	deadline := time.Now().Add(ctx.config.GetShutdownTimeout())
+	ctx.mu.Unlock()
+
+	// finalize inputs
+	FinalizeKaohiInputs()
+
 	// finalize kaohi watcher
 	FinalizeKaohiWatcher()
 
 	// finalize command listener
 	FinalizeCmdListener()
+
+	// finalize metrics
+	FinalizeMetrics()
+
+	// finalize internal events
+	FinalizeInternalEvents()
+
+	// drain and finalize outputs
+	delivered := FinalizeKaohiOutputs(deadline)
+	if delivered {
+		DEBUG_INFO("All events were delivered")
+	}
+
+	// stop pinging systemd watchdog
+	FinalizeNotify()
+
+	// finalize logging
+	FinalizeLogger()
+
+	return delivered
+}
+
+// exit immediately when a signal is received during shutdown
+func forceExitOnSignal() {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-interrupt
+		DEBUG_WARN("Second signal has occurred, exiting without draining")
+		os.Exit(KAOHI_EXIT_FORCED)
+	}()
 }
 
-// loop until interupt has occurre
-func WaitForSignal() {
+// loop until interupt has occurre, configuration is reloaded on SIGHUP
+func WaitForSignal(ctx *kContext) {
 	// create signal channel
 	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt, os.Kill, syscall.SIGTERM)
+	signal.Notify(interrupt, os.Interrupt, os.Kill, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
 
 	// wait until TERM signal has received
 	for {
 		select {
 		case killSignal := <-interrupt:
+			if killSignal == syscall.SIGHUP {
+				DEBUG_INFO("Hangup signal has occurred, reloading configuration")
+				NotifyReloading()
+				if err := ctx.ReloadConfig(); err != nil {
+					DEBUG_ERR("Could not reload configuration: %v", err)
+				}
+				NotifyReloaded()
+				continue
+			}
+
+			if killSignal == syscall.SIGUSR1 {
+				if err := ReopenLogFile(); err != nil {
+					DEBUG_ERR("Could not reopen log file: %v", err)
+				}
+				DEBUG_INFO("Log file was reopened")
+				continue
+			}
+
 			if killSignal == os.Interrupt {
 				DEBUG_INFO("Interrupt has occurred by system signal")
 				return
@@ -106,34 +353,101 @@ func WaitForSignal() {
 	}
 }
 
+// print problems of configuration one per line
+func printConfigErrors(err error) {
+	if errs, ok := err.(kConfigErrors); ok {
+		for _, e := range errs {
+			fmt.Fprintln(os.Stderr, e)
+		}
+		return
+	}
+	fmt.Fprintln(os.Stderr, err)
+}
+
+// parse and validate configuration, returns exit status
+func checkConfig(ctx *kContext) int {
+	if err := ctx.config.ParseConfigFile(ctx.configPath); err != nil {
+		if _, ok := err.(*kConfigError); !ok {
+			err = &kConfigError{File: ctx.configPath, Err: err}
+		}
+		fmt.Fprintln(os.Stderr, err)
+		return KAOHI_EXIT_FAILURE
+	}
+
+	if err := ctx.config.Validate(); err != nil {
+		printConfigErrors(err)
+		return KAOHI_EXIT_FAILURE
+	}
+
+	fmt.Printf("%s: configuration is valid\n", ctx.configPath)
+	for _, include := range ctx.config.GetIncludes() {
+		fmt.Printf("%s: configuration is valid\n", include)
+	}
+
+	return KAOHI_EXIT_OK
+}
+
 // main function
 func main() {
 	var err error
 
 	// create new context
 	ctx := NewKaohiContext()
+	ctx.configPath = GetConfigPath(os.Args[1:])
 
-	// check sudo privilege
-	if ok, err := checkPrivileges(); !ok {
-		fmt.Println(err)
-		os.Exit(1)
+	// manage systemd service
+	if IsServiceCommand(os.Args[1:]) {
+		os.Exit(runServiceCommand(os.Args[1:]))
+	}
+
+	// only validate configuration without starting anything
+	if IsCheckConfig(os.Args[1:]) {
+		os.Exit(checkConfig(ctx))
 	}
 
 	// parse configuration file
-	if err = ctx.config.ParseConfig(KAOHI_DEFAULT_CONFIG_FILE); err != nil {
+	if err = ctx.config.ParseConfig(ctx.configPath); err != nil {
+		fmt.Println(err)
+		os.Exit(KAOHI_EXIT_FAILURE)
+	}
+	if err = ctx.config.Validate(); err != nil {
+		printConfigErrors(err)
+		os.Exit(KAOHI_EXIT_FAILURE)
+	}
+
+	// check capabilities which configuration needs
+	keepCaps, err := checkPrivileges(ctx.config)
+	if err != nil {
 		fmt.Println(err)
-		os.Exit(1)
+		os.Exit(KAOHI_EXIT_FAILURE)
+	}
+
+	// root keeps reading files, so files added by reload can still be tailed
+	if os.Geteuid() == 0 {
+		keepCaps.Add(CAP_DAC_READ_SEARCH)
 	}
 
 	// init context
 	if err := ctx.Init(); err != nil {
 		fmt.Println(err)
-		os.Exit(1)
+		os.Exit(KAOHI_EXIT_FAILURE)
 	}
 
+	// drop capabilities which aren't needed after startup
+	if err := dropCapabilities(keepCaps); err != nil {
+		DEBUG_WARN("Could not drop capabilities: %v", err)
+	} else {
+		DEBUG_INFO("Kept capabilities: %s", keepCaps)
+	}
+	NotifyReady()
+
 	// main loop
-	WaitForSignal()
+	WaitForSignal(ctx)
 
 	// finalize context
-	ctx.Finalize()
+	forceExitOnSignal()
+	NotifyStopping()
+	if !ctx.Finalize() {
+		os.Exit(KAOHI_EXIT_UNDELIVERED)
+	}
 }
@@ -1,12 +1,694 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
 
 package main
 
-import "fmt"
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
 
+// console options
 type Options struct {
-	
+	Address        string
+	JSON           bool
+	Timeout        time.Duration
+
+	TLSCAFile      string
+	TLSCertFile    string
+	TLSKeyFile     string
+	TLSServerName  string
+}
+
+// console client structure
+type kConsoleClient struct {
+	conn           net.Conn
+	codec          kCmdCodec
+	stream         *CmdStream
+	packets        chan *CmdPacket
+	readErr        error
+	nextID         uint32
+	timeout        time.Duration
+}
+
+// console subcommand
+type kConsoleCmd struct {
+	usage          string
+	description    string
+	run            func(c *kConsoleClient, opts *Options, args []string) error
+}
+
+var consoleCmds = map[string]*kConsoleCmd{
+	"status":      {"status", "Show daemon status", runStatus},
+	"inputs":      {"inputs", "List inputs", runInputs},
+	"outputs":     {"outputs", "List outputs", runOutputs},
+	"pause":       {"pause <input>", "Pause input", runPause},
+	"resume":      {"resume <input>", "Resume input", runResume},
+	"reload":      {"reload", "Reload configuration file", runReload},
+	"log-level":   {"log-level <0-3 | error | warn | info | debug>", "Change log level of daemon", runLogLevel},
+	"flush":       {"flush [timeout]", "Flush outputs", runFlush},
+	"stats":       {"stats", "Show event statistics", runStats},
+	"config":      {"config show | config apply [--dry-run] <file>", "Show or apply configuration file", runConfig},
+	"tail":        {"tail [--group group] [--source source] [--match regexp]", "Stream events live", runTail},
+}
+
+var consoleCmdOrder = []string{"status", "inputs", "outputs", "pause", "resume", "reload", "log-level", "flush", "stats", "config", "tail"}
+
+// create client side TLS configuration from options
+func newConsoleTLSConfig(opts *Options) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:     opts.TLSServerName,
+	}
+
+	if opts.TLSCAFile != "" {
+		pem, err := ioutil.ReadFile(opts.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, ErrInvalidCACert
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if opts.TLSCertFile != "" || opts.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.TLSCertFile, opts.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if tlsConfig.ServerName == "" {
+		if host, _, err := net.SplitHostPort(opts.Address); err == nil {
+			tlsConfig.ServerName = host
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// connect to command listener of daemon, the address is IP:port or path of unix socket
+func DialConsole(opts *Options) (*kConsoleClient, error) {
+	var conn net.Conn
+	var err error
+
+	if strings.HasPrefix(opts.Address, "unix:") || strings.HasPrefix(opts.Address, "/") {
+		conn, err = net.DialTimeout("unix", strings.TrimPrefix(opts.Address, "unix:"), opts.Timeout)
+	} else if opts.TLSCAFile != "" || opts.TLSCertFile != "" {
+		var tlsConfig *tls.Config
+		if tlsConfig, err = newConsoleTLSConfig(opts); err != nil {
+			return nil, err
+		}
+		dialer := &net.Dialer{Timeout: opts.Timeout}
+		conn, err = tls.DialWithDialer(dialer, "tcp", opts.Address, tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", opts.Address, opts.Timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &kConsoleClient{
+		conn:           conn,
+		codec:          kJSONCodec{},
+		stream:         NewCmdStream(conn, NewCmdProtocol()),
+		packets:        make(chan *CmdPacket, 16),
+		timeout:        opts.Timeout,
+	}
+	go c.readLoop()
+
+	return c, nil
+}
+
+// read packets in background, so acknowledges of chunks are consumed while sending
+func (c *kConsoleClient) readLoop() {
+	for {
+		p, err := c.stream.ReadPacket()
+		if err != nil {
+			c.readErr = err
+			c.stream.Close()
+			close(c.packets)
+			return
+		}
+		c.packets <- p
+	}
+}
+
+func (c *kConsoleClient) Close() {
+	c.conn.Close()
+}
+
+// send request and return its id
+func (c *kConsoleClient) Send(cmd string, args interface{}) (uint32, error) {
+	c.nextID++
+	req := &kCmdMessage{
+		Type:           CMD_MSG_REQUEST,
+		ID:             c.nextID,
+		Command:        cmd,
+		Body:           args,
+	}
+
+	packet, err := EncodeCmdMessage(c.codec, req)
+	if err != nil {
+		return 0, err
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	if err := c.stream.WritePacket(packet); err != nil {
+		return 0, err
+	}
+
+	return req.ID, nil
+}
+
+// read next message, waits forever if timeout is 0
+func (c *kConsoleClient) Read(timeout time.Duration) (*kCmdMessage, kCmdCodec, error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case p, ok := <-c.packets:
+		if !ok {
+			return nil, nil, c.readErr
+		}
+		c.stream.Consumed(p)
+		if p.TooLarge() {
+			return nil, nil, ErrCmdPacketTooLarge
+		}
+		return DecodeCmdMessage(p.GetBody())
+
+	case <-expired:
+		return nil, nil, ErrConsoleTimeout
+	}
+}
+
+// check status of response and decode its result into result
+func checkResponse(resp *kCmdMessage, codec kCmdCodec, result interface{}) error {
+	if resp.Status != CMD_STATUS_OK {
+		return fmt.Errorf("%s failed (%d): %s", resp.Command, resp.Status, resp.Error)
+	}
+	if result != nil {
+		return resp.DecodeBody(codec, result)
+	}
+
+	return nil
+}
+
+// send request and decode result of response into result
+func (c *kConsoleClient) Request(cmd string, args interface{}, result interface{}) error {
+	id, err := c.Send(cmd, args)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(c.timeout)
+	for {
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			return ErrConsoleTimeout
+		}
+
+		resp, codec, err := c.Read(remaining)
+		if err != nil {
+			return err
+		}
+		if resp.Type != CMD_MSG_RESPONSE || resp.ID != id {
+			continue
+		}
+
+		return checkResponse(resp, codec, result)
+	}
+}
+
+// print result as indented JSON
+func printJSON(v interface{}) error {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(out))
+	return nil
+}
+
+// create table writer
+func newTable() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+}
+
+func runStatus(c *kConsoleClient, opts *Options, args []string) error {
+	var info kCmdStatusInfo
+
+	if err := c.Request(CMD_STATUS, nil, &info); err != nil {
+		return err
+	}
+	if opts.JSON {
+		return printJSON(&info)
+	}
+
+	w := newTable()
+	fmt.Fprintf(w, "Version:\t%s\n", info.Version)
+	fmt.Fprintf(w, "PID:\t%d\n", info.PID)
+	fmt.Fprintf(w, "Started:\t%s\n", info.StartTime)
+	fmt.Fprintf(w, "Uptime:\t%v\n", time.Duration(info.Uptime) * time.Second)
+	fmt.Fprintf(w, "Config file:\t%s\n", info.ConfigFile)
+	fmt.Fprintf(w, "Inputs:\t%d\n", info.Inputs)
+	fmt.Fprintf(w, "Outputs:\t%d\n", info.Outputs)
+	fmt.Fprintf(w, "Watched files:\t%d\n", info.WatchedFiles)
+	if info.LogLevel >= 0 && info.LogLevel < len(kLogLevelNames) {
+		fmt.Fprintf(w, "Log level:\t%d (%s)\n", info.LogLevel, kLogLevelNames[info.LogLevel])
+	}
+	return w.Flush()
+}
+
+func runInputs(c *kConsoleClient, opts *Options, args []string) error {
+	var infos []kCmdInputInfo
+
+	if err := c.Request(CMD_LIST_INPUTS, nil, &infos); err != nil {
+		return err
+	}
+	if opts.JSON {
+		return printJSON(infos)
+	}
+
+	w := newTable()
+	fmt.Fprintln(w, "NAME\tTYPE\tSTATE\tEVENTS\tBYTES\tERRORS")
+	for _, info := range infos {
+		state := "running"
+		if info.Paused {
+			state = "paused"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\n", info.Name, info.Type, state, info.Events, info.Bytes, info.Errors)
+	}
+	return w.Flush()
+}
+
+func runOutputs(c *kConsoleClient, opts *Options, args []string) error {
+	var infos []kCmdOutputInfo
+
+	if err := c.Request(CMD_LIST_OUTPUTS, nil, &infos); err != nil {
+		return err
+	}
+	if opts.JSON {
+		return printJSON(infos)
+	}
+
+	w := newTable()
+	fmt.Fprintln(w, "NAME\tTYPE\tQUEUED\tSENT\tDROPPED\tFAILED")
+	for _, info := range infos {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\n", info.Name, info.Type, info.Queued, info.Sent, info.Dropped, info.Failed)
+	}
+	return w.Flush()
+}
+
+// parse input argument which is either "name" or "type/name"
+func parseInputArg(args []string) (*kCmdInputArgs, error) {
+	if len(args) != 1 {
+		return nil, ErrConsoleInvalidArgs
+	}
+
+	for i := 0; i < len(args[0]); i++ {
+		if args[0][i] == '/' {
+			return &kCmdInputArgs{Type: args[0][:i], Name: args[0][i + 1:]}, nil
+		}
+	}
+
+	return &kCmdInputArgs{Name: args[0]}, nil
+}
+
+// print result of commands which return nothing
+func printDone(opts *Options, message string) error {
+	if opts.JSON {
+		return printJSON(map[string]string{"result": message})
+	}
+
+	fmt.Println(message)
+	return nil
 }
 
+func runPause(c *kConsoleClient, opts *Options, args []string) error {
+	in, err := parseInputArg(args)
+	if err != nil {
+		return err
+	}
+	if err := c.Request(CMD_PAUSE_INPUT, in, nil); err != nil {
+		return err
+	}
+
+	return printDone(opts, fmt.Sprintf("Input '%s' paused", in.Name))
+}
+
+func runResume(c *kConsoleClient, opts *Options, args []string) error {
+	in, err := parseInputArg(args)
+	if err != nil {
+		return err
+	}
+	if err := c.Request(CMD_RESUME_INPUT, in, nil); err != nil {
+		return err
+	}
+
+	return printDone(opts, fmt.Sprintf("Input '%s' resumed", in.Name))
+}
+
+func runReload(c *kConsoleClient, opts *Options, args []string) error {
+	if err := c.Request(CMD_RELOAD_CONFIG, nil, nil); err != nil {
+		return err
+	}
+
+	return printDone(opts, "Configuration reloaded")
+}
+
+// parse log level which is either number or name
+func parseLogLevelArg(arg string) (int, error) {
+	for level, name := range kLogLevelNames {
+		if arg == name || arg == strconv.Itoa(level) {
+			return level, nil
+		}
+	}
+
+	return 0, ErrInvalidLogLevel
+}
+
+func runLogLevel(c *kConsoleClient, opts *Options, args []string) error {
+	var result kCmdLogLevelResult
+
+	if len(args) != 1 {
+		return ErrConsoleInvalidArgs
+	}
+	level, err := parseLogLevelArg(args[0])
+	if err != nil {
+		return err
+	}
+
+	if err := c.Request(CMD_SET_LOG_LEVEL, &kCmdLogLevelArgs{Level: &level}, &result); err != nil {
+		return err
+	}
+	if opts.JSON {
+		return printJSON(&result)
+	}
+
+	fmt.Printf("Log level changed from %s to %s\n", kLogLevelNames[result.Previous], kLogLevelNames[result.Level])
+	return nil
+}
+
+func runFlush(c *kConsoleClient, opts *Options, args []string) error {
+	var flushArgs kCmdFlushArgs
+	var results []kCmdFlushResult
+
+	if len(args) > 0 {
+		timeout, err := strconv.Atoi(args[0])
+		if err != nil {
+			return ErrConsoleInvalidArgs
+		}
+		flushArgs.Timeout = timeout
+
+		// wait for daemon longer than flush timeout
+		c.timeout += time.Duration(timeout) * time.Second
+	}
+
+	if err := c.Request(CMD_FLUSH_OUTPUTS, &flushArgs, &results); err != nil {
+		return err
+	}
+	if opts.JSON {
+		return printJSON(results)
+	}
+
+	w := newTable()
+	fmt.Fprintln(w, "NAME\tTYPE\tRESULT")
+	for _, r := range results {
+		result := "flushed"
+		if r.Error != "" {
+			result = r.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", r.Name, r.Type, result)
+	}
+	return w.Flush()
+}
+
+func runStats(c *kConsoleClient, opts *Options, args []string) error {
+	var info kCmdStatsInfo
+
+	if err := c.Request(CMD_STATS, nil, &info); err != nil {
+		return err
+	}
+	if opts.JSON {
+		return printJSON(&info)
+	}
+
+	w := newTable()
+	fmt.Fprintf(w, "Input events:\t%d\n", info.InputEvents)
+	fmt.Fprintf(w, "Input bytes:\t%d\n", info.InputBytes)
+	fmt.Fprintf(w, "Input errors:\t%d\n", info.InputErrors)
+	fmt.Fprintf(w, "Output queued:\t%d\n", info.OutputQueued)
+	fmt.Fprintf(w, "Output sent:\t%d\n", info.OutputSent)
+	fmt.Fprintf(w, "Output dropped:\t%d\n", info.OutputDropped)
+	fmt.Fprintf(w, "Output failed:\t%d\n", info.OutputFailed)
+	fmt.Fprintf(w, "Watched files:\t%d\n", info.WatchedFiles)
+	if info.LogLevel >= 0 && info.LogLevel < len(kLogLevelNames) {
+		fmt.Fprintf(w, "Log level:\t%d (%s)\n", info.LogLevel, kLogLevelNames[info.LogLevel])
+	}
+	return w.Flush()
+}
+
+func runConfig(c *kConsoleClient, opts *Options, args []string) error {
+	if len(args) == 0 {
+		return ErrConsoleInvalidArgs
+	}
+
+	switch args[0] {
+	case "show":
+		return runConfigShow(c, opts, args[1:])
+	case "apply":
+		return runConfigApply(c, opts, args[1:])
+	}
+
+	return ErrConsoleInvalidArgs
+}
+
+func runConfigShow(c *kConsoleClient, opts *Options, args []string) error {
+	var info kCmdConfigInfo
+
+	if len(args) != 0 {
+		return ErrConsoleInvalidArgs
+	}
+
+	if err := c.Request(CMD_SHOW_CONFIG, nil, &info); err != nil {
+		return err
+	}
+	if opts.JSON {
+		return printJSON(&info)
+	}
+
+	fmt.Printf("# %s\n", info.Path)
+	for _, include := range info.Includes {
+		fmt.Printf("# includes %s\n", include)
+	}
+	fmt.Print(info.Content)
+	return nil
+}
+
+func runConfigApply(c *kConsoleClient, opts *Options, args []string) error {
+	var applyArgs kCmdApplyArgs
+	var result kCmdApplyResult
+
+	fs := flag.NewFlagSet("config apply", flag.ContinueOnError)
+	fs.BoolVar(&applyArgs.DryRun, "dry-run", false, "Validate and show changes without applying")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return ErrConsoleInvalidArgs
+	}
+
+	content, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	applyArgs.Content = string(content)
+
+	if err := c.Request(CMD_APPLY_CONFIG, &applyArgs, &result); err != nil {
+		return err
+	}
+	if opts.JSON {
+		return printJSON(&result)
+	}
+
+	if len(result.Changes) == 0 {
+		fmt.Println("No changes of inputs and outputs")
+	} else {
+		w := newTable()
+		fmt.Fprintln(w, "ACTION\tKIND\tTYPE\tNAME")
+		for _, change := range result.Changes {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", change.Action, change.Kind, change.Type, change.Name)
+		}
+		w.Flush()
+	}
+
+	if result.Applied {
+		fmt.Println("Configuration applied")
+	} else {
+		fmt.Println("Configuration is valid, nothing applied")
+	}
+	return nil
+}
+
+func runTail(c *kConsoleClient, opts *Options, args []string) error {
+	var tailArgs kCmdTailArgs
+
+	fs := flag.NewFlagSet("tail", flag.ContinueOnError)
+	fs.StringVar(&tailArgs.Group, "group", "", "Show events of the group only")
+	fs.StringVar(&tailArgs.Source, "source", "", "Show events of the source only")
+	fs.StringVar(&tailArgs.Match, "match", "", "Show events whose message matches the regexp only")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 {
+		return ErrConsoleInvalidArgs
+	}
+
+	id, err := c.Send(CMD_SUBSCRIBE, &tailArgs)
+	if err != nil {
+		return err
+	}
+
+	// events are streamed until connection is closed
+	var dropped uint64
+	for {
+		msg, codec, err := c.Read(0)
+		if err != nil {
+			return err
+		}
+		if msg.ID != id {
+			continue
+		}
+
+		if msg.Type == CMD_MSG_RESPONSE {
+			if err := checkResponse(msg, codec, nil); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var ev kCmdTailEvent
+		if err := msg.DecodeBody(codec, &ev); err != nil {
+			return err
+		}
+
+		if ev.Dropped > dropped {
+			fmt.Fprintf(os.Stderr, "*** %d event(s) dropped by daemon\n", ev.Dropped - dropped)
+			dropped = ev.Dropped
+		}
+
+		if opts.JSON {
+			out, _ := json.Marshal(&ev)
+			fmt.Println(string(out))
+		} else {
+			fmt.Printf("%s %s %s %s\n", ev.Time, ev.Group, ev.Source, ev.Message)
+		}
+	}
+}
+
+// print usage
+func printUsage(fs *flag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] <command> [args]\n\nCommands:\n", os.Args[0])
+
+	w := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+	for _, name := range consoleCmdOrder {
+		cmd := consoleCmds[name]
+		fmt.Fprintf(w, "  %s\t%s\n", cmd.usage, cmd.description)
+	}
+	w.Flush()
+
+	fmt.Fprintf(os.Stderr, "\nOptions:\n")
+	fs.PrintDefaults()
+}
+
+// parse command line options
+func parseOptions() (*Options, []string) {
+	opts := &Options{}
+
+	addr := os.Getenv("KAOHI_LISTEN_ADDR")
+	if addr == "" {
+		addr = KAOHI_DEFAULT_LISTEN_ADDR
+	}
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	fs.StringVar(&opts.Address, "address", addr, "IP:port or unix socket path of Kaohi command listener")
+	fs.BoolVar(&opts.JSON, "json", false, "Print results in JSON")
+	fs.DurationVar(&opts.Timeout, "timeout", 10 * time.Second, "Timeout of requests")
+	fs.StringVar(&opts.TLSCAFile, "tls-ca", "", "CA certificate to verify the daemon")
+	fs.StringVar(&opts.TLSCertFile, "tls-cert", "", "Client certificate")
+	fs.StringVar(&opts.TLSKeyFile, "tls-key", "", "Private key of client certificate")
+	fs.StringVar(&opts.TLSServerName, "tls-server-name", "", "Server name of the daemon certificate")
+	fs.Usage = func() {
+		printUsage(fs)
+	}
+	fs.Parse(os.Args[1:])
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	return opts, fs.Args()
+}
+
+// main function
 func main() {
-	
+	opts, args := parseOptions()
+
+	cmd, ok := consoleCmds[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command '%s'\n", args[0])
+		os.Exit(2)
+	}
+
+	client, err := DialConsole(opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer client.Close()
+
+	if err := cmd.run(client, opts, args[1:]); err != nil {
+		if err == ErrConsoleInvalidArgs {
+			fmt.Fprintf(os.Stderr, "Usage: %s %s\n", os.Args[0], cmd.usage)
+			os.Exit(2)
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
@@ -26,13 +26,17 @@
 package main
 
 import (
-	"os"
+	"encoding/json"
 	"fmt"
+	"io"
+	"os"
 	"path"
-	"sync"
-	"time"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // log file path
@@ -49,26 +53,27 @@ const (
 	ERR = "ERR"
 )
 
-// logger type
+// tags of levels in text format
+var kLogTypes = []string{"ERR", "WRN", "INF", "DBG"}
+
+// log format
 const (
-	CONSOLE string = "console"
-	FILE    string = "file"
+	LOG_FORMAT_TEXT = "text"
+	LOG_FORMAT_JSON = "json"
 )
 
-// logger struct
-type kLogger struct {
-	Logger
-}
+// fields of structured log message
+const (
+	LOG_FIELD_COMPONENT = "component"
+	LOG_FIELD_GROUP     = "group"
+	LOG_FIELD_ERROR     = "error"
+)
 
-type Logger struct {
-	PrinterType string
-	Location    string
-}
+type kLogFields map[string]string
 
-type LogInstance struct {
-	LogType    string
-	Message    string
-	LoggerInit Logger
+// logger which adds fields to every message, e.g. group of input
+type kFieldLogger struct {
+	fields kLogFields
 }
 
 type callerInfo struct {
@@ -78,67 +83,304 @@ type callerInfo struct {
 	line        int
 }
 
-// external logger variables
-var consoleLogger, fileLogger kLogger
+// log file which is rotated by size, kaohi.log.1 is the newest rotated file
+type kLogFile struct {
+	path           string
+	file           *os.File
+	size           int64
+	maxSize        int64
+	maxFiles       int
+}
+
+// logger state
 var mux sync.Mutex
-var kLogFile *os.File
+var kLogOutput io.Writer = os.Stdout
+var kLogFileOut *kLogFile
+var kLogFormat = LOG_FORMAT_TEXT
+var kLogLevel int32 = LOG_LEVEL_DEBUG
+
+// init logger, messages are written to log file of directory and also to
+// console if it is a terminal
+func InitLogger(dir_path string, level int, format string, maxSize int, maxFiles int) error {
+	if err := SetLogFile(dir_path, maxSize, maxFiles); err != nil {
+		return err
+	}
 
-// init logger
-func InitLogger(dir_path string, level int) error {
+	if fi, err := os.Stdout.Stat(); err != nil || fi.Mode() & os.ModeCharDevice == 0 {
+		mux.Lock()
+		kLogOutput = nil
+		mux.Unlock()
+	}
+
+	if err := SetLogFormat(format); err != nil {
+		return err
+	}
+	SetLogLevel(level)
+
+	return nil
+}
+
+// finalize logger
+func FinalizeLogger() {
+	mux.Lock()
+	defer mux.Unlock()
+
+	if kLogFileOut != nil {
+		kLogFileOut.file.Close()
+		kLogFileOut = nil
+	}
+	kLogOutput = os.Stdout
+}
+
+// open log file in directory, the current log file is kept if it can't be opened
+func SetLogFile(dir_path string, maxSize int, maxFiles int) error {
 	// create log directory and set log file path
 	if os.MkdirAll(dir_path, 0755) != nil {
 		return ErrCreateLogDir
 	}
-	log_path := path.Join(dir_path, KAOHI_LOG_FILE)
 
-	// create log file
-	kLogFile, err := os.OpenFile(log_path, os.O_APPEND | os.O_WRONLY | os.O_CREATE, 0644)
-	defer kLogFile.Close()
+	if maxSize <= 0 {
+		maxSize = KAOHI_DEFAULT_LOG_MAX_SIZE
+	}
+	if maxFiles <= 0 {
+		maxFiles = KAOHI_DEFAULT_LOG_MAX_FILES
+	}
+
+	lf := &kLogFile{
+		path:           path.Join(dir_path, KAOHI_LOG_FILE),
+		maxSize:        int64(maxSize) * 1024 * 1024,
+		maxFiles:       maxFiles,
+	}
+	if err := lf.open(); err != nil {
+		return err
+	}
+
+	mux.Lock()
+	prev := kLogFileOut
+	kLogFileOut = lf
+	mux.Unlock()
+
+	if prev != nil {
+		prev.file.Close()
+	}
+
+	return nil
+}
+
+// reopen log file after it was moved by external logrotate
+func ReopenLogFile() error {
+	mux.Lock()
+	defer mux.Unlock()
+
+	if kLogFileOut == nil {
+		return nil
+	}
+
+	kLogFileOut.file.Close()
+	return kLogFileOut.open()
+}
+
+func (lf *kLogFile) open() error {
+	file, err := os.OpenFile(lf.path, os.O_APPEND | os.O_WRONLY | os.O_CREATE, 0644)
 	if err != nil {
 		return ErrCreateLogFile
 	}
 
-	// get logger for console and file
-	consoleLogger = GetLogger()
-	fileLogger = GetLogger(FILE, log_path)
+	lf.file = file
+	lf.size = 0
+	if fi, err := file.Stat(); err == nil {
+		lf.size = fi.Size()
+	}
 
 	return nil
 }
 
-// get logger
-func GetLogger(selector ...string) kLogger {
-	if len(selector) == 0 {
-		return kLogger{Logger{CONSOLE, ""}}
+// write message, the file is rotated before it exceeds the maximum size
+func (lf *kLogFile) Write(data []byte) (int, error) {
+	if lf.size > 0 && lf.size + int64(len(data)) > lf.maxSize {
+		if err := lf.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not rotate log file '%s': %v\n", lf.path, err)
+		}
 	}
-	return kLogger{Logger{selector[0], selector[1]}}
+
+	n, err := lf.file.Write(data)
+	lf.size += int64(n)
+
+	return n, err
+}
+
+// shift rotated files and remove the ones beyond retention count
+func (lf *kLogFile) rotate() error {
+	lf.file.Close()
+
+	os.Remove(fmt.Sprintf("%s.%d", lf.path, lf.maxFiles))
+	for i := lf.maxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", lf.path, i), fmt.Sprintf("%s.%d", lf.path, i + 1))
+	}
+	if err := os.Rename(lf.path, lf.path + ".1"); err != nil {
+		lf.open()
+		return err
+	}
+
+	return lf.open()
 }
 
-func Print(log LogInstance, packageName string, fileName string, lineNumber int, funcName string, tt time.Time) {
-	logString := fmt.Sprintf("[%s] [%s] [%s::%s::%s] [%d] %s\n", log.LogType, tt.Format(time.RFC3339), packageName, fileName, funcName, lineNumber, log.Message)
+// write message to log file and console
+func writeLog(data []byte) {
+	if kLogFileOut != nil {
+		kLogFileOut.Write(data)
+	}
+	if kLogOutput != nil {
+		kLogOutput.Write(data)
+	}
+}
 
-	switch log.LoggerInit.PrinterType {
-	case "console":
-		fmt.Printf(logString)
-	case "file":
-		kLogFile.WriteString(logString)
+// set log level and return previous one, level is clamped to 0 ~ 3
+func SetLogLevel(level int) int {
+	if level < LOG_LEVEL_ERR {
+		level = LOG_LEVEL_ERR
+	} else if level > LOG_LEVEL_DEBUG {
+		level = LOG_LEVEL_DEBUG
 	}
+
+	return int(atomic.SwapInt32(&kLogLevel, int32(level)))
 }
 
-func logPrinter(log LogInstance) {
+func GetLogLevel() int {
+	return int(atomic.LoadInt32(&kLogLevel))
+}
+
+func SetLogFormat(format string) error {
+	switch format {
+	case "":
+		format = LOG_FORMAT_TEXT
+	case LOG_FORMAT_TEXT, LOG_FORMAT_JSON:
+	default:
+		return ErrInvalidLogFormat
+	}
+
+	mux.Lock()
+	kLogFormat = format
+	mux.Unlock()
+
+	return nil
+}
+
+// create logger with fields
+func LogWith(fields kLogFields) kFieldLogger {
+	return kFieldLogger{fields}
+}
+
+// copy of logger with additional field
+func (l kFieldLogger) With(key string, value string) kFieldLogger {
+	fields := make(kLogFields, len(l.fields) + 1)
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	fields[key] = value
+
+	return kFieldLogger{fields}
+}
+
+func (l kFieldLogger) Err(format string, args ...interface{}) {
+	logMessage(LOG_LEVEL_ERR, l.fields, format, args)
+}
+
+func (l kFieldLogger) Warn(format string, args ...interface{}) {
+	logMessage(LOG_LEVEL_WARN, l.fields, format, args)
+}
+
+func (l kFieldLogger) Info(format string, args ...interface{}) {
+	logMessage(LOG_LEVEL_INFO, l.fields, format, args)
+}
+
+func (l kFieldLogger) Debug(format string, args ...interface{}) {
+	logMessage(LOG_LEVEL_DEBUG, l.fields, format, args)
+}
+
+// format and write message if its level is enabled, must be called
+// directly by logging functions so that caller is found
+func logMessage(level int, fields kLogFields, format string, args []interface{}) {
+	logged := level <= GetLogLevel()
+	internal := internalEventsEnabled(level)
+	if !logged && !internal {
+		return
+	}
+
+	msg := format
+	if len(args) > 0 {
+		msg = fmt.Sprintf(format, args...)
+	}
+
 	info := retrieveCallInfo()
-	timer := time.Now()
-	logPrint(log, info, timer)
+
+	// error of arguments is logged as error field
+	if _, ok := fields[LOG_FIELD_ERROR]; !ok {
+		for _, arg := range args {
+			if err, ok := arg.(error); ok {
+				fields = LogWith(fields).With(LOG_FIELD_ERROR, err.Error()).fields
+				break
+			}
+		}
+	}
+
+	now := time.Now()
+	if internal {
+		emitInternalEvent(level, fields, msg, info, now)
+	}
+	if !logged {
+		return
+	}
+
+	mux.Lock()
+	defer mux.Unlock()
+
+	if kLogFormat == LOG_FORMAT_JSON {
+		printJSONLog(level, fields, msg, info, now)
+	} else {
+		printTextLog(level, fields, msg, info, now)
+	}
+}
+
+func printTextLog(level int, fields kLogFields, msg string, info *callerInfo, tt time.Time) {
+	logString := fmt.Sprintf("[%s] [%s] [%s::%s::%s] [%d] %s", kLogTypes[level], tt.Format(time.RFC3339),
+		info.packageName, info.fileName, info.funcName, info.line, msg)
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		if key != LOG_FIELD_ERROR {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		logString += fmt.Sprintf(" %s=%q", key, fields[key])
+	}
+
+	writeLog([]byte(logString + "\n"))
 }
 
-func logPrint(log LogInstance, info *callerInfo, time time.Time) {
-	Print(log, info.packageName, info.fileName, info.line, info.funcName, time)
-	if log.LogType == "CRT" {
-		os.Exit(1)
+func printJSONLog(level int, fields kLogFields, msg string, info *callerInfo, tt time.Time) {
+	record := map[string]string{
+		"time":                 tt.Format(time.RFC3339Nano),
+		"level":                kLogLevelNames[level],
+		LOG_FIELD_COMPONENT:    strings.TrimSuffix(info.fileName, ".go"),
+		"caller":               fmt.Sprintf("%s:%d", info.fileName, info.line),
+		"message":              msg,
 	}
+	for key, value := range fields {
+		record[key] = value
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	writeLog(append(data, '\n'))
 }
 
 func retrieveCallInfo() *callerInfo {
-	pc, file, line, _ := runtime.Caller(4)
+	pc, file, line, _ := runtime.Caller(3)
 	_, fileName := path.Split(file)
 	parts := strings.Split(runtime.FuncForPC(pc).Name(), ".")
 	pl := len(parts)
@@ -160,54 +402,22 @@ func retrieveCallInfo() *callerInfo {
 	}
 }
 
-func (log kLogger) Info(message string) {
-	logPrinter(LogInstance{LogType: "INF", Message: message, LoggerInit: log.Logger})
-}
-
-func (log kLogger) Warn(message string) {
-	logPrinter(LogInstance{LogType: "WRN", Message: message, LoggerInit: log.Logger})
-}
-
-func (log kLogger) Error(message string) {
-	logPrinter(LogInstance{LogType: "ERR", Message: message, LoggerInit: log.Logger})
-}
-
-func (log kLogger) Debug(message string) {
-	logPrinter(LogInstance{LogType: "DBG", Message: message, LoggerInit: log.Logger})
+// print debug message
+func DEBUG_DBG(format string, args ...interface{}) {
+	logMessage(LOG_LEVEL_DEBUG, nil, format, args)
 }
 
 // print info
 func DEBUG_INFO(format string, args ...interface{}) {
-	var msg string
-
-	if len(args) == 0 {
-		msg = format
-	} else {
-		msg = fmt.Sprintf(format, args)
-	}
-	consoleLogger.Info(msg)
+	logMessage(LOG_LEVEL_INFO, nil, format, args)
 }
 
 // print warning
 func DEBUG_WARN(format string, args ...interface{}) {
-	var msg string
-
-	if len(args) == 0 {
-		msg = format
-	} else {
-		msg = fmt.Sprintf(format, args)
-	}
-	consoleLogger.Warn(msg)
+	logMessage(LOG_LEVEL_WARN, nil, format, args)
 }
 
 // print errors
 func DEBUG_ERR(format string, args ...interface{}) {
-	var msg string
-
-	if len(args) == 0 {
-		msg = format
-	} else {
-		msg = fmt.Sprintf(format, args)
-	}
-	consoleLogger.Error(msg)
+	logMessage(LOG_LEVEL_ERR, nil, format, args)
 }
@@ -0,0 +1,351 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// buckets of duration histograms in seconds
+var kDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// histogram of durations which is usable as zero value, it's kept apart
+// from prometheus so that inputs and outputs don't depend on it
+type kHistogram struct {
+	mu             sync.Mutex
+	counts         []uint64
+	count          uint64
+	sum            float64
+}
+
+// snapshot of histogram with cumulative bucket counts
+type kHistogramSnapshot struct {
+	Count          uint64
+	Sum            float64
+	Buckets        map[float64]uint64
+}
+
+func (h *kHistogram) Observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.counts == nil {
+		h.counts = make([]uint64, len(kDurationBuckets))
+	}
+
+	seconds := d.Seconds()
+	if i := sort.SearchFloat64s(kDurationBuckets, seconds); i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += seconds
+}
+
+func (h *kHistogram) Snapshot() kHistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := kHistogramSnapshot{Count: h.count, Sum: h.sum, Buckets: make(map[float64]uint64)}
+
+	var cumulative uint64
+	for i, bound := range kDurationBuckets {
+		if h.counts != nil {
+			cumulative += h.counts[i]
+		}
+		s.Buckets[bound] = cumulative
+	}
+
+	return s
+}
+
+// sum of two snapshots with same buckets
+func mergeHistograms(a kHistogramSnapshot, b kHistogramSnapshot) kHistogramSnapshot {
+	s := kHistogramSnapshot{Count: a.Count + b.Count, Sum: a.Sum + b.Sum, Buckets: make(map[float64]uint64)}
+	for bound, n := range a.Buckets {
+		s.Buckets[bound] += n
+	}
+	for bound, n := range b.Buckets {
+		s.Buckets[bound] += n
+	}
+
+	return s
+}
+
+// statistics of commands input
+type kCommandStats struct {
+	Duration       kHistogramSnapshot
+	ExitCodes      map[int]uint64
+}
+
+// input which runs commands
+type kCommandStatser interface {
+	CommandStats() kCommandStats
+}
+
+// number of connected console clients
+var kCmdClients int64
+
+// collector which reads statistics of running inputs and outputs on scrape
+type kMetricsCollector struct {
+	inputEvents    *prometheus.Desc
+	inputBytes     *prometheus.Desc
+	inputErrors    *prometheus.Desc
+	inputPaused    *prometheus.Desc
+	commandSeconds *prometheus.Desc
+	commandExits   *prometheus.Desc
+	outputSent     *prometheus.Desc
+	outputDropped  *prometheus.Desc
+	outputFailed   *prometheus.Desc
+	outputRetries  *prometheus.Desc
+	outputQueued   *prometheus.Desc
+	outputDisk     *prometheus.Desc
+	outputSeconds  *prometheus.Desc
+	watchedFiles   *prometheus.Desc
+	consoleClients *prometheus.Desc
+	internalDropped *prometheus.Desc
+}
+
+func newMetricsCollector() *kMetricsCollector {
+	desc := func(name string, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc("kaohi_" + name, help, labels, nil)
+	}
+
+	return &kMetricsCollector{
+		inputEvents:    desc("input_events_total", "Events read by input.", "type", "group"),
+		inputBytes:     desc("input_bytes_total", "Bytes read by input.", "type", "group"),
+		inputErrors:    desc("input_errors_total", "Read and parse failures of input.", "type", "group"),
+		inputPaused:    desc("input_paused", "Whether input is paused.", "type", "group"),
+		commandSeconds: desc("command_duration_seconds", "Run time of commands.", "group"),
+		commandExits:   desc("command_exits_total", "Exit codes of commands.", "group", "code"),
+		outputSent:     desc("output_events_sent_total", "Events delivered by output.", "type", "name"),
+		outputDropped:  desc("output_events_dropped_total", "Events dropped as queue of output was full.", "type", "name"),
+		outputFailed:   desc("output_events_failed_total", "Events which could not be delivered by output.", "type", "name"),
+		outputRetries:  desc("output_retries_total", "Retried deliveries of output.", "type", "name"),
+		outputQueued:   desc("output_queue_depth", "Events queued for delivery.", "type", "name"),
+		outputDisk:     desc("output_disk_usage_bytes", "Size of dead-letter file and spool of output.", "type", "name"),
+		outputSeconds:  desc("output_send_duration_seconds", "Latency of deliveries of output.", "type", "name"),
+		watchedFiles:   desc("watched_files", "Files watched by watcher."),
+		consoleClients: desc("console_clients", "Connected console clients."),
+		internalDropped: desc("internal_events_dropped_total", "Internal events dropped as queue was full or they were rate limited."),
+	}
+}
+
+func (mc *kMetricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		mc.inputEvents, mc.inputBytes, mc.inputErrors, mc.inputPaused,
+		mc.commandSeconds, mc.commandExits,
+		mc.outputSent, mc.outputDropped, mc.outputFailed, mc.outputRetries,
+		mc.outputQueued, mc.outputDisk, mc.outputSeconds,
+		mc.watchedFiles, mc.consoleClients, mc.internalDropped,
+	} {
+		ch <- desc
+	}
+}
+
+func (mc *kMetricsCollector) Collect(ch chan<- prometheus.Metric) {
+	counter := func(desc *prometheus.Desc, value uint64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(value), labels...)
+	}
+	gauge := func(desc *prometheus.Desc, value float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labels...)
+	}
+	histogram := func(desc *prometheus.Desc, h kHistogramSnapshot, labels ...string) {
+		ch <- prometheus.MustNewConstHistogram(desc, h.Count, h.Sum, h.Buckets, labels...)
+	}
+
+	for _, in := range GetInputs() {
+		stats := in.Stats()
+		counter(mc.inputEvents, stats.Events, in.Type(), in.Name())
+		counter(mc.inputBytes, stats.Bytes, in.Type(), in.Name())
+		counter(mc.inputErrors, stats.Errors, in.Type(), in.Name())
+
+		paused := 0.0
+		if in.IsPaused() {
+			paused = 1
+		}
+		gauge(mc.inputPaused, paused, in.Type(), in.Name())
+
+		if cs, ok := in.(kCommandStatser); ok {
+			cmdStats := cs.CommandStats()
+			histogram(mc.commandSeconds, cmdStats.Duration, in.Name())
+			for code, n := range cmdStats.ExitCodes {
+				counter(mc.commandExits, n, in.Name(), strconv.Itoa(code))
+			}
+		}
+	}
+
+	for _, out := range GetOutputs() {
+		stats := out.Stats()
+		counter(mc.outputSent, stats.Sent, out.Type(), out.Name())
+		counter(mc.outputDropped, stats.Dropped, out.Type(), out.Name())
+		counter(mc.outputFailed, stats.Failed, out.Type(), out.Name())
+		counter(mc.outputRetries, stats.Retries, out.Type(), out.Name())
+		gauge(mc.outputQueued, float64(stats.Queued), out.Type(), out.Name())
+		gauge(mc.outputDisk, float64(stats.DiskUsage), out.Type(), out.Name())
+		histogram(mc.outputSeconds, stats.Latency, out.Type(), out.Name())
+	}
+
+	if kWatcher != nil {
+		gauge(mc.watchedFiles, float64(kWatcher.FileCount()))
+	}
+	gauge(mc.consoleClients, float64(atomic.LoadInt64(&kCmdClients)))
+	counter(mc.internalDropped, atomic.LoadUint64(&kInternal.dropped) + atomic.LoadUint64(&kInternal.suppressed))
+}
+
+// HTTP server of metrics
+type kMetricsServer struct {
+	server         *http.Server
+	listener       net.Listener
+	done           chan struct{}
+}
+
+var kMetrics struct {
+	mu             sync.Mutex
+	registry       *prometheus.Registry
+	srv            *kMetricsServer
+}
+
+// start HTTP server of metrics on listen address of configuration
+func startMetricsServer(cfg kMetricsConfig) (*kMetricsServer, error) {
+	listener, err := net.Listen("tcp", cfg.ListenAddr)
+	if err != nil {
+		return nil, ErrListenFaield
+	}
+
+	path := cfg.Path
+	if path == "" {
+		path = KAOHI_DEFAULT_METRICS_PATH
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(path, promhttp.HandlerFor(kMetrics.registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc(KAOHI_HEALTHZ_PATH, handleHealthz)
+	mux.HandleFunc(KAOHI_READYZ_PATH, newReadyzHandler(cfg.HighWaterMark))
+
+	srv := &kMetricsServer{
+		server:         &http.Server{Handler: mux, ReadTimeout: KAOHI_METRICS_TIMEOUT, WriteTimeout: KAOHI_METRICS_TIMEOUT},
+		listener:       listener,
+		done:           make(chan struct{}),
+	}
+	go func() {
+		defer close(srv.done)
+		if err := srv.server.Serve(listener); err != http.ErrServerClosed {
+			DEBUG_ERR("Metrics server on %s stopped: %v", listener.Addr(), err)
+		}
+	}()
+
+	DEBUG_INFO("Serving metrics on http://%s%s, health checks on %s and %s",
+		listener.Addr(), path, KAOHI_HEALTHZ_PATH, KAOHI_READYZ_PATH)
+
+	return srv, nil
+}
+
+func (srv *kMetricsServer) Stop() {
+	srv.server.Close()
+	<-srv.done
+}
+
+// init metrics, the HTTP server is started only if listen address is given
+func InitMetrics(ctx *kContext) error {
+	DEBUG_INFO("Initializing metrics")
+
+	kMetrics.mu.Lock()
+	defer kMetrics.mu.Unlock()
+
+	kMetrics.registry = prometheus.NewRegistry()
+	kMetrics.registry.MustRegister(newMetricsCollector())
+	kMetrics.registry.MustRegister(prometheus.NewGoCollector())
+	kMetrics.registry.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+
+	cfg := ctx.config.GetMetrics()
+	if cfg.ListenAddr == "" {
+		return nil
+	}
+
+	srv, err := startMetricsServer(cfg)
+	if err != nil {
+		return err
+	}
+	kMetrics.srv = srv
+
+	return nil
+}
+
+// restart HTTP server of metrics if its configuration was changed, the
+// running server is kept if the new one can't be started
+func ReconfigureMetrics(old *kConfigScheme, config *kConfigScheme) {
+	if reflect.DeepEqual(old.GetMetrics(), config.GetMetrics()) {
+		return
+	}
+
+	kMetrics.mu.Lock()
+	defer kMetrics.mu.Unlock()
+
+	prev := kMetrics.srv
+	if prev != nil && old.GetMetrics().ListenAddr == config.GetMetrics().ListenAddr {
+		// same address can't be bound twice
+		prev.Stop()
+		prev = nil
+		kMetrics.srv = nil
+	}
+
+	var srv *kMetricsServer
+	if config.GetMetrics().ListenAddr != "" {
+		var err error
+		if srv, err = startMetricsServer(config.GetMetrics()); err != nil {
+			DEBUG_ERR("Could not restart metrics server on %s: %v", config.GetMetrics().ListenAddr, err)
+			return
+		}
+	}
+
+	if prev != nil {
+		prev.Stop()
+	}
+	kMetrics.srv = srv
+}
+
+// finalize metrics
+func FinalizeMetrics() {
+	DEBUG_INFO("Finalizing metrics")
+
+	kMetrics.mu.Lock()
+	defer kMetrics.mu.Unlock()
+
+	if kMetrics.srv != nil {
+		kMetrics.srv.Stop()
+		kMetrics.srv = nil
+	}
+}
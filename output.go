@@ -0,0 +1,472 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// output interface
+type kOutput interface {
+	// Name returns the name of output block
+	Name() string
+
+	// Type returns the type of output
+	Type() string
+
+	// Write queues the event for delivery, it must never block
+	Write(ev *kEvent) error
+
+	// Flush waits until all queued events have been delivered
+	Flush(timeout time.Duration) error
+
+	// Stats returns the delivery statistics
+	Stats() kOutputStats
+
+	// Close stops the output
+	Close()
+}
+
+// output statistics
+type kOutputStats struct {
+	Queued         int64
+	Sent           uint64
+	Dropped        uint64
+	Failed         uint64
+	Retries        uint64
+	DiskUsage      int64
+	Latency        kHistogramSnapshot
+	Capacity       int64
+	Failing        bool
+}
+
+// output counters which are updated atomically
+type kOutputCounters struct {
+	queued         int64
+	sent           uint64
+	dropped        uint64
+	failed         uint64
+	retries        uint64
+	latency        kHistogram
+	failing        int32 // last delivery attempt has failed
+}
+
+func (c *kOutputCounters) addQueued(delta int64) {
+	atomic.AddInt64(&c.queued, delta)
+}
+
+func (c *kOutputCounters) addSent(n int) {
+	atomic.AddUint64(&c.sent, uint64(n))
+	atomic.StoreInt32(&c.failing, 0)
+}
+
+func (c *kOutputCounters) addDropped(n int) {
+	atomic.AddUint64(&c.dropped, uint64(n))
+}
+
+func (c *kOutputCounters) addFailed(n int) {
+	atomic.AddUint64(&c.failed, uint64(n))
+	atomic.StoreInt32(&c.failing, 1)
+}
+
+func (c *kOutputCounters) addRetries(n int) {
+	atomic.AddUint64(&c.retries, uint64(n))
+	atomic.StoreInt32(&c.failing, 1)
+}
+
+// record time taken to deliver events
+func (c *kOutputCounters) observeLatency(d time.Duration) {
+	c.latency.Observe(d)
+}
+
+func (c *kOutputCounters) Stats() kOutputStats {
+	return kOutputStats{
+		Queued:         atomic.LoadInt64(&c.queued),
+		Sent:           atomic.LoadUint64(&c.sent),
+		Dropped:        atomic.LoadUint64(&c.dropped),
+		Failed:         atomic.LoadUint64(&c.failed),
+		Retries:        atomic.LoadUint64(&c.retries),
+		Latency:        c.latency.Snapshot(),
+		Failing:        atomic.LoadInt32(&c.failing) == 1,
+	}
+}
+
+// wait until queued count reaches zero
+func (c *kOutputCounters) waitDrained(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&c.queued) > 0 {
+		if time.Now().After(deadline) {
+			return ErrOutputFlushTimeout
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return nil
+}
+
+// batching queue for outputs which deliver events in batches
+type kBatchQueue struct {
+	queue          chan *kEvent
+	batchSize      int
+	interval       time.Duration
+	send           func(batch []*kEvent)
+	stop           chan struct{}
+	wg             sync.WaitGroup
+
+	kOutputCounters
+}
+
+// create batching queue, send is called from the queue goroutine and
+// is responsible for updating sent and failed counters
+func newBatchQueue(queueSize int, batchSize int, interval time.Duration, send func(batch []*kEvent)) *kBatchQueue {
+	if queueSize <= 0 {
+		queueSize = KAOHI_DEFAULT_OUTPUT_QUEUE_SIZE
+	}
+	if batchSize <= 0 {
+		batchSize = KAOHI_DEFAULT_OUTPUT_BATCH_SIZE
+	}
+	if interval <= 0 {
+		interval = KAOHI_DEFAULT_OUTPUT_FLUSH_INTERVAL
+	}
+
+	q := &kBatchQueue{
+		queue:          make(chan *kEvent, queueSize),
+		batchSize:      batchSize,
+		interval:       interval,
+		send:           send,
+		stop:           make(chan struct{}),
+	}
+
+	q.wg.Add(1)
+	go q.run()
+
+	return q
+}
+
+// push event into queue, the event is dropped if queue is full
+func (q *kBatchQueue) Push(ev *kEvent) error {
+	select {
+	case q.queue <- ev:
+		q.addQueued(1)
+		return nil
+	default:
+		q.addDropped(1)
+		return ErrOutputQueueFull
+	}
+}
+
+func (q *kBatchQueue) Stats() kOutputStats {
+	stats := q.kOutputCounters.Stats()
+	stats.Capacity = int64(cap(q.queue))
+
+	return stats
+}
+
+// stop queue goroutine, the pending batch is sent before return
+func (q *kBatchQueue) Close() {
+	close(q.stop)
+	q.wg.Wait()
+}
+
+func (q *kBatchQueue) run() {
+	defer q.wg.Done()
+
+	ticker := time.NewTicker(q.interval)
+	defer ticker.Stop()
+
+	batch := make([]*kEvent, 0, q.batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		start := time.Now()
+		q.send(batch)
+		q.observeLatency(time.Since(start))
+		q.addQueued(-int64(len(batch)))
+		batch = make([]*kEvent, 0, q.batchSize)
+	}
+
+	for {
+		select {
+		case <-q.stop:
+			flush()
+			return
+
+		case ev := <-q.queue:
+			batch = append(batch, ev)
+			if len(batch) >= q.batchSize {
+				flush()
+			}
+
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// kaohi outputs structure
+type KaohiOutputs struct {
+	mu             sync.RWMutex
+	outputs        []kOutput
+}
+
+// global variable for outputs
+var kOutputs KaohiOutputs
+
+// create output of configuration entry
+func newOutput(entry kConfigEntry) (kOutput, error) {
+	switch cfg := entry.Config.(type) {
+	case kSyslogOutputConfig:
+		return NewSyslogOutput(cfg)
+	case kHTTPOutputConfig:
+		return NewHTTPOutput(cfg)
+	case kElasticOutputConfig:
+		return NewElasticOutput(cfg)
+	case kKafkaOutputConfig:
+		return NewKafkaOutput(cfg)
+	case kFileOutputConfig:
+		return NewFileOutput(cfg)
+	}
+
+	return nil, ErrConfigInvalid
+}
+
+// create outputs from configuration
+func newOutputsFromConfig(config *kConfigScheme) ([]kOutput, error) {
+	return reconcileOutputs(nil, config)
+}
+
+// create outputs of configuration, the running outputs whose configuration
+// is not changed from old configuration are taken over with their queues
+func reconcileOutputs(old *kConfigScheme, config *kConfigScheme) ([]kOutput, error) {
+	var outputs []kOutput
+	var created []kOutput
+
+	running := make(map[string]kOutput)
+	if old != nil {
+		for _, out := range GetOutputs() {
+			running[out.Type() + "/" + out.Name()] = out
+		}
+	}
+	changed := changedConfigEntries(old, config)
+
+	for _, entry := range configEntries(config) {
+		if entry.Kind != "output" {
+			continue
+		}
+
+		key := entry.Type + "/" + entry.Name
+		if out, ok := running[key]; ok && !changed[key] {
+			outputs = append(outputs, out)
+			continue
+		}
+
+		out, err := newOutput(entry)
+		if err != nil {
+			closeOutputs(created)
+			return nil, err
+		}
+		outputs = append(outputs, out)
+		created = append(created, out)
+	}
+
+	return outputs, nil
+}
+
+// get outputs which are not contained in the list
+func outputsNotIn(outputs []kOutput, list []kOutput) []kOutput {
+	var rest []kOutput
+
+	for _, out := range outputs {
+		found := false
+		for _, o := range list {
+			if o == out {
+				found = true
+				break
+			}
+		}
+		if !found {
+			rest = append(rest, out)
+		}
+	}
+
+	return rest
+}
+
+// close list of outputs
+func closeOutputs(outputs []kOutput) {
+	for _, out := range outputs {
+		out.Close()
+	}
+}
+
+// send event to all outputs and tail subscribers
+func EmitEvent(ev *kEvent) {
+	publishTailEvent(ev)
+
+	kOutputs.mu.RLock()
+	defer kOutputs.mu.RUnlock()
+
+	for _, out := range kOutputs.outputs {
+		out.Write(ev)
+	}
+}
+
+// get list of outputs
+func GetOutputs() []kOutput {
+	kOutputs.mu.RLock()
+	defer kOutputs.mu.RUnlock()
+
+	return append([]kOutput{}, kOutputs.outputs...)
+}
+
+// replace running outputs, the old ones are flushed and closed
+func replaceOutputs(outputs []kOutput) {
+	retireOutputs(swapOutputs(outputs))
+}
+
+// swap running outputs and return previous ones which are still open
+func swapOutputs(outputs []kOutput) []kOutput {
+	kOutputs.mu.Lock()
+	old := kOutputs.outputs
+	kOutputs.outputs = outputs
+	kOutputs.mu.Unlock()
+
+	return old
+}
+
+// flush and close outputs which were swapped out
+func retireOutputs(outputs []kOutput) {
+	for _, out := range outputs {
+		if err := out.Flush(KAOHI_DEFAULT_OUTPUT_FLUSH_TIMEOUT); err != nil {
+			DEBUG_WARN("Could not flush output '%s': %v", out.Name(), err)
+		}
+		out.Close()
+	}
+}
+
+// build TLS client configuration
+func newOutputTLSConfig(cfg kTLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.SkipVerify,
+	}
+
+	if cfg.CAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, ErrInvalidCACert
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// init kaohi outputs
+func InitKaohiOutputs(ctx *kContext) error {
+	DEBUG_INFO("Initializing Kaohi outputs")
+
+	outputs, err := newOutputsFromConfig(ctx.config)
+	if err != nil {
+		return err
+	}
+
+	replaceOutputs(outputs)
+
+	return nil
+}
+
+// finalize kaohi outputs
+func FinalizeKaohiOutputs(deadline time.Time) bool {
+	DEBUG_INFO("Finalizing Kaohi outputs")
+
+	outputs := swapOutputs(nil)
+	results := make(chan bool, len(outputs))
+
+	for _, out := range outputs {
+		go func(out kOutput) {
+			results <- drainOutput(out, deadline)
+		}(out)
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	delivered := true
+	for range outputs {
+		select {
+		case ok := <-results:
+			delivered = delivered && ok
+
+		case <-timer.C:
+			DEBUG_WARN("Could not drain outputs until shutdown deadline")
+			return false
+		}
+	}
+
+	return delivered
+}
+
+// flush queued events of output until deadline and close it, returns false
+// if some events were not delivered
+func drainOutput(out kOutput, deadline time.Time) bool {
+	before := out.Stats()
+
+	delivered := true
+	if err := out.Flush(time.Until(deadline)); err != nil {
+		DEBUG_WARN("Could not flush output '%s': %v", out.Name(), err)
+		delivered = false
+	}
+	out.Close()
+
+	after := out.Stats()
+	if after.Queued > 0 || after.Failed > before.Failed || after.Dropped > before.Dropped {
+		DEBUG_WARN("Output '%s' could not deliver %d event(s)", out.Name(),
+			uint64(after.Queued) + after.Failed - before.Failed + after.Dropped - before.Dropped)
+		delivered = false
+	}
+
+	return delivered
+}
@@ -0,0 +1,271 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// elasticsearch output structure
+type kElasticOutput struct {
+	name           string
+	bulkURL        string
+	index          string
+	idFromHash     bool
+	compression    string
+	sender         *kHTTPSender
+	deadLetter     *kDeadLetter
+	queue          *kBatchQueue
+}
+
+// bulk action metadata
+type kBulkAction struct {
+	Index          string             `json:"_index"`
+	ID             string             `json:"_id,omitempty"`
+}
+
+// bulk response structures
+type kBulkResponse struct {
+	Errors         bool                              `json:"errors"`
+	Items          []map[string]kBulkResponseItem    `json:"items"`
+}
+
+type kBulkResponseItem struct {
+	Status         int                `json:"status"`
+	Error          json.RawMessage    `json:"error"`
+}
+
+// create elasticsearch output
+func NewElasticOutput(cfg kElasticOutputConfig) (*kElasticOutput, error) {
+	if cfg.URL == "" {
+		return nil, ErrElasticNoURL
+	}
+
+	switch cfg.Compression {
+	case "", "none", "gzip":
+	default:
+		return nil, ErrUnknownCompression
+	}
+
+	index := cfg.Index
+	if index == "" {
+		index = KAOHI_DEFAULT_ELASTIC_INDEX
+	}
+
+	sender, err := newHTTPSender(cfg.TLS, cfg.Timeout, nil, cfg.Username, cfg.Password,
+		cfg.BearerToken, cfg.MaxRetries, cfg.RetryInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	deadLetter, err := NewDeadLetter(cfg.DeadLetterFile)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &kElasticOutput{
+		name:           cfg.Name,
+		bulkURL:        strings.TrimRight(cfg.URL, "/") + "/_bulk",
+		index:          index,
+		idFromHash:     cfg.IDFromHash,
+		compression:    cfg.Compression,
+		sender:         sender,
+		deadLetter:     deadLetter,
+	}
+	out.queue = newBatchQueue(cfg.QueueSize, cfg.BatchSize,
+		time.Duration(cfg.FlushInterval) * time.Second, out.sendBatch)
+	sender.counters = &out.queue.kOutputCounters
+
+	DEBUG_INFO("Created elasticsearch output '%s' for %s", out.name, cfg.URL)
+
+	return out, nil
+}
+
+func (out *kElasticOutput) Name() string {
+	return out.name
+}
+
+func (out *kElasticOutput) Type() string {
+	return "elasticsearch"
+}
+
+func (out *kElasticOutput) Write(ev *kEvent) error {
+	return out.queue.Push(ev)
+}
+
+func (out *kElasticOutput) Flush(timeout time.Duration) error {
+	return out.queue.waitDrained(timeout)
+}
+
+func (out *kElasticOutput) Stats() kOutputStats {
+	stats := out.queue.Stats()
+	stats.DiskUsage = out.deadLetter.Size()
+
+	return stats
+}
+
+func (out *kElasticOutput) Close() {
+	out.sender.Close()
+	out.queue.Close()
+}
+
+// build _bulk request body
+func (out *kElasticOutput) encodeBulk(batch []*kEvent) ([]byte, error) {
+	var buf bytes.Buffer
+
+	enc := json.NewEncoder(&buf)
+	for _, ev := range batch {
+		action := kBulkAction{Index: sanitizeIndexName(expandEventTemplate(out.index, ev))}
+		if out.idFromHash {
+			action.ID = ev.Hash()
+		}
+
+		if err := enc.Encode(map[string]kBulkAction{"index": action}); err != nil {
+			return nil, err
+		}
+		if err := enc.Encode(ev.ToMap()); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// make expanded index name valid: lowercase, without the characters which
+// aren't allowed in index names and without leading '-', '_' or '+'
+func sanitizeIndexName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(ELASTIC_INDEX_INVALID_CHARS, r) {
+			return -1
+		}
+		return r
+	}, strings.ToLower(name))
+
+	return strings.TrimLeft(name, "-_+")
+}
+
+// send batch with _bulk API, the items failed with retryable status are
+// sent again and the others are written into dead-letter file
+func (out *kElasticOutput) sendBatch(batch []*kEvent) {
+	for attempt := 0; len(batch) > 0; attempt++ {
+		retry, err := out.sendBulk(batch)
+		if err != nil {
+			out.reject(batch, err.Error())
+			return
+		}
+		if len(retry) == 0 {
+			return
+		}
+
+		if out.sender.maxRetries > 0 && attempt >= out.sender.maxRetries {
+			out.reject(retry, "retries of bulk items have been exhausted")
+			return
+		}
+
+		wait := out.sender.retryInterval << uint(attempt)
+		if wait > KAOHI_HTTP_MAX_RETRY_WAIT || wait <= 0 {
+			wait = KAOHI_HTTP_MAX_RETRY_WAIT
+		}
+		DEBUG_WARN("Retrying %d bulk item(s) of output '%s' in %v", len(retry), out.name, wait)
+
+		select {
+		case <-out.sender.stop:
+			out.reject(retry, "output was closed while retrying bulk items")
+			return
+		case <-time.After(wait):
+		}
+		out.queue.addRetries(1)
+
+		batch = retry
+	}
+}
+
+// send single _bulk request and return the events to be retried
+func (out *kElasticOutput) sendBulk(batch []*kEvent) ([]*kEvent, error) {
+	body, err := out.encodeBulk(batch)
+	if err != nil {
+		return nil, err
+	}
+
+	contentEncoding := ""
+	if out.compression == "gzip" {
+		if body, err = gzipBody(body); err != nil {
+			return nil, err
+		}
+		contentEncoding = "gzip"
+	}
+
+	status, respBody, err := out.sender.Send("POST", out.bulkURL, "application/x-ndjson", contentEncoding, body)
+	if err != nil {
+		return nil, fmt.Errorf("status %d: %v", status, err)
+	}
+
+	var resp kBulkResponse
+	if err := json.Unmarshal(respBody, &resp); err != nil {
+		return nil, ErrElasticInvalidResponse
+	}
+	if !resp.Errors {
+		out.queue.addSent(len(batch))
+		return nil, nil
+	}
+	if len(resp.Items) != len(batch) {
+		return nil, ErrElasticInvalidResponse
+	}
+
+	// check result of each item
+	var retry []*kEvent
+	for i, item := range resp.Items {
+		var result kBulkResponseItem
+		for _, r := range item {
+			result = r
+		}
+
+		switch {
+		case result.Status >= 200 && result.Status < 300:
+			out.queue.addSent(1)
+
+		case isRetryableHTTPStatus(result.Status):
+			retry = append(retry, batch[i])
+
+		default:
+			out.reject(batch[i:i + 1], fmt.Sprintf("status %d: %s", result.Status, string(result.Error)))
+		}
+	}
+
+	return retry, nil
+}
+
+// write rejected events into dead-letter file
+func (out *kElasticOutput) reject(batch []*kEvent, reason string) {
+	out.queue.addFailed(len(batch))
+	if err := out.deadLetter.Write(out.name, reason, batch); err != nil {
+		DEBUG_ERR("Could not write dead-letter file of output '%s': %v", out.name, err)
+	}
+}
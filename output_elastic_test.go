@@ -0,0 +1,240 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// _bulk endpoint which answers every item with status chosen by id field
+// of its document, "retry" items fail with 429 on their first attempt
+type kTestBulkServer struct {
+	*httptest.Server
+
+	mu             sync.Mutex
+	requests       [][]kBulkAction
+	attempts       map[string]int
+}
+
+func newTestBulkServer(t *testing.T) *kTestBulkServer {
+	s := &kTestBulkServer{attempts: make(map[string]int)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_bulk" {
+			t.Errorf("request to %s", r.URL.Path)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		var actions []kBulkAction
+		var items []map[string]interface{}
+		errors := false
+
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		for scanner.Scan() {
+			var action map[string]kBulkAction
+			if err := json.Unmarshal(scanner.Bytes(), &action); err != nil || !scanner.Scan() {
+				t.Errorf("invalid bulk body: %s", body)
+				return
+			}
+			var doc struct {
+				Fields map[string]string `json:"fields"`
+			}
+			if err := json.Unmarshal(scanner.Bytes(), &doc); err != nil {
+				t.Errorf("invalid document: %s", scanner.Text())
+				return
+			}
+			actions = append(actions, action["index"])
+
+			id := doc.Fields["id"]
+			s.attempts[id]++
+
+			item := map[string]interface{}{"status": 201}
+			switch {
+			case id == "bad":
+				item = map[string]interface{}{"status": 400,
+					"error": map[string]string{"type": "mapper_parsing_exception"}}
+			case id == "busy" || (id == "retry" && s.attempts[id] == 1):
+				item = map[string]interface{}{"status": 429,
+					"error": map[string]string{"type": "es_rejected_execution_exception"}}
+			}
+			if item["status"] != 201 {
+				errors = true
+			}
+			items = append(items, map[string]interface{}{"index": item})
+		}
+		s.requests = append(s.requests, actions)
+
+		json.NewEncoder(w).Encode(map[string]interface{}{"errors": errors, "items": items})
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func newTestElasticOutput(t *testing.T, cfg kElasticOutputConfig) *kElasticOutput {
+	cfg.Name = "test"
+	cfg.DeadLetterFile = filepath.Join(t.TempDir(), "elastic.dead")
+
+	out, err := NewElasticOutput(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.sender.retryInterval = time.Millisecond
+	t.Cleanup(out.Close)
+
+	return out
+}
+
+func readDeadLetter(t *testing.T, path string) []kDeadLetterRecord {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+
+	var records []kDeadLetterRecord
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for dec.More() {
+		var rec kDeadLetterRecord
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+
+	return records
+}
+
+func TestElasticRetriesFailedItemsOnly(t *testing.T) {
+	server := newTestBulkServer(t)
+	out := newTestElasticOutput(t, kElasticOutputConfig{URL: server.URL + "/", Index: "kaohi-%{group}", MaxRetries: 3})
+
+	out.sendBatch(newTestBatch("ok", "retry", "bad"))
+
+	if len(server.requests) != 2 {
+		t.Fatalf("%d bulk requests, expected 2", len(server.requests))
+	}
+	if len(server.requests[0]) != 3 || server.requests[0][0].Index != "kaohi-test" {
+		t.Fatalf("unexpected first request: %+v", server.requests[0])
+	}
+	if len(server.requests[1]) != 1 || server.attempts["retry"] != 2 || server.attempts["ok"] != 1 {
+		t.Fatalf("unexpected retry: %+v, attempts %v", server.requests[1], server.attempts)
+	}
+
+	records := readDeadLetter(t, out.deadLetter.path)
+	if len(records) != 1 || records[0].Output != "test" ||
+		!strings.Contains(records[0].Reason, "400") || !strings.Contains(records[0].Reason, "mapper_parsing_exception") {
+		t.Fatalf("unexpected dead-letter records: %+v", records)
+	}
+	if fields, _ := records[0].Event["fields"].(map[string]interface{}); fields["id"] != "bad" {
+		t.Fatalf("unexpected dead-letter event: %v", records[0].Event)
+	}
+
+	if stats := out.Stats(); stats.Sent != 2 || stats.Failed != 1 || stats.Retries != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestElasticDeadLettersExhaustedItems(t *testing.T) {
+	server := newTestBulkServer(t)
+	out := newTestElasticOutput(t, kElasticOutputConfig{URL: server.URL, MaxRetries: 2})
+
+	out.sendBatch(newTestBatch("ok", "busy"))
+
+	if n := server.attempts["busy"]; n != 3 {
+		t.Fatalf("busy item was sent %d times, expected 3", n)
+	}
+
+	records := readDeadLetter(t, out.deadLetter.path)
+	if len(records) != 1 || !strings.Contains(records[0].Reason, "exhausted") {
+		t.Fatalf("unexpected dead-letter records: %+v", records)
+	}
+	if stats := out.Stats(); stats.Sent != 1 || stats.Failed != 1 || stats.Retries != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestElasticIDFromHash(t *testing.T) {
+	server := newTestBulkServer(t)
+	out := newTestElasticOutput(t, kElasticOutputConfig{URL: server.URL, IDFromHash: true})
+
+	batch := newTestBatch("a", "a")
+	batch[1].Time = batch[0].Time
+	out.sendBatch(batch)
+
+	actions := server.requests[0]
+	if actions[0].ID == "" || actions[0].ID != batch[0].Hash() || actions[0].ID != actions[1].ID {
+		t.Fatalf("unexpected ids: %+v", actions)
+	}
+	if actions[0].Index != expandEventTemplate(KAOHI_DEFAULT_ELASTIC_INDEX, batch[0]) {
+		t.Fatalf("unexpected index %q", actions[0].Index)
+	}
+	if stats := out.Stats(); stats.Sent != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestSanitizeIndexName(t *testing.T) {
+	for _, c := range []struct {
+		name, expected string
+	}{
+		{"kaohi-2023.10.06", "kaohi-2023.10.06"},
+		{"Kaohi-WebServers", "kaohi-webservers"},
+		{"kaohi-a/b\\c*d?e\"f<g>h|i,j#k l", "kaohi-abcdefghijkl"},
+		{"-_+kaohi", "kaohi"},
+		{"_-/+kaohi-_", "kaohi-_"},
+	} {
+		if name := sanitizeIndexName(c.name); name != c.expected {
+			t.Errorf("%q sanitized to %q", c.name, name)
+		}
+	}
+}
+
+func TestElasticIndexIsSanitized(t *testing.T) {
+	server := newTestBulkServer(t)
+	out := newTestElasticOutput(t, kElasticOutputConfig{URL: server.URL, Index: "%{group}-%{host}"})
+
+	batch := newTestBatch("a")
+	batch[0].Group = "_Web/Logs"
+	batch[0].Host = "Node#1"
+	out.sendBatch(batch)
+
+	if index := server.requests[0][0].Index; index != "weblogs-node1" {
+		t.Fatalf("unexpected index %q", index)
+	}
+}
@@ -0,0 +1,456 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// file output constants
+const (
+	FILE_OUTPUT_ROTATED_SUFFIX    = "20060102-150405.000000000"
+	FILE_OUTPUT_IDLE_TIMEOUT      = 5 * time.Minute
+)
+
+// file output structure
+type kFileOutput struct {
+	name           string
+	path           string
+	format         string
+	maxSize        int64
+	rotateInterval time.Duration
+	compression    string
+	maxFiles       int
+	maxAge         time.Duration
+	files          map[string]*kRotatingFile
+	started        map[string]time.Time
+	rotatedMu      sync.Mutex
+	compressWg     sync.WaitGroup
+	queue          *kBatchQueue
+}
+
+// opened output file
+type kRotatingFile struct {
+	path           string
+	file           *os.File
+	writer         *bufio.Writer
+	size           int64
+	startedAt      time.Time
+	lastWrite      time.Time
+}
+
+// create file output
+func NewFileOutput(cfg kFileOutputConfig) (*kFileOutput, error) {
+	if cfg.Path == "" {
+		return nil, ErrFileOutputNoPath
+	}
+
+	switch cfg.Format {
+	case "", "json", "raw":
+	default:
+		return nil, ErrFileOutputInvalidFormat
+	}
+
+	switch cfg.Compression {
+	case "", "none", "gzip", "zstd":
+	default:
+		return nil, ErrUnknownCompression
+	}
+
+	out := &kFileOutput{
+		name:           cfg.Name,
+		path:           cfg.Path,
+		format:         cfg.Format,
+		maxSize:        int64(cfg.MaxSize) * 1024 * 1024,
+		rotateInterval: time.Duration(cfg.RotateInterval) * time.Second,
+		compression:    cfg.Compression,
+		maxFiles:       cfg.MaxFiles,
+		maxAge:         time.Duration(cfg.MaxAge) * 24 * time.Hour,
+		files:          make(map[string]*kRotatingFile),
+		started:        make(map[string]time.Time),
+	}
+	if out.format == "" {
+		out.format = "json"
+	}
+
+	flushInterval := time.Duration(cfg.FlushInterval) * time.Second
+	if flushInterval <= 0 {
+		flushInterval = KAOHI_DEFAULT_FILE_FLUSH_INTERVAL
+	}
+	out.queue = newBatchQueue(cfg.QueueSize, cfg.BatchSize, flushInterval, out.writeBatch)
+
+	DEBUG_INFO("Created file output '%s' for %s", out.name, out.path)
+
+	return out, nil
+}
+
+func (out *kFileOutput) Name() string {
+	return out.name
+}
+
+func (out *kFileOutput) Type() string {
+	return "file"
+}
+
+func (out *kFileOutput) Write(ev *kEvent) error {
+	return out.queue.Push(ev)
+}
+
+func (out *kFileOutput) Flush(timeout time.Duration) error {
+	return out.queue.waitDrained(timeout)
+}
+
+func (out *kFileOutput) Stats() kOutputStats {
+	return out.queue.Stats()
+}
+
+func (out *kFileOutput) Close() {
+	out.queue.Close()
+
+	for path, f := range out.files {
+		f.close()
+		delete(out.files, path)
+	}
+
+	// wait for compression of rotated files
+	out.compressWg.Wait()
+}
+
+// format event as a line
+func (out *kFileOutput) formatEvent(ev *kEvent) ([]byte, error) {
+	if out.format == "raw" {
+		return []byte(ev.Message + "\n"), nil
+	}
+
+	line, err := json.Marshal(ev.ToMap())
+	if err != nil {
+		return nil, err
+	}
+
+	return append(line, '\n'), nil
+}
+
+// write batch of events, it is called from queue goroutine only
+func (out *kFileOutput) writeBatch(batch []*kEvent) {
+	for _, ev := range batch {
+		line, err := out.formatEvent(ev)
+		if err != nil {
+			out.queue.addFailed(1)
+			continue
+		}
+
+		path, err := expandPathTemplate(out.path, ev)
+		if err != nil {
+			DEBUG_ERR("Could not expand output file path of output '%s': %v", out.name, err)
+			out.queue.addFailed(1)
+			continue
+		}
+
+		f, err := out.getFile(path)
+		if err != nil {
+			DEBUG_ERR("Could not open output file of output '%s': %v", out.name, err)
+			out.queue.addFailed(1)
+			continue
+		}
+
+		if out.needRotate(f, int64(len(line))) {
+			if f, err = out.rotate(f); err != nil {
+				DEBUG_ERR("Could not rotate output file '%s': %v", path, err)
+				out.queue.addFailed(1)
+				continue
+			}
+		}
+
+		if _, err := f.writer.Write(line); err != nil {
+			DEBUG_ERR("Could not write output file '%s': %v", f.path, err)
+			out.queue.addFailed(1)
+			continue
+		}
+		f.size += int64(len(line))
+		f.lastWrite = time.Now()
+		out.queue.addSent(1)
+	}
+
+	out.maintainFiles()
+}
+
+// get opened file for path, the file is opened if needed
+func (out *kFileOutput) getFile(path string) (*kRotatingFile, error) {
+	if f, ok := out.files[path]; ok {
+		return f, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND | os.O_WRONLY | os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	f := &kRotatingFile{
+		path:           path,
+		file:           file,
+		writer:         bufio.NewWriter(file),
+		size:           stat.Size(),
+		startedAt:      out.startedAt(path),
+		lastWrite:      time.Now(),
+	}
+	out.files[path] = f
+
+	return f, nil
+}
+
+// get time the current file of path was started, it's kept when idle file
+// is closed, and it's the time of the last rotation after a restart
+func (out *kFileOutput) startedAt(path string) time.Time {
+	if t, ok := out.started[path]; ok {
+		return t
+	}
+
+	var t time.Time
+	for _, r := range rotatedFiles(path) {
+		if r.rotatedAt.After(t) {
+			t = r.rotatedAt
+		}
+	}
+	if t.IsZero() {
+		t = time.Now()
+	}
+	out.started[path] = t
+
+	return t
+}
+
+// check whether the file should be rotated before writing
+func (out *kFileOutput) needRotate(f *kRotatingFile, n int64) bool {
+	if out.maxSize > 0 && f.size > 0 && f.size + n > out.maxSize {
+		return true
+	}
+	if out.rotateInterval > 0 && time.Since(f.startedAt) >= out.rotateInterval && f.size > 0 {
+		return true
+	}
+
+	return false
+}
+
+// rotate file and return newly opened one
+func (out *kFileOutput) rotate(f *kRotatingFile) (*kRotatingFile, error) {
+	f.close()
+	delete(out.files, f.path)
+
+	now := time.Now()
+	rotated := f.path + "." + now.Format(FILE_OUTPUT_ROTATED_SUFFIX)
+	if err := os.Rename(f.path, rotated); err != nil {
+		return f, err
+	}
+	out.started[f.path] = now
+
+	DEBUG_INFO("Rotated output file '%s' to '%s'", f.path, rotated)
+
+	if out.compression == "gzip" || out.compression == "zstd" {
+		out.compressWg.Add(1)
+		go func() {
+			defer out.compressWg.Done()
+
+			out.rotatedMu.Lock()
+			defer out.rotatedMu.Unlock()
+
+			if err := compressFile(rotated, out.compression); err != nil {
+				DEBUG_ERR("Could not compress rotated file '%s': %v", rotated, err)
+			}
+			out.removeExpired(f.path)
+		}()
+	} else {
+		out.rotatedMu.Lock()
+		out.removeExpired(f.path)
+		out.rotatedMu.Unlock()
+	}
+
+	return out.getFile(f.path)
+}
+
+// flush buffers, close idle files and reopen the files which were
+// moved or removed by others
+func (out *kFileOutput) maintainFiles() {
+	for path, f := range out.files {
+		if err := f.writer.Flush(); err != nil {
+			DEBUG_ERR("Could not write output file '%s': %v", path, err)
+		}
+
+		if time.Since(f.lastWrite) > FILE_OUTPUT_IDLE_TIMEOUT {
+			f.close()
+			delete(out.files, path)
+			continue
+		}
+
+		// a file descriptor of moved file is never kept
+		pathStat, err := os.Stat(path)
+		fileStat, ferr := f.file.Stat()
+		if err != nil || ferr != nil || !os.SameFile(pathStat, fileStat) {
+			DEBUG_WARN("Output file '%s' was moved or removed, reopening", path)
+			f.close()
+			delete(out.files, path)
+		}
+	}
+}
+
+// remove rotated files exceeding retention count or age, rotatedMu must
+// be held by caller
+func (out *kFileOutput) removeExpired(path string) {
+	if out.maxFiles <= 0 && out.maxAge <= 0 {
+		return
+	}
+
+	rotated := rotatedFiles(path)
+
+	// newest first
+	sort.Slice(rotated, func(i, j int) bool {
+		return rotated[i].rotatedAt.After(rotated[j].rotatedAt)
+	})
+
+	for i, r := range rotated {
+		if (out.maxFiles > 0 && i >= out.maxFiles) || (out.maxAge > 0 && time.Since(r.modTime) > out.maxAge) {
+			DEBUG_INFO("Removing expired output file '%s'", r.path)
+			os.Remove(r.path)
+		}
+	}
+}
+
+// rotated file of output file
+type kRotatedFile struct {
+	path           string
+	rotatedAt      time.Time
+	modTime        time.Time
+}
+
+// list rotated files of path, the directory is listed rather than globbed
+// as the path is expanded from field values
+func rotatedFiles(path string) []kRotatedFile {
+	entries, err := ioutil.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return nil
+	}
+
+	prefix := filepath.Base(path) + "."
+	var rotated []kRotatedFile
+	for _, entry := range entries {
+		name := entry.Name()
+		// skip files being compressed
+		if !strings.HasPrefix(name, prefix) || strings.HasSuffix(name, ".tmp") || !entry.Mode().IsRegular() {
+			continue
+		}
+
+		suffix := name[len(prefix):]
+		if len(suffix) < len(FILE_OUTPUT_ROTATED_SUFFIX) {
+			continue
+		}
+		rotatedAt, err := time.ParseInLocation(FILE_OUTPUT_ROTATED_SUFFIX, suffix[:len(FILE_OUTPUT_ROTATED_SUFFIX)], time.Local)
+		if err != nil {
+			continue
+		}
+
+		rotated = append(rotated, kRotatedFile{
+			path:           filepath.Join(filepath.Dir(path), name),
+			rotatedAt:      rotatedAt,
+			modTime:        entry.ModTime(),
+		})
+	}
+
+	return rotated
+}
+
+func (f *kRotatingFile) close() {
+	f.writer.Flush()
+	f.file.Close()
+}
+
+// compress file with gzip or zstd and remove the original one
+func compressFile(path string, method string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dstPath := path + ".gz"
+	if method == "zstd" {
+		dstPath = path + ".zst"
+	}
+
+	tmpPath := dstPath + ".tmp"
+	dst, err := os.OpenFile(tmpPath, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+
+	var zw io.WriteCloser
+	if method == "zstd" {
+		if zw, err = zstd.NewWriter(dst); err != nil {
+			dst.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+	} else {
+		zw = gzip.NewWriter(dst)
+	}
+
+	if _, err = io.Copy(zw, src); err == nil {
+		err = zw.Close()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, dstPath); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
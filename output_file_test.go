@@ -0,0 +1,242 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func newTestFileOutput(t *testing.T, cfg kFileOutputConfig) *kFileOutput {
+	cfg.Name = "archive"
+	cfg.Format = "raw"
+	out, err := NewFileOutput(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(out.Close)
+
+	return out
+}
+
+func readTestFile(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(data)
+}
+
+// create rotated file of path which was rotated at the time
+func createRotatedFile(t *testing.T, path string, rotatedAt time.Time) string {
+	rotated := path + "." + rotatedAt.Format(FILE_OUTPUT_ROTATED_SUFFIX)
+	if err := ioutil.WriteFile(rotated, []byte("rotated\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	return rotated
+}
+
+func TestFileOutputRotatesBySizeAndCompresses(t *testing.T) {
+	for _, c := range []struct {
+		compression, ext string
+	}{
+		{"none", ""},
+		{"gzip", ".gz"},
+		{"zstd", ".zst"},
+	} {
+		dir := t.TempDir()
+		out := newTestFileOutput(t, kFileOutputConfig{Path: filepath.Join(dir, "%{group}.log"), Compression: c.compression})
+		out.maxSize = 20
+
+		out.writeBatch([]*kEvent{
+			NewKaohiEvent("web", "nginx", "first event line"),
+			NewKaohiEvent("web", "nginx", "second event line"),
+		})
+		// wait for compression of rotated file
+		out.compressWg.Wait()
+
+		path := filepath.Join(dir, "web.log")
+		if s := readTestFile(t, path); s != "second event line\n" {
+			t.Fatalf("%s: current file has %q", c.compression, s)
+		}
+
+		rotated := rotatedFiles(path)
+		if len(rotated) != 1 || len(rotated[0].path) != len(path) + len(FILE_OUTPUT_ROTATED_SUFFIX) + 1 + len(c.ext) ||
+			!strings.HasSuffix(rotated[0].path, c.ext) {
+			t.Fatalf("%s: unexpected rotated files %+v", c.compression, rotated)
+		}
+
+		f, err := os.Open(rotated[0].path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		var r io.Reader = f
+		switch c.compression {
+		case "gzip":
+			if r, err = gzip.NewReader(f); err != nil {
+				t.Fatal(err)
+			}
+		case "zstd":
+			zr, err := zstd.NewReader(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer zr.Close()
+			r = zr
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil || string(data) != "first event line\n" {
+			t.Fatalf("%s: rotated file has %q, %v", c.compression, data, err)
+		}
+	}
+}
+
+func TestFileOutputRotatesByTimeAfterIdleClose(t *testing.T) {
+	dir := t.TempDir()
+	out := newTestFileOutput(t, kFileOutputConfig{Path: filepath.Join(dir, "%{group}.log"), RotateInterval: 3600})
+	path := filepath.Join(dir, "web.log")
+
+	out.writeBatch([]*kEvent{NewKaohiEvent("web", "nginx", "first")})
+
+	// the stream writes less often than the idle timeout
+	out.files[path].lastWrite = time.Now().Add(-2 * FILE_OUTPUT_IDLE_TIMEOUT)
+	out.maintainFiles()
+	if len(out.files) != 0 {
+		t.Fatal("idle file wasn't closed")
+	}
+	out.started[path] = out.started[path].Add(-2 * time.Hour)
+
+	out.writeBatch([]*kEvent{NewKaohiEvent("web", "nginx", "second")})
+	if rotated := rotatedFiles(path); len(rotated) != 1 {
+		t.Fatalf("reopened file wasn't rotated: %+v", rotated)
+	}
+	if s := readTestFile(t, path); s != "second\n" {
+		t.Fatalf("current file has %q", s)
+	}
+}
+
+func TestFileOutputRotatesByTimeOfLastRotation(t *testing.T) {
+	dir := t.TempDir()
+	old := filepath.Join(dir, "old.log")
+	recent := filepath.Join(dir, "recent.log")
+	for _, path := range []string{old, recent} {
+		if err := ioutil.WriteFile(path, []byte("before restart\n"), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	createRotatedFile(t, old, time.Now().Add(-2 * time.Hour))
+	createRotatedFile(t, recent, time.Now().Add(-10 * time.Minute))
+
+	out := newTestFileOutput(t, kFileOutputConfig{Path: filepath.Join(dir, "%{group}.log"), RotateInterval: 3600})
+	out.writeBatch([]*kEvent{
+		NewKaohiEvent("old", "nginx", "after restart"),
+		NewKaohiEvent("recent", "nginx", "after restart"),
+	})
+
+	if rotated := rotatedFiles(old); len(rotated) != 2 {
+		t.Fatalf("file rotated 2 hours ago wasn't rotated: %+v", rotated)
+	}
+	if rotated := rotatedFiles(recent); len(rotated) != 1 {
+		t.Fatalf("file rotated 10 minutes ago was rotated: %+v", rotated)
+	}
+}
+
+func TestFileOutputRemovesExpiredFilesOfPathOnly(t *testing.T) {
+	dir := t.TempDir()
+	out := newTestFileOutput(t, kFileOutputConfig{Path: filepath.Join(dir, "%{group}.log"), MaxFiles: 2})
+
+	path := filepath.Join(dir, "web.log")
+	oldest := createRotatedFile(t, path, time.Now().Add(-3 * time.Hour))
+	createRotatedFile(t, path, time.Now().Add(-2 * time.Hour))
+	createRotatedFile(t, path, time.Now().Add(-1 * time.Hour))
+	backup := path + ".bak"
+	if err := ioutil.WriteFile(backup, []byte("backup\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	// glob metacharacters of a group don't match files of other groups
+	out.removeExpired(filepath.Join(dir, "w*.log"))
+	if rotated := rotatedFiles(path); len(rotated) != 3 {
+		t.Fatalf("files of other group were removed: %+v", rotated)
+	}
+
+	out.removeExpired(path)
+	if rotated := rotatedFiles(path); len(rotated) != 2 {
+		t.Fatalf("unexpected rotated files %+v", rotated)
+	}
+	if _, err := os.Stat(oldest); !os.IsNotExist(err) {
+		t.Fatal("oldest rotated file wasn't removed")
+	}
+	if _, err := os.Stat(backup); err != nil {
+		t.Fatal("file which isn't rotated was removed")
+	}
+}
+
+func TestFileOutputRotateFailureIsCounted(t *testing.T) {
+	dir := t.TempDir()
+	out := newTestFileOutput(t, kFileOutputConfig{Path: filepath.Join(dir, "%{group}.log")})
+	out.maxSize = 10
+
+	out.writeBatch([]*kEvent{NewKaohiEvent("web", "nginx", "first event")})
+
+	// the file is renamed, but the new one can't be opened without free
+	// file descriptors
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		t.Fatal(err)
+	}
+	none := limit
+	none.Cur = 0
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &none); err != nil {
+		t.Skip(err)
+	}
+	out.writeBatch([]*kEvent{NewKaohiEvent("web", "nginx", "second event")})
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats := out.Stats(); stats.Sent != 1 || stats.Failed != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	out.writeBatch([]*kEvent{NewKaohiEvent("web", "nginx", "third event")})
+	if s := readTestFile(t, filepath.Join(dir, "web.log")); s != "third event\n" {
+		t.Fatalf("current file has %q", s)
+	}
+}
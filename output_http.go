@@ -0,0 +1,320 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// HTTP client which retries requests on 429, 5xx and network errors
+type kHTTPSender struct {
+	client         *http.Client
+	headers        map[string]string
+	username       string
+	password       string
+	bearerToken    string
+	maxRetries     int              // negative retries forever
+	retryInterval  time.Duration
+	stop           chan struct{}
+	counters       *kOutputCounters // counts retries if set
+}
+
+// HTTP output structure
+type kHTTPOutput struct {
+	name           string
+	url            string
+	encoder        kEventEncoder
+	compression    string
+	sender         *kHTTPSender
+	deadLetter     *kDeadLetter
+	queue          *kBatchQueue
+}
+
+// create HTTP sender
+func newHTTPSender(tlsCfg kTLSConfig, timeout int, headers map[string]string,
+	username string, password string, bearerToken string, maxRetries int, retryInterval int) (*kHTTPSender, error) {
+	tlsConfig, err := newOutputTLSConfig(tlsCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if timeout <= 0 {
+		timeout = KAOHI_DEFAULT_HTTP_TIMEOUT
+	}
+	if maxRetries == 0 {
+		maxRetries = KAOHI_DEFAULT_HTTP_MAX_RETRIES
+	}
+	if retryInterval <= 0 {
+		retryInterval = KAOHI_DEFAULT_HTTP_RETRY_INTERVAL
+	}
+
+	return &kHTTPSender{
+		client:         &http.Client{
+			Timeout:        time.Duration(timeout) * time.Second,
+			Transport:      &http.Transport{
+				Proxy:              http.ProxyFromEnvironment,
+				TLSClientConfig:    tlsConfig,
+			},
+		},
+		headers:        headers,
+		username:       username,
+		password:       password,
+		bearerToken:    bearerToken,
+		maxRetries:     maxRetries,
+		retryInterval:  time.Duration(retryInterval) * time.Second,
+		stop:           make(chan struct{}),
+	}, nil
+}
+
+// check whether the status code is worth retrying
+func isRetryableHTTPStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// parse Retry-After header which is either seconds or HTTP date
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+
+	if secs, err := strconv.Atoi(value); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+
+	if t, err := http.ParseTime(value); err == nil {
+		if d := t.Sub(time.Now()); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+
+	return 0, false
+}
+
+// send single request
+func (s *kHTTPSender) do(method string, url string, contentType string, contentEncoding string,
+	body []byte) (int, []byte, http.Header, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	if s.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer " + s.bearerToken)
+	} else if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, resp.Header, err
+	}
+
+	return resp.StatusCode, respBody, resp.Header, nil
+}
+
+// send request with retries, the returned error is ErrHTTPRejected if the
+// server rejected the request permanently and ErrHTTPRetriesExhausted if
+// all retries have failed
+func (s *kHTTPSender) Send(method string, url string, contentType string, contentEncoding string,
+	body []byte) (int, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		status, respBody, header, err := s.do(method, url, contentType, contentEncoding, body)
+		if err == nil {
+			if status >= 200 && status < 300 {
+				return status, respBody, nil
+			}
+			if !isRetryableHTTPStatus(status) {
+				return status, respBody, ErrHTTPRejected
+			}
+		}
+
+		if s.maxRetries > 0 && attempt >= s.maxRetries {
+			return status, respBody, ErrHTTPRetriesExhausted
+		}
+
+		// exponential backoff unless server tells when to retry
+		wait, ok := parseRetryAfter(header.Get("Retry-After"))
+		if !ok {
+			wait = s.retryInterval << uint(attempt)
+			if wait > KAOHI_HTTP_MAX_RETRY_WAIT || wait <= 0 {
+				wait = KAOHI_HTTP_MAX_RETRY_WAIT
+			}
+		}
+
+		if err != nil {
+			DEBUG_WARN("HTTP request to %s failed: %v, retrying in %v", url, err, wait)
+		} else {
+			DEBUG_WARN("HTTP request to %s returned %d, retrying in %v", url, status, wait)
+		}
+
+		select {
+		case <-s.stop:
+			return status, respBody, ErrHTTPRetriesExhausted
+		case <-time.After(wait):
+		}
+		if s.counters != nil {
+			s.counters.addRetries(1)
+		}
+	}
+}
+
+// stop waiting for retries
+func (s *kHTTPSender) Close() {
+	close(s.stop)
+}
+
+// create HTTP output
+func NewHTTPOutput(cfg kHTTPOutputConfig) (*kHTTPOutput, error) {
+	if cfg.URL == "" {
+		return nil, ErrHTTPNoURL
+	}
+
+	encoder, err := NewEventEncoder(cfg.Encoder)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cfg.Compression {
+	case "", "none", "gzip":
+	default:
+		return nil, ErrUnknownCompression
+	}
+
+	sender, err := newHTTPSender(cfg.TLS, cfg.Timeout, cfg.Headers, cfg.Username, cfg.Password,
+		cfg.BearerToken, cfg.MaxRetries, cfg.RetryInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	deadLetter, err := NewDeadLetter(cfg.DeadLetterFile)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &kHTTPOutput{
+		name:           cfg.Name,
+		url:            cfg.URL,
+		encoder:        encoder,
+		compression:    cfg.Compression,
+		sender:         sender,
+		deadLetter:     deadLetter,
+	}
+	out.queue = newBatchQueue(cfg.QueueSize, cfg.BatchSize,
+		time.Duration(cfg.FlushInterval) * time.Second, out.sendBatch)
+	sender.counters = &out.queue.kOutputCounters
+
+	DEBUG_INFO("Created HTTP output '%s' for %s", out.name, out.url)
+
+	return out, nil
+}
+
+func (out *kHTTPOutput) Name() string {
+	return out.name
+}
+
+func (out *kHTTPOutput) Type() string {
+	return "http"
+}
+
+func (out *kHTTPOutput) Write(ev *kEvent) error {
+	return out.queue.Push(ev)
+}
+
+func (out *kHTTPOutput) Flush(timeout time.Duration) error {
+	return out.queue.waitDrained(timeout)
+}
+
+func (out *kHTTPOutput) Stats() kOutputStats {
+	stats := out.queue.Stats()
+	stats.DiskUsage = out.deadLetter.Size()
+
+	return stats
+}
+
+func (out *kHTTPOutput) Close() {
+	out.sender.Close()
+	out.queue.Close()
+}
+
+// encode and post batch of events
+func (out *kHTTPOutput) sendBatch(batch []*kEvent) {
+	body, err := out.encoder.Encode(batch)
+	if err != nil {
+		out.reject(batch, fmt.Sprintf("encoding failed: %v", err))
+		return
+	}
+
+	contentEncoding := ""
+	if out.compression == "gzip" {
+		if body, err = gzipBody(body); err != nil {
+			out.reject(batch, fmt.Sprintf("compression failed: %v", err))
+			return
+		}
+		contentEncoding = "gzip"
+	}
+
+	status, _, err := out.sender.Send("POST", out.url, out.encoder.ContentType(), contentEncoding, body)
+	if err == ErrHTTPRejected {
+		out.reject(batch, fmt.Sprintf("status %d: %v", status, err))
+		return
+	}
+	if err != nil {
+		// only permanently rejected batches are dead-lettered, a batch
+		// which could still be delivered is counted as failed
+		out.queue.addFailed(len(batch))
+		DEBUG_ERR("Could not deliver %d events of output '%s': %v", len(batch), out.name, err)
+		return
+	}
+
+	out.queue.addSent(len(batch))
+}
+
+// write rejected batch into dead-letter file
+func (out *kHTTPOutput) reject(batch []*kEvent, reason string) {
+	out.queue.addFailed(len(batch))
+	if err := out.deadLetter.Write(out.name, reason, batch); err != nil {
+		DEBUG_ERR("Could not write dead-letter file of output '%s': %v", out.name, err)
+	}
+}
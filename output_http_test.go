@@ -0,0 +1,261 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// HTTP server which answers requests with the given statuses in order and
+// keeps the requests it received
+type kTestHTTPServer struct {
+	*httptest.Server
+
+	mu             sync.Mutex
+	statuses       []int
+	requests       []*http.Request
+	bodies         [][]byte
+}
+
+func newTestHTTPServer(t *testing.T, statuses ...int) *kTestHTTPServer {
+	s := &kTestHTTPServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+
+		s.mu.Lock()
+		status := http.StatusOK
+		if n := len(s.requests); n < len(s.statuses) {
+			status = s.statuses[n]
+		} else if len(s.statuses) > 0 {
+			status = s.statuses[len(s.statuses) - 1]
+		}
+		s.requests = append(s.requests, r)
+		s.bodies = append(s.bodies, body)
+		s.mu.Unlock()
+
+		if status == http.StatusTooManyRequests || status >= 500 {
+			w.Header().Set("Retry-After", "0")
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *kTestHTTPServer) requestCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.requests)
+}
+
+func newTestHTTPOutput(t *testing.T, cfg kHTTPOutputConfig) *kHTTPOutput {
+	cfg.Name = "test"
+	cfg.DeadLetterFile = filepath.Join(t.TempDir(), "http.dead")
+
+	out, err := NewHTTPOutput(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(out.Close)
+
+	return out
+}
+
+func TestHTTPRetriesOn429And5xx(t *testing.T) {
+	server := newTestHTTPServer(t, http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusOK)
+	out := newTestHTTPOutput(t, kHTTPOutputConfig{URL: server.URL, MaxRetries: 3, RetryInterval: 3600})
+
+	start := time.Now()
+	out.sendBatch(newTestBatch("a", "b"))
+
+	// Retry-After: 0 must be honoured instead of the retry interval
+	if elapsed := time.Since(start); elapsed > 10 * time.Second {
+		t.Fatalf("retries took %v, Retry-After was ignored", elapsed)
+	}
+	if n := server.requestCount(); n != 3 {
+		t.Fatalf("%d requests, expected 3", n)
+	}
+	if stats := out.Stats(); stats.Sent != 2 || stats.Failed != 0 || stats.Retries != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestHTTPRejectedStatusIsNotRetried(t *testing.T) {
+	server := newTestHTTPServer(t, http.StatusBadRequest)
+	out := newTestHTTPOutput(t, kHTTPOutputConfig{URL: server.URL, MaxRetries: 3})
+
+	out.sendBatch(newTestBatch("a", "b"))
+
+	if n := server.requestCount(); n != 1 {
+		t.Fatalf("%d requests, expected 1", n)
+	}
+	if stats := out.Stats(); stats.Sent != 0 || stats.Failed != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if n := countLines(t, out.deadLetter.path); n != 2 {
+		t.Fatalf("%d dead-letter records, expected 2", n)
+	}
+}
+
+func TestHTTPRetriesAreBounded(t *testing.T) {
+	server := newTestHTTPServer(t, http.StatusInternalServerError)
+	out := newTestHTTPOutput(t, kHTTPOutputConfig{URL: server.URL, MaxRetries: 2})
+
+	out.sendBatch(newTestBatch("a"))
+
+	if n := server.requestCount(); n != 3 {
+		t.Fatalf("%d requests, expected 3", n)
+	}
+	if stats := out.Stats(); stats.Failed != 1 || stats.Retries != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if size := out.deadLetter.Size(); size != 0 {
+		t.Fatalf("retryable batch was dead-lettered, %d bytes", size)
+	}
+}
+
+func TestHTTPCloseAbortsRetriesWithoutDeadLetter(t *testing.T) {
+	server := newTestHTTPServer(t, http.StatusServiceUnavailable)
+	out, err := NewHTTPOutput(kHTTPOutputConfig{Name: "test", URL: server.URL, MaxRetries: -1,
+		DeadLetterFile: filepath.Join(t.TempDir(), "http.dead")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := out.Write(newTestBatch("a")[0]); err != nil {
+		t.Fatal(err)
+	}
+	for server.requestCount() < 3 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	out.Close()
+
+	if stats := out.Stats(); stats.Sent != 0 || stats.Failed != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if size := out.deadLetter.Size(); size != 0 {
+		t.Fatalf("retryable batch was dead-lettered, %d bytes", size)
+	}
+}
+
+func TestHTTPGzipNDJSON(t *testing.T) {
+	server := newTestHTTPServer(t)
+	out := newTestHTTPOutput(t, kHTTPOutputConfig{URL: server.URL, Encoder: "ndjson", Compression: "gzip"})
+
+	out.sendBatch(newTestBatch("a", "b"))
+
+	if n := server.requestCount(); n != 1 {
+		t.Fatalf("%d requests, expected 1", n)
+	}
+	req := server.requests[0]
+	if ct := req.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Fatalf("Content-Type %q", ct)
+	}
+	if ce := req.Header.Get("Content-Encoding"); ce != "gzip" {
+		t.Fatalf("Content-Encoding %q", ce)
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(server.bodies[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var messages []string
+	scanner := bufio.NewScanner(zr)
+	for scanner.Scan() {
+		var m map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			t.Fatalf("invalid line %q: %v", scanner.Text(), err)
+		}
+		messages = append(messages, m["message"].(string))
+	}
+	if len(messages) != 2 || messages[0] != "message a" || messages[1] != "message b" {
+		t.Fatalf("unexpected messages: %v", messages)
+	}
+}
+
+func TestHTTPJSONArray(t *testing.T) {
+	server := newTestHTTPServer(t)
+	out := newTestHTTPOutput(t, kHTTPOutputConfig{URL: server.URL, Encoder: "json"})
+
+	out.sendBatch(newTestBatch("a", "b"))
+
+	req := server.requests[0]
+	if ct := req.Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("Content-Type %q", ct)
+	}
+	if ce := req.Header.Get("Content-Encoding"); ce != "" {
+		t.Fatalf("Content-Encoding %q", ce)
+	}
+
+	var arr []map[string]interface{}
+	if err := json.Unmarshal(server.bodies[0], &arr); err != nil {
+		t.Fatal(err)
+	}
+	if len(arr) != 2 || arr[1]["message"] != "message b" {
+		t.Fatalf("unexpected body: %s", server.bodies[0])
+	}
+	if fields, ok := arr[0]["fields"].(map[string]interface{}); !ok || fields["id"] != "a" {
+		t.Fatalf("unexpected fields: %v", arr[0]["fields"])
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if d, ok := parseRetryAfter("120"); !ok || d != 120 * time.Second {
+		t.Fatalf("seconds: %v %v", d, ok)
+	}
+
+	date := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if d, ok := parseRetryAfter(date); !ok || d < 59 * time.Minute || d > time.Hour {
+		t.Fatalf("date: %v %v", d, ok)
+	}
+
+	past := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	if d, ok := parseRetryAfter(past); !ok || d != 0 {
+		t.Fatalf("past date: %v %v", d, ok)
+	}
+
+	for _, value := range []string{"", "-1", "soon"} {
+		if _, ok := parseRetryAfter(value); ok {
+			t.Fatalf("%q was accepted", value)
+		}
+	}
+}
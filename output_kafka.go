@@ -0,0 +1,437 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// kafka producer interface, it is satisfied by sarama.SyncProducer and
+// can be replaced with a mock producer
+type kKafkaProducer interface {
+	SendMessages(msgs []*sarama.ProducerMessage) error
+	Close() error
+}
+
+// kafka output structure
+type kKafkaOutput struct {
+	name           string
+	topic          string
+	keyField       string
+	producer       kKafkaProducer
+	maxRetries     int
+	retryInterval  time.Duration
+	deadLetter     *kDeadLetter
+	spool          *kSpool
+	queue          *kBatchQueue
+	stop           chan struct{}
+	wg             sync.WaitGroup
+}
+
+// build sarama configuration from output configuration
+func newKafkaConfig(cfg kKafkaOutputConfig) (*sarama.Config, error) {
+	config := sarama.NewConfig()
+
+	config.ClientID = cfg.ClientID
+	if config.ClientID == "" {
+		config.ClientID = KAOHI_DEFAULT_KAFKA_CLIENT_ID
+	}
+
+	if cfg.Version != "" {
+		version, err := sarama.ParseKafkaVersion(cfg.Version)
+		if err != nil {
+			return nil, err
+		}
+		config.Version = version
+	}
+
+	switch cfg.Acks {
+	case "", "all":
+		config.Producer.RequiredAcks = sarama.WaitForAll
+	case "leader":
+		config.Producer.RequiredAcks = sarama.WaitForLocal
+	case "none":
+		config.Producer.RequiredAcks = sarama.NoResponse
+	default:
+		return nil, ErrKafkaInvalidAcks
+	}
+
+	switch cfg.Compression {
+	case "", "none":
+		config.Producer.Compression = sarama.CompressionNone
+	case "gzip":
+		config.Producer.Compression = sarama.CompressionGZIP
+	case "snappy":
+		config.Producer.Compression = sarama.CompressionSnappy
+	case "lz4":
+		config.Producer.Compression = sarama.CompressionLZ4
+	case "zstd":
+		config.Producer.Compression = sarama.CompressionZSTD
+	default:
+		return nil, ErrUnknownCompression
+	}
+
+	switch cfg.Partitioner {
+	case "", "hash":
+		config.Producer.Partitioner = sarama.NewHashPartitioner
+	case "random":
+		config.Producer.Partitioner = sarama.NewRandomPartitioner
+	case "roundrobin":
+		config.Producer.Partitioner = sarama.NewRoundRobinPartitioner
+	default:
+		return nil, ErrKafkaInvalidPartitioner
+	}
+
+	// retries are done by output itself
+	config.Producer.Retry.Max = 0
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+
+	if cfg.TLS.CAFile != "" || cfg.TLS.CertFile != "" || cfg.TLS.SkipVerify {
+		tlsConfig, err := newOutputTLSConfig(cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
+
+	return config, nil
+}
+
+// create kafka output
+func NewKafkaOutput(cfg kKafkaOutputConfig) (*kKafkaOutput, error) {
+	if len(cfg.Brokers) == 0 {
+		return nil, ErrKafkaNoBroker
+	}
+
+	config, err := newKafkaConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	producer, err := sarama.NewSyncProducer(cfg.Brokers, config)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := newKafkaOutputWithProducer(cfg, producer)
+	if err != nil {
+		producer.Close()
+		return nil, err
+	}
+
+	DEBUG_INFO("Created kafka output '%s' for topic '%s'", out.name, out.topic)
+
+	return out, nil
+}
+
+// create kafka output with given producer
+func newKafkaOutputWithProducer(cfg kKafkaOutputConfig, producer kKafkaProducer) (*kKafkaOutput, error) {
+	if cfg.Topic == "" {
+		return nil, ErrKafkaNoTopic
+	}
+
+	deadLetter, err := NewDeadLetter(cfg.DeadLetterFile)
+	if err != nil {
+		return nil, err
+	}
+
+	maxRetries := cfg.MaxRetries
+	if maxRetries < 0 {
+		return nil, ErrKafkaInvalidMaxRetries
+	}
+	if maxRetries == 0 {
+		maxRetries = KAOHI_DEFAULT_KAFKA_MAX_RETRIES
+	}
+	retryInterval := cfg.RetryInterval
+	if retryInterval <= 0 {
+		retryInterval = KAOHI_DEFAULT_HTTP_RETRY_INTERVAL
+	}
+
+	spoolDir := cfg.SpoolDir
+	if spoolDir == "" {
+		spoolDir = filepath.Join(KAOHI_DEFAULT_STATE_DIR, "kafka-" + cfg.Name)
+	}
+	spool, err := NewSpool(spoolDir)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &kKafkaOutput{
+		name:           cfg.Name,
+		topic:          cfg.Topic,
+		keyField:       cfg.KeyField,
+		producer:       producer,
+		maxRetries:     maxRetries,
+		retryInterval:  time.Duration(retryInterval) * time.Second,
+		deadLetter:     deadLetter,
+		spool:          spool,
+		stop:           make(chan struct{}),
+	}
+	out.queue = newBatchQueue(cfg.QueueSize, cfg.BatchSize,
+		time.Duration(cfg.FlushInterval) * time.Second, out.sendBatch)
+
+	out.wg.Add(1)
+	go out.retrySpool()
+
+	return out, nil
+}
+
+func (out *kKafkaOutput) Name() string {
+	return out.name
+}
+
+func (out *kKafkaOutput) Type() string {
+	return "kafka"
+}
+
+func (out *kKafkaOutput) Write(ev *kEvent) error {
+	return out.queue.Push(ev)
+}
+
+func (out *kKafkaOutput) Flush(timeout time.Duration) error {
+	return out.queue.waitDrained(timeout)
+}
+
+func (out *kKafkaOutput) Stats() kOutputStats {
+	stats := out.queue.Stats()
+	stats.DiskUsage = out.deadLetter.Size() + out.spool.Size()
+
+	return stats
+}
+
+// close output, events which still fail are kept in spool for next start
+func (out *kKafkaOutput) Close() {
+	close(out.stop)
+	out.wg.Wait()
+	out.queue.Close()
+	out.producer.Close()
+}
+
+// build producer message for event
+func (out *kKafkaOutput) newMessage(ev *kEvent) (*sarama.ProducerMessage, error) {
+	value, err := json.Marshal(ev.ToMap())
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &sarama.ProducerMessage{
+		Topic:          expandEventTemplate(out.topic, ev),
+		Value:          sarama.ByteEncoder(value),
+		Metadata:       ev,
+		Timestamp:      ev.Time,
+	}
+	if out.keyField != "" {
+		if key, ok := ev.GetField(out.keyField); ok {
+			msg.Key = sarama.StringEncoder(key)
+		}
+	}
+
+	return msg, nil
+}
+
+// produce batch of events, the events whose delivery failed are put into
+// spool and produced again by retrySpool
+func (out *kKafkaOutput) sendBatch(batch []*kEvent) {
+	msgs := make([]*sarama.ProducerMessage, 0, len(batch))
+	for _, ev := range batch {
+		msg, err := out.newMessage(ev)
+		if err != nil {
+			out.reject([]*kEvent{ev}, fmt.Sprintf("encoding failed: %v", err))
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+
+	failed, lastErr := out.produce(msgs)
+	out.spoolFailed(failed, nil, lastErr)
+}
+
+// produce spooled events periodically, waiting longer after each failure
+func (out *kKafkaOutput) retrySpool() {
+	defer out.wg.Done()
+
+	failures := 0
+	for {
+		wait := out.retryInterval << uint(failures)
+		if wait > KAOHI_HTTP_MAX_RETRY_WAIT || wait <= 0 {
+			wait = KAOHI_HTTP_MAX_RETRY_WAIT
+		}
+
+		select {
+		case <-out.stop:
+			return
+		case <-time.After(wait):
+		}
+
+		if out.produceSpooled() {
+			failures = 0
+		} else {
+			failures++
+		}
+	}
+}
+
+// produce segments of spool from the oldest one until spool is empty or
+// delivery fails, returns false if it failed
+func (out *kKafkaOutput) produceSpooled() bool {
+	for {
+		select {
+		case <-out.stop:
+			return true
+		default:
+		}
+
+		// a segment which couldn't be read is kept for next retry
+		path, records, err := out.spool.Next()
+		if err == ErrSpoolCorruptSegment {
+			continue
+		} else if err != nil {
+			DEBUG_ERR("Could not read spool of output '%s': %v", out.name, err)
+			return false
+		}
+		if path == "" {
+			return true
+		}
+
+		attempts := make(map[*kEvent]int, len(records))
+		msgs := make([]*sarama.ProducerMessage, 0, len(records))
+		for _, rec := range records {
+			msg, err := out.newMessage(rec.Event)
+			if err != nil {
+				out.reject([]*kEvent{rec.Event}, fmt.Sprintf("encoding failed: %v", err))
+				continue
+			}
+			attempts[rec.Event] = rec.Attempts
+			msgs = append(msgs, msg)
+		}
+		out.queue.addRetries(1)
+
+		// failed messages go into new segment before the old one is removed
+		failed, lastErr := out.produce(msgs)
+		out.spoolFailed(failed, attempts, lastErr)
+		if err := out.spool.Remove(path); err != nil {
+			DEBUG_ERR("Could not remove spool segment '%s' of output '%s': %v", path, out.name, err)
+			return false
+		}
+		if len(failed) > 0 {
+			return false
+		}
+	}
+}
+
+// put events of failed messages into spool, the ones which have failed
+// more than max retries times are rejected
+func (out *kKafkaOutput) spoolFailed(failed []*sarama.ProducerMessage, attempts map[*kEvent]int, lastErr error) {
+	if len(failed) == 0 {
+		return
+	}
+
+	var records []kSpoolRecord
+	var rejected []*kEvent
+	for _, ev := range kafkaMessageEvents(failed) {
+		n := attempts[ev] + 1
+		if n > out.maxRetries {
+			rejected = append(rejected, ev)
+		} else {
+			records = append(records, kSpoolRecord{Attempts: n, Event: ev})
+		}
+	}
+
+	if len(rejected) > 0 {
+		out.reject(rejected, fmt.Sprintf("delivery failed after %d retries: %v", out.maxRetries, lastErr))
+	}
+	if len(records) == 0 {
+		return
+	}
+
+	if err := out.spool.Put(records); err != nil {
+		events := make([]*kEvent, 0, len(records))
+		for _, rec := range records {
+			events = append(events, rec.Event)
+		}
+		out.reject(events, fmt.Sprintf("delivery failed: %v, could not spool: %v", lastErr, err))
+		return
+	}
+
+	DEBUG_WARN("Delivery of %d message(s) of output '%s' failed: %v, spooled for retry",
+		len(records), out.name, lastErr)
+}
+
+// produce messages and return the failed ones
+func (out *kKafkaOutput) produce(msgs []*sarama.ProducerMessage) ([]*sarama.ProducerMessage, error) {
+	if len(msgs) == 0 {
+		return nil, nil
+	}
+
+	err := out.producer.SendMessages(msgs)
+	if err == nil {
+		out.queue.addSent(len(msgs))
+		return nil, nil
+	}
+
+	perrs, ok := err.(sarama.ProducerErrors)
+	if !ok {
+		// the whole batch has failed
+		return msgs, err
+	}
+
+	failed := make([]*sarama.ProducerMessage, 0, len(perrs))
+	for _, perr := range perrs {
+		failed = append(failed, perr.Msg)
+		err = perr.Err
+	}
+	out.queue.addSent(len(msgs) - len(failed))
+
+	return failed, err
+}
+
+// get events from producer messages
+func kafkaMessageEvents(msgs []*sarama.ProducerMessage) []*kEvent {
+	events := make([]*kEvent, 0, len(msgs))
+	for _, msg := range msgs {
+		if ev, ok := msg.Metadata.(*kEvent); ok {
+			events = append(events, ev)
+		}
+	}
+
+	return events
+}
+
+// write undeliverable events into dead-letter file
+func (out *kKafkaOutput) reject(events []*kEvent, reason string) {
+	out.queue.addFailed(len(events))
+	if err := out.deadLetter.Write(out.name, reason, events); err != nil {
+		DEBUG_ERR("Could not write dead-letter file of output '%s': %v", out.name, err)
+	}
+}
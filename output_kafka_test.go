@@ -0,0 +1,238 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+// mock producer which fails messages whose key is in failKeys
+type kMockProducer struct {
+	mu             sync.Mutex
+	failKeys       map[string]bool
+	sent           []string
+}
+
+func (p *kMockProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var perrs sarama.ProducerErrors
+	for _, msg := range msgs {
+		key, _ := msg.Key.Encode()
+		if p.failKeys[string(key)] {
+			perrs = append(perrs, &sarama.ProducerError{Msg: msg, Err: errors.New("leader not available")})
+			continue
+		}
+		p.sent = append(p.sent, string(key))
+	}
+
+	if len(perrs) > 0 {
+		return perrs
+	}
+	return nil
+}
+
+func (p *kMockProducer) Close() error {
+	return nil
+}
+
+func (p *kMockProducer) setFailKeys(keys ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.failKeys = make(map[string]bool)
+	for _, key := range keys {
+		p.failKeys[key] = true
+	}
+}
+
+func (p *kMockProducer) sentKeys() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]string(nil), p.sent...)
+}
+
+func newTestKafkaOutput(t *testing.T, producer kKafkaProducer, maxRetries int) (*kKafkaOutput, string) {
+	dir := t.TempDir()
+	cfg := kKafkaOutputConfig{
+		Name:           "test",
+		Topic:          "logs",
+		KeyField:       "id",
+		MaxRetries:     maxRetries,
+		RetryInterval:  3600,
+		DeadLetterFile: filepath.Join(dir, "kafka.dead"),
+		SpoolDir:       filepath.Join(dir, "spool"),
+	}
+
+	out, err := newKafkaOutputWithProducer(cfg, producer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(out.Close)
+
+	return out, cfg.DeadLetterFile
+}
+
+func TestKafkaPartialFailureIsSpooledAndRetried(t *testing.T) {
+	producer := &kMockProducer{}
+	producer.setFailKeys("b")
+	out, _ := newTestKafkaOutput(t, producer, 3)
+
+	out.sendBatch(newTestBatch("a", "b", "c"))
+
+	if sent := producer.sentKeys(); len(sent) != 2 || sent[0] != "a" || sent[1] != "c" {
+		t.Fatalf("sent %v, expected [a c]", sent)
+	}
+	if stats := out.Stats(); stats.Sent != 2 || stats.Failed != 0 || stats.DiskUsage == 0 {
+		t.Fatalf("unexpected stats after partial failure: %+v", stats)
+	}
+
+	_, records, err := out.spool.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Attempts != 1 || records[0].Event.Fields["id"] != "b" {
+		t.Fatalf("unexpected spooled records: %+v", records)
+	}
+
+	producer.setFailKeys()
+	if !out.produceSpooled() {
+		t.Fatal("retry of spooled events failed")
+	}
+
+	if sent := producer.sentKeys(); len(sent) != 3 || sent[2] != "b" {
+		t.Fatalf("sent %v, expected [a c b]", sent)
+	}
+	if path, _, _ := out.spool.Next(); path != "" {
+		t.Fatalf("spool segment %s wasn't removed", path)
+	}
+	if stats := out.Stats(); stats.Sent != 3 || stats.Retries != 1 {
+		t.Fatalf("unexpected stats after retry: %+v", stats)
+	}
+}
+
+func TestKafkaRetriesAreBounded(t *testing.T) {
+	producer := &kMockProducer{}
+	producer.setFailKeys("a", "b")
+	out, deadLetterFile := newTestKafkaOutput(t, producer, 2)
+
+	out.sendBatch(newTestBatch("a", "b", "c"))
+
+	// the first retry spools them again, the second one exceeds max retries
+	if out.produceSpooled() {
+		t.Fatal("retry succeeded while producer fails")
+	}
+	_, records, _ := out.spool.Next()
+	if len(records) != 2 || records[0].Attempts != 2 {
+		t.Fatalf("unexpected spooled records: %+v", records)
+	}
+
+	if out.produceSpooled() {
+		t.Fatal("retry succeeded while producer fails")
+	}
+	if path, _, _ := out.spool.Next(); path != "" {
+		t.Fatalf("spool segment %s wasn't removed", path)
+	}
+
+	if n := countLines(t, deadLetterFile); n != 2 {
+		t.Fatalf("%d dead-letter records, expected 2", n)
+	}
+	if stats := out.Stats(); stats.Sent != 1 || stats.Failed != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestKafkaSpoolSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	spool, err := NewSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := newTestBatch("a", "b")
+	if err := spool.Put([]kSpoolRecord{{Attempts: 1, Event: batch[0]}, {Attempts: 2, Event: batch[1]}}); err != nil {
+		t.Fatal(err)
+	}
+
+	spool, err = NewSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, records, err := spool.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[1].Attempts != 2 || records[1].Event.Message != "message b" ||
+		!records[0].Event.Time.Equal(batch[0].Time) {
+		t.Fatalf("unexpected records: %+v", records)
+	}
+
+	if err := spool.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if spool.Size() != 0 {
+		t.Fatal("spool isn't empty")
+	}
+}
+
+func TestKafkaCorruptSpoolSegmentIsMovedAside(t *testing.T) {
+	producer := &kMockProducer{}
+	out, _ := newTestKafkaOutput(t, producer, 3)
+
+	// the oldest segment has a valid record before the broken one
+	corrupt := filepath.Join(out.spool.dir, "00000000000000000001-000001" + SPOOL_SEGMENT_SUFFIX)
+	data := []byte("{\"attempts\":1,\"event\":{\"message\":\"message a\"}}\n{\"attempts\":\n")
+	if err := ioutil.WriteFile(corrupt, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.spool.Put([]kSpoolRecord{{Attempts: 1, Event: newTestBatch("b")[0]}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !out.produceSpooled() {
+		t.Fatal("retry of spooled events failed")
+	}
+	if keys := producer.sentKeys(); len(keys) != 1 || keys[0] != "b" {
+		t.Fatalf("unexpected sent keys: %v", keys)
+	}
+
+	kept, err := ioutil.ReadFile(strings.TrimSuffix(corrupt, SPOOL_SEGMENT_SUFFIX) + SPOOL_CORRUPT_SUFFIX)
+	if err != nil || string(kept) != string(data) {
+		t.Fatalf("corrupt segment wasn't kept: %q, %v", kept, err)
+	}
+	if path, _, _ := out.spool.Next(); path != "" {
+		t.Fatalf("spool segment %s wasn't removed", path)
+	}
+}
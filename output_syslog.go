@@ -0,0 +1,430 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// syslog output constants
+const (
+	SYSLOG_RFC5424_VERSION    = 1
+	SYSLOG_NILVALUE           = "-"
+
+	SYSLOG_MAX_HOSTNAME_LEN   = 255
+	SYSLOG_MAX_APPNAME_LEN    = 48
+	SYSLOG_MAX_PROCID_LEN     = 128
+	SYSLOG_MAX_MSGID_LEN      = 32
+	SYSLOG_MAX_SDNAME_LEN     = 32
+
+	SYSLOG_DIAL_TIMEOUT       = 5 * time.Second
+	SYSLOG_WRITE_TIMEOUT      = 10 * time.Second
+	SYSLOG_RETRY_INTERVAL     = 2 * time.Second
+)
+
+// syslog output structure
+type kSyslogOutput struct {
+	name           string
+	facility       int
+	severity       int
+	appName        string
+	sdID           string
+	tlsConfig      *tls.Config
+	dests          []*kSyslogDest
+	stop           chan struct{}
+	wg             sync.WaitGroup
+}
+
+// syslog destination which has its own queue and connection
+type kSyslogDest struct {
+	out            *kSyslogOutput
+	proto          string
+	addr           string
+	queue          chan *kEvent
+	conn           net.Conn
+
+	kOutputCounters
+}
+
+// create syslog output
+func NewSyslogOutput(cfg kSyslogOutputConfig) (*kSyslogOutput, error) {
+	out := &kSyslogOutput{
+		name:           cfg.Name,
+		facility:       KAOHI_DEFAULT_SYSLOG_FACILITY,
+		severity:       KAOHI_DEFAULT_SYSLOG_SEVERITY,
+		appName:        cfg.AppName,
+		sdID:           cfg.SdID,
+		stop:           make(chan struct{}),
+	}
+
+	// facility and severity are pointers, since 0 is a valid value of both
+	if cfg.Facility != nil {
+		if *cfg.Facility < 0 || *cfg.Facility > 23 {
+			return nil, ErrSyslogInvalidFacility
+		}
+		out.facility = *cfg.Facility
+	}
+	if cfg.Severity != nil {
+		if *cfg.Severity < 0 || *cfg.Severity > 7 {
+			return nil, ErrSyslogInvalidSeverity
+		}
+		out.severity = *cfg.Severity
+	}
+	if out.appName == "" {
+		out.appName = KAOHI_DEFAULT_SYSLOG_APPNAME
+	}
+	if err := checkSyslogSdID(out.sdID); err != nil {
+		return nil, err
+	}
+
+	queueSize := cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = KAOHI_DEFAULT_OUTPUT_QUEUE_SIZE
+	}
+
+	if len(cfg.Destinations) == 0 {
+		return nil, ErrSyslogNoDestination
+	}
+
+	for _, dest := range cfg.Destinations {
+		u, err := url.Parse(dest)
+		if err != nil || u.Host == "" {
+			return nil, ErrSyslogInvalidDestination
+		}
+
+		switch u.Scheme {
+		case "udp", "tcp":
+		case "tls":
+			if out.tlsConfig == nil {
+				if out.tlsConfig, err = newOutputTLSConfig(cfg.TLS); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			return nil, ErrSyslogInvalidDestination
+		}
+
+		out.dests = append(out.dests, &kSyslogDest{
+			out:            out,
+			proto:          u.Scheme,
+			addr:           u.Host,
+			queue:          make(chan *kEvent, queueSize),
+		})
+	}
+
+	// start sender for each destination
+	for _, d := range out.dests {
+		out.wg.Add(1)
+		go d.run()
+	}
+
+	DEBUG_INFO("Created syslog output '%s' with %d destination(s)", out.name, len(out.dests))
+
+	return out, nil
+}
+
+func (out *kSyslogOutput) Name() string {
+	return out.name
+}
+
+func (out *kSyslogOutput) Type() string {
+	return "syslog"
+}
+
+// queue the event on every destination, the event is dropped for
+// the destinations whose queue is full
+func (out *kSyslogOutput) Write(ev *kEvent) error {
+	var err error
+
+	for _, d := range out.dests {
+		select {
+		case d.queue <- ev:
+			d.addQueued(1)
+		default:
+			d.addDropped(1)
+			err = ErrOutputQueueFull
+		}
+	}
+
+	return err
+}
+
+func (out *kSyslogOutput) Flush(timeout time.Duration) error {
+	for _, d := range out.dests {
+		if err := d.waitDrained(timeout); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (out *kSyslogOutput) Stats() kOutputStats {
+	var stats kOutputStats
+
+	for _, d := range out.dests {
+		s := d.Stats()
+		stats.Queued += s.Queued
+		stats.Sent += s.Sent
+		stats.Dropped += s.Dropped
+		stats.Failed += s.Failed
+		stats.Retries += s.Retries
+		stats.Latency = mergeHistograms(stats.Latency, s.Latency)
+		stats.Capacity += int64(cap(d.queue))
+		stats.Failing = stats.Failing || s.Failing
+	}
+
+	return stats
+}
+
+func (out *kSyslogOutput) Close() {
+	close(out.stop)
+	out.wg.Wait()
+}
+
+// sender loop of destination
+func (d *kSyslogDest) run() {
+	defer func() {
+		if d.conn != nil {
+			d.conn.Close()
+		}
+		d.out.wg.Done()
+	}()
+
+	for {
+		select {
+		case <-d.out.stop:
+			return
+
+		case ev := <-d.queue:
+			msg := d.out.format(ev)
+			start := time.Now()
+			for !d.send(msg) {
+				select {
+				case <-d.out.stop:
+					d.addFailed(1)
+					d.addQueued(-1)
+					return
+
+				case <-time.After(SYSLOG_RETRY_INTERVAL):
+					d.addRetries(1)
+				}
+			}
+			d.observeLatency(time.Since(start))
+			d.addSent(1)
+			d.addQueued(-1)
+		}
+	}
+}
+
+// connect to destination
+func (d *kSyslogDest) connect() (err error) {
+	dialer := &net.Dialer{Timeout: SYSLOG_DIAL_TIMEOUT}
+
+	switch d.proto {
+	case "udp":
+		d.conn, err = dialer.Dial("udp", d.addr)
+	case "tcp":
+		d.conn, err = dialer.Dial("tcp", d.addr)
+	case "tls":
+		d.conn, err = tls.DialWithDialer(dialer, "tcp", d.addr, d.out.tlsConfig)
+	}
+
+	return err
+}
+
+// send a message to destination, the message is framed with octet
+// counting (RFC 6587, RFC 5425) on stream transports
+func (d *kSyslogDest) send(msg []byte) bool {
+	if d.conn == nil {
+		if err := d.connect(); err != nil {
+			DEBUG_WARN("Could not connect to syslog destination %s://%s: %v", d.proto, d.addr, err)
+			return false
+		}
+	}
+
+	frame := msg
+	if d.proto != "udp" {
+		frame = append([]byte(strconv.Itoa(len(msg)) + " "), msg...)
+	}
+
+	d.conn.SetWriteDeadline(time.Now().Add(SYSLOG_WRITE_TIMEOUT))
+	if _, err := d.conn.Write(frame); err != nil {
+		DEBUG_WARN("Could not send to syslog destination %s://%s: %v", d.proto, d.addr, err)
+		d.conn.Close()
+		d.conn = nil
+		return false
+	}
+
+	return true
+}
+
+// format event as RFC 5424 message
+func (out *kSyslogOutput) format(ev *kEvent) []byte {
+	var buf bytes.Buffer
+
+	severity := out.severity
+	if s, ok := ev.Fields["severity"]; ok {
+		if v, err := strconv.Atoi(s); err == nil && v >= 0 && v <= 7 {
+			severity = v
+		}
+	}
+
+	procID := SYSLOG_NILVALUE
+	if pid, ok := ev.Fields["pid"]; ok {
+		procID = pid
+	}
+
+	fmt.Fprintf(&buf, "<%d>%d %s %s %s %s %s ",
+		out.facility * 8 + severity,
+		SYSLOG_RFC5424_VERSION,
+		ev.Time.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		syslogHeaderField(ev.Host, SYSLOG_MAX_HOSTNAME_LEN),
+		syslogHeaderField(out.appName, SYSLOG_MAX_APPNAME_LEN),
+		syslogHeaderField(procID, SYSLOG_MAX_PROCID_LEN),
+		syslogHeaderField(ev.Group, SYSLOG_MAX_MSGID_LEN))
+
+	out.formatSD(&buf, ev)
+
+	if ev.Message != "" {
+		buf.WriteByte(' ')
+		buf.WriteString(ev.Message)
+	}
+
+	return buf.Bytes()
+}
+
+// map event source and structured fields into SD-ELEMENT, there is no
+// structured data without SD-ID
+func (out *kSyslogOutput) formatSD(buf *bytes.Buffer, ev *kEvent) {
+	if out.sdID == "" {
+		buf.WriteString(SYSLOG_NILVALUE)
+		return
+	}
+
+	names := make([]string, 0, len(ev.Fields))
+	for name := range ev.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf.WriteByte('[')
+	buf.WriteString(syslogSDName(out.sdID))
+	if ev.Source != "" {
+		buf.WriteString(" source=\"")
+		buf.WriteString(syslogSDValue(ev.Source))
+		buf.WriteByte('"')
+	}
+	for _, name := range names {
+		sdName := syslogSDName(name)
+		if sdName == SYSLOG_NILVALUE {
+			continue
+		}
+		buf.WriteByte(' ')
+		buf.WriteString(sdName)
+		buf.WriteString("=\"")
+		buf.WriteString(syslogSDValue(ev.Fields[name]))
+		buf.WriteByte('"')
+	}
+	buf.WriteByte(']')
+}
+
+// check SD-ID, the fields are custom parameters so it must be in the form
+// name@<private enterprise number> of RFC 5424, or empty
+func checkSyslogSdID(id string) error {
+	if id == "" {
+		return nil
+	}
+
+	at := strings.IndexByte(id, '@')
+	if at <= 0 || len(id) > SYSLOG_MAX_SDNAME_LEN || syslogSDName(id) != id {
+		return ErrSyslogInvalidSdID
+	}
+
+	pen := id[at + 1:]
+	for _, part := range strings.Split(pen, ".") {
+		if part == "" || strings.Trim(part, "0123456789") != "" {
+			return ErrSyslogInvalidSdID
+		}
+	}
+
+	return nil
+}
+
+// header fields are printable US-ASCII without spaces
+func syslogHeaderField(value string, maxLen int) string {
+	b := make([]byte, 0, len(value))
+	for i := 0; i < len(value) && len(b) < maxLen; i++ {
+		if value[i] > 32 && value[i] < 127 {
+			b = append(b, value[i])
+		}
+	}
+
+	if len(b) == 0 {
+		return SYSLOG_NILVALUE
+	}
+	return string(b)
+}
+
+// SD-NAME is printable US-ASCII except '=', ' ', ']' and '"'
+func syslogSDName(name string) string {
+	b := make([]byte, 0, len(name))
+	for i := 0; i < len(name) && len(b) < SYSLOG_MAX_SDNAME_LEN; i++ {
+		c := name[i]
+		if c > 32 && c < 127 && c != '=' && c != ']' && c != '"' {
+			b = append(b, c)
+		}
+	}
+
+	if len(b) == 0 {
+		return SYSLOG_NILVALUE
+	}
+	return string(b)
+}
+
+// escape '"', '\' and ']' in PARAM-VALUE
+func syslogSDValue(value string) string {
+	var buf bytes.Buffer
+
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '"', '\\', ']':
+			buf.WriteByte('\\')
+		}
+		buf.WriteByte(value[i])
+	}
+
+	return buf.String()
+}
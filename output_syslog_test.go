@@ -0,0 +1,203 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSyslogEvent(fields map[string]string) *kEvent {
+	ev := NewKaohiEvent("nginx", "/var/log/nginx/access.log", "GET /index.html")
+	ev.Time = time.Date(2023, 10, 6, 0, 17, 9, 669794000, time.UTC)
+	ev.Host = "web1"
+	for name, value := range fields {
+		ev.SetField(name, value)
+	}
+
+	return ev
+}
+
+func TestSyslogFormatRFC5424(t *testing.T) {
+	const ts = "2023-10-06T00:17:09.669794Z"
+
+	for _, c := range []struct {
+		name     string
+		out      *kSyslogOutput
+		fields   map[string]string
+		edit     func(ev *kEvent)
+		expected string
+	}{
+		{
+			name:     "defaults",
+			out:      &kSyslogOutput{facility: 1, severity: 5, appName: "kaohi", sdID: "kaohi@32473"},
+			expected: `<13>1 ` + ts + ` web1 kaohi - nginx [kaohi@32473 source="/var/log/nginx/access.log"] GET /index.html`,
+		},
+		{
+			name:     "facility and severity 0",
+			out:      &kSyslogOutput{facility: 0, severity: 0, appName: "kaohi", sdID: "kaohi@32473"},
+			expected: `<0>1 ` + ts + ` web1 kaohi - nginx [kaohi@32473 source="/var/log/nginx/access.log"] GET /index.html`,
+		},
+		{
+			name:     "severity and pid of fields",
+			out:      &kSyslogOutput{facility: 4, severity: 5, appName: "kaohi", sdID: "kaohi@32473"},
+			fields:   map[string]string{"severity": "3", "pid": "1234", "user": "alice"},
+			expected: `<35>1 ` + ts + ` web1 kaohi 1234 nginx [kaohi@32473 source="/var/log/nginx/access.log" pid="1234" severity="3" user="alice"] GET /index.html`,
+		},
+		{
+			name:     "invalid severity of field",
+			out:      &kSyslogOutput{facility: 1, severity: 5, appName: "kaohi"},
+			fields:   map[string]string{"severity": "9"},
+			expected: `<13>1 ` + ts + ` web1 kaohi - nginx - GET /index.html`,
+		},
+		{
+			name:     "no SD-ID",
+			out:      &kSyslogOutput{facility: 1, severity: 5, appName: "kaohi"},
+			fields:   map[string]string{"user": "alice"},
+			expected: `<13>1 ` + ts + ` web1 kaohi - nginx - GET /index.html`,
+		},
+		{
+			name:     "header fields without spaces",
+			out:      &kSyslogOutput{facility: 1, severity: 5, appName: "my app", sdID: "kaohi@32473"},
+			edit:     func(ev *kEvent) { ev.Host = "web 1" },
+			expected: `<13>1 ` + ts + ` web1 myapp - nginx [kaohi@32473 source="/var/log/nginx/access.log"] GET /index.html`,
+		},
+		{
+			name:     "empty host and message",
+			out:      &kSyslogOutput{facility: 1, severity: 5, appName: "kaohi"},
+			edit:     func(ev *kEvent) { ev.Host, ev.Message = " ", "" },
+			expected: `<13>1 ` + ts + ` - kaohi - nginx -`,
+		},
+	} {
+		ev := newTestSyslogEvent(c.fields)
+		if c.edit != nil {
+			c.edit(ev)
+		}
+
+		if msg := string(c.out.format(ev)); msg != c.expected {
+			t.Errorf("%s:\n got %s\nwant %s", c.name, msg, c.expected)
+		}
+	}
+}
+
+func TestSyslogSDEscaping(t *testing.T) {
+	for _, c := range []struct {
+		value, expected string
+	}{
+		{`plain value`, `plain value`},
+		{`say "hi"`, `say \"hi\"`},
+		{`C:\temp`, `C:\\temp`},
+		{`[x=y]`, `[x=y\]`},
+		{`\"]`, `\\\"\]`},
+		{``, ``},
+	} {
+		if v := syslogSDValue(c.value); v != c.expected {
+			t.Errorf("%q escaped to %q, expected %q", c.value, v, c.expected)
+		}
+	}
+
+	for _, c := range []struct {
+		name, expected string
+	}{
+		{"user", "user"},
+		{"user name", "username"},
+		{"a=b", "ab"},
+		{`"]`, SYSLOG_NILVALUE},
+		{"ünicode", "nicode"},
+		{strings.Repeat("n", 40), strings.Repeat("n", SYSLOG_MAX_SDNAME_LEN)},
+	} {
+		if n := syslogSDName(c.name); n != c.expected {
+			t.Errorf("%q sanitized to %q, expected %q", c.name, n, c.expected)
+		}
+	}
+
+	// fields whose name is empty after sanitizing are skipped
+	out := kSyslogOutput{facility: 1, severity: 5, appName: "kaohi", sdID: "kaohi@32473"}
+	msg := string(out.format(newTestSyslogEvent(map[string]string{"=": "x", "path": `a]b`})))
+	if !strings.Contains(msg, `[kaohi@32473 source="/var/log/nginx/access.log" path="a\]b"]`) {
+		t.Fatalf("unexpected message %s", msg)
+	}
+}
+
+func TestSyslogSdID(t *testing.T) {
+	for _, c := range []struct {
+		id    string
+		valid bool
+	}{
+		{"", true},
+		{"kaohi@32473", true},
+		{"kaohi@32473.1.2", true},
+		{"kaohi", false},
+		{"@32473", false},
+		{"kaohi@", false},
+		{"kaohi@pen", false},
+		{"kaohi@1..2", false},
+		{"ka hi@32473", false},
+		{"ka=hi@32473", false},
+		{strings.Repeat("k", 30) + "@32473", false},
+	} {
+		if err := checkSyslogSdID(c.id); (err == nil) != c.valid {
+			t.Errorf("%q: %v", c.id, err)
+		}
+	}
+
+	if _, err := NewSyslogOutput(kSyslogOutputConfig{Name: "siem", Destinations: []string{"udp://127.0.0.1:514"}, SdID: "kaohi"}); err != ErrSyslogInvalidSdID {
+		t.Fatalf("invalid SD-ID was accepted: %v", err)
+	}
+}
+
+func TestSyslogFraming(t *testing.T) {
+	msg := []byte("<13>1 - - - - - - hello")
+
+	for _, c := range []struct {
+		proto, expected string
+	}{
+		{"tcp", "23 <13>1 - - - - - - hello"},
+		{"tls", "23 <13>1 - - - - - - hello"},
+		{"udp", "<13>1 - - - - - - hello"},
+	} {
+		a, b := net.Pipe()
+		d := &kSyslogDest{proto: c.proto, addr: "pipe", conn: a}
+
+		sent := make(chan bool, 1)
+		go func() {
+			sent <- d.send(msg)
+			a.Close()
+		}()
+
+		frame, err := ioutil.ReadAll(b)
+		b.Close()
+		if err != nil || !<-sent {
+			t.Fatalf("%s: send failed: %v", c.proto, err)
+		}
+		if string(frame) != c.expected {
+			t.Errorf("%s: framed as %q, expected %q", c.proto, frame, c.expected)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// linux capabilities which Kaohi may need
+const (
+	CAP_DAC_READ_SEARCH           = 2
+	CAP_SETGID                    = 6
+	CAP_SETUID                    = 7
+	CAP_NET_BIND_SERVICE          = 10
+)
+
+var kCapNames = map[uint]string{
+	CAP_DAC_READ_SEARCH:          "CAP_DAC_READ_SEARCH",
+	CAP_SETGID:                   "CAP_SETGID",
+	CAP_SETUID:                   "CAP_SETUID",
+	CAP_NET_BIND_SERVICE:         "CAP_NET_BIND_SERVICE",
+}
+
+// privileged ports are below this one
+const KAOHI_PRIVILEGED_PORT = 1024
+
+// capability needed by configuration and the option which needs it
+type kCapNeed struct {
+	cap            uint
+	reason         string
+}
+
+// set of capabilities as bit mask
+type kCapSet uint64
+
+func (s kCapSet) Has(cap uint) bool {
+	return s & (1 << cap) != 0
+}
+
+func (s *kCapSet) Add(cap uint) {
+	*s |= 1 << cap
+}
+
+// check whether the process can access path with mode bits without any
+// capability, which is the case for root only by ownership
+func accessibleWithoutCaps(path string, bit os.FileMode) bool {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return true
+	}
+
+	mode := fi.Mode().Perm()
+	if int(st.Uid) == os.Geteuid() {
+		return mode & (bit << 6) != 0
+	}
+
+	groups, _ := os.Getgroups()
+	groups = append(groups, os.Getegid())
+	for _, gid := range groups {
+		if uint32(gid) == st.Gid {
+			return mode & (bit << 3) != 0
+		}
+	}
+
+	return mode & bit != 0
+}
+
+// check whether a file can be read without CAP_DAC_READ_SEARCH, every parent
+// directory must be searchable too; missing files are checked by the
+// deepest existing directory
+func readableWithoutCaps(path string) bool {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return true
+	}
+
+	if _, err := os.Stat(path); err == nil && !accessibleWithoutCaps(path, 04) {
+		return false
+	}
+
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(dir); err == nil && !accessibleWithoutCaps(dir, 01) {
+			return false
+		}
+		if dir == filepath.Dir(dir) {
+			return true
+		}
+	}
+}
+
+// check whether a TCP listen address has privileged port
+func isPrivilegedAddr(addr string) bool {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+
+	n, err := net.LookupPort("tcp", port)
+	return err == nil && n > 0 && n < KAOHI_PRIVILEGED_PORT
+}
+
+// work out capabilities which configuration needs
+func requiredCapabilities(config *kConfigScheme) []kCapNeed {
+	var needs []kCapNeed
+
+	for _, cfg := range config.GetConfigFiles() {
+		for _, file := range cfg.Files {
+			if !readableWithoutCaps(file) {
+				needs = append(needs, kCapNeed{CAP_DAC_READ_SEARCH,
+					fmt.Sprintf("config-files %q: %s is not readable", cfg.Name, file)})
+			}
+		}
+	}
+
+	for _, cfg := range config.GetContainers() {
+		cfg = containersConfigDefaults(cfg)
+		for _, dir := range []string{cfg.ContainersDir, cfg.PodsDir} {
+			if _, err := os.Stat(dir); err == nil && (!readableWithoutCaps(dir) || !accessibleWithoutCaps(dir, 04)) {
+				needs = append(needs, kCapNeed{CAP_DAC_READ_SEARCH,
+					fmt.Sprintf("containers %q: %s is not readable", cfg.Name, dir)})
+			}
+		}
+		for path := range discoverContainerLogs(cfg) {
+			if !readableWithoutCaps(path) {
+				needs = append(needs, kCapNeed{CAP_DAC_READ_SEARCH,
+					fmt.Sprintf("containers %q: %s is not readable", cfg.Name, path)})
+				break
+			}
+		}
+	}
+
+	for _, cfg := range config.GetAudits() {
+		if file := auditConfigDefaults(cfg).File; !readableWithoutCaps(file) {
+			needs = append(needs, kCapNeed{CAP_DAC_READ_SEARCH,
+				fmt.Sprintf("audit %q: %s is not readable", cfg.Name, file)})
+		}
+	}
+
+	cmdListener := config.GetCmdListener()
+	if (config.GetListenAddr() != "" || cmdListener.UnixSocket == "") && isPrivilegedAddr(config.GetListenAddr()) {
+		needs = append(needs, kCapNeed{CAP_NET_BIND_SERVICE,
+			fmt.Sprintf("global.listen_address %s", config.GetListenAddr())})
+	}
+	if addr := config.GetMetrics().ListenAddr; addr != "" && isPrivilegedAddr(addr) {
+		needs = append(needs, kCapNeed{CAP_NET_BIND_SERVICE, fmt.Sprintf("metrics.listen_address %s", addr)})
+	}
+
+	for _, cfg := range config.GetCommands() {
+		if cfg.Uid != os.Geteuid() {
+			reason := fmt.Sprintf("commands %q: runs as uid %d", cfg.Name, cfg.Uid)
+			needs = append(needs, kCapNeed{CAP_SETUID, reason}, kCapNeed{CAP_SETGID, reason})
+		}
+	}
+
+	return needs
+}
+
+// check that the process has capabilities which configuration needs,
+// returns the set which has to be kept after startup
+func checkPrivileges(config *kConfigScheme) (kCapSet, error) {
+	effective, err := getCapabilities()
+	if err != nil {
+		return 0, err
+	}
+
+	var keep kCapSet
+	var missing []string
+	for _, need := range requiredCapabilities(config) {
+		keep.Add(need.cap)
+		if !effective.Has(need.cap) {
+			missing = append(missing, kCapNames[need.cap] + " (" + need.reason + ")")
+		}
+	}
+
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return keep, fmt.Errorf("%v: %s", ErrMissingCapabilities, strings.Join(missing, ", "))
+	}
+
+	return keep, nil
+}
+
+// names of capabilities in set
+func (s kCapSet) String() string {
+	var names []string
+	for cap := uint(0); cap < 64; cap++ {
+		if !s.Has(cap) {
+			continue
+		}
+		if name, ok := kCapNames[cap]; ok {
+			names = append(names, name)
+		} else {
+			names = append(names, "cap_" + strconv.Itoa(int(cap)))
+		}
+	}
+
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,160 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// systemd notification state, all notifications are no-op if Kaohi wasn't
+// started by systemd with NOTIFY_SOCKET
+var kNotify struct {
+	mu             sync.Mutex
+	stopping       int32
+	stop           chan struct{}
+	wg             sync.WaitGroup
+}
+
+// send state to systemd, returns false if notification socket isn't set
+func sdNotify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+
+	// abstract socket
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// get watchdog interval of systemd, zero if watchdog isn't enabled for
+// this process
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
+
+// notify systemd that Kaohi is ready and start pinging watchdog
+func NotifyReady() {
+	if _, err := sdNotify("READY=1\nSTATUS=Collecting events\nMAINPID=" + strconv.Itoa(os.Getpid())); err != nil {
+		DEBUG_WARN("Could not notify systemd: %v", err)
+	}
+
+	interval := sdWatchdogInterval()
+	if interval == 0 {
+		return
+	}
+
+	kNotify.mu.Lock()
+	defer kNotify.mu.Unlock()
+
+	if kNotify.stop != nil {
+		return
+	}
+
+	DEBUG_INFO("Pinging systemd watchdog every %s", interval / 2)
+
+	kNotify.stop = make(chan struct{})
+	kNotify.wg.Add(1)
+	go runWatchdog(interval / 2, kNotify.stop)
+}
+
+// ping watchdog while watcher loop is ticking, so systemd restarts Kaohi
+// if it hangs; during shutdown the watcher is gone and ping is unconditional
+func runWatchdog(interval time.Duration, stop chan struct{}) {
+	defer kNotify.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+
+		case <-ticker.C:
+			if atomic.LoadInt32(&kNotify.stopping) == 0 && watcherHealth().Status != HEALTH_STATUS_OK {
+				DEBUG_WARN("Watcher loop isn't ticking, skipping watchdog ping")
+				continue
+			}
+			sdNotify("WATCHDOG=1")
+		}
+	}
+}
+
+// notify systemd that configuration is being reloaded
+func NotifyReloading() {
+	sdNotify("RELOADING=1")
+}
+
+// notify systemd that reloading has finished
+func NotifyReloaded() {
+	sdNotify("READY=1")
+}
+
+// notify systemd that Kaohi is stopping
+func NotifyStopping() {
+	atomic.StoreInt32(&kNotify.stopping, 1)
+	sdNotify("STOPPING=1\nSTATUS=Delivering queued events")
+}
+
+// stop pinging watchdog
+func FinalizeNotify() {
+	kNotify.mu.Lock()
+	defer kNotify.mu.Unlock()
+
+	if kNotify.stop != nil {
+		close(kNotify.stop)
+		kNotify.wg.Wait()
+		kNotify.stop = nil
+	}
+}
@@ -0,0 +1,288 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// service subcommands
+const (
+	SERVICE_CMD_INSTALL           = "install"
+	SERVICE_CMD_UNINSTALL         = "uninstall"
+	SERVICE_CMD_START             = "start"
+	SERVICE_CMD_STOP              = "stop"
+	SERVICE_CMD_STATUS            = "status"
+)
+
+// systemd unit of Kaohi, the daemon notifies readiness and pings watchdog
+const kServiceUnitTemplate = `[Unit]
+Description=Kaohi log collector
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=notify
+NotifyAccess=main
+ExecStart={{.Exec}} --config {{.Config}}
+ExecReload=/bin/kill -HUP $MAINPID
+WatchdogSec={{.Watchdog}}
+TimeoutStopSec={{.StopTimeout}}
+Restart=on-failure
+
+[Install]
+WantedBy=multi-user.target
+`
+
+type kServiceUnit struct {
+	Exec           string
+	Config         string
+	Watchdog       int
+	StopTimeout    int
+}
+
+// check whether the argument is a service subcommand
+func IsServiceCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+
+	switch args[0] {
+	case SERVICE_CMD_INSTALL, SERVICE_CMD_UNINSTALL, SERVICE_CMD_START, SERVICE_CMD_STOP, SERVICE_CMD_STATUS:
+		return true
+	}
+
+	return false
+}
+
+// path of systemd unit file
+func serviceUnitPath() string {
+	return filepath.Join(KAOHI_SERVICE_UNIT_DIR, KAOHI_SERVICE_NAME + ".service")
+}
+
+// check whether system is managed by systemd
+func checkSystemd() error {
+	if _, err := os.Stat("/run/systemd/system"); err != nil {
+		return ErrUnsupportedSystem
+	}
+	if _, err := exec.LookPath("systemctl"); err != nil {
+		return ErrUnsupportedSystem
+	}
+
+	return nil
+}
+
+func isServiceInstalled() bool {
+	_, err := os.Stat(serviceUnitPath())
+	return err == nil
+}
+
+func isServiceRunning() bool {
+	return exec.Command("systemctl", "is-active", "--quiet", KAOHI_SERVICE_NAME).Run() == nil
+}
+
+// run systemctl, its output is returned as error on failure
+func systemctl(args ...string) error {
+	output, err := exec.Command("systemctl", args...).CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(output)); msg != "" {
+			return fmt.Errorf("systemctl %s: %s", strings.Join(args, " "), msg)
+		}
+		return fmt.Errorf("systemctl %s: %v", strings.Join(args, " "), err)
+	}
+
+	return nil
+}
+
+// generate systemd unit for the configuration, stop timeout leaves time for
+// delivering queued events within shutdown timeout
+func generateServiceUnit(cfgPath string) (string, error) {
+	execPath, err := executablePath(os.Args[0])
+	if err != nil {
+		return "", err
+	}
+	if execPath, err = filepath.Abs(execPath); err != nil {
+		return "", err
+	}
+
+	if cfgPath, err = filepath.Abs(cfgPath); err != nil {
+		return "", err
+	}
+
+	// the configuration may not exist yet, defaults are used then
+	config := NewKaohiConfig()
+	shutdownTimeout := KAOHI_DEFAULT_SHUTDOWN_TIMEOUT
+	if err := config.ParseConfigFile(cfgPath); err == nil {
+		shutdownTimeout = config.GetShutdownTimeout()
+	}
+
+	unit := kServiceUnit{
+		Exec:           execPath,
+		Config:         cfgPath,
+		Watchdog:       int(KAOHI_SERVICE_WATCHDOG / time.Second),
+		StopTimeout:    int((shutdownTimeout + KAOHI_SERVICE_STOP_MARGIN) / time.Second),
+	}
+
+	var b strings.Builder
+	if err := template.Must(template.New("unit").Parse(kServiceUnitTemplate)).Execute(&b, unit); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+// install and enable systemd unit
+func installService(cfgPath string) error {
+	if isServiceInstalled() {
+		return ErrAlreadyInstalled
+	}
+
+	unit, err := generateServiceUnit(cfgPath)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(serviceUnitPath(), []byte(unit), 0644); err != nil {
+		return err
+	}
+	if err := systemctl("daemon-reload"); err != nil {
+		os.Remove(serviceUnitPath())
+		return err
+	}
+
+	return systemctl("enable", KAOHI_SERVICE_NAME)
+}
+
+// stop, disable and remove systemd unit
+func uninstallService() error {
+	if !isServiceInstalled() {
+		return ErrNotInstalled
+	}
+
+	if isServiceRunning() {
+		if err := systemctl("stop", KAOHI_SERVICE_NAME); err != nil {
+			return err
+		}
+	}
+	if err := systemctl("disable", KAOHI_SERVICE_NAME); err != nil {
+		return err
+	}
+	if err := os.Remove(serviceUnitPath()); err != nil {
+		return err
+	}
+
+	return systemctl("daemon-reload")
+}
+
+func startService() error {
+	if !isServiceInstalled() {
+		return ErrNotInstalled
+	}
+	if isServiceRunning() {
+		return ErrAlreadyRunning
+	}
+
+	return systemctl("start", KAOHI_SERVICE_NAME)
+}
+
+func stopService() error {
+	if !isServiceInstalled() {
+		return ErrNotInstalled
+	}
+	if !isServiceRunning() {
+		return ErrAlreadyStopped
+	}
+
+	return systemctl("stop", KAOHI_SERVICE_NAME)
+}
+
+// print status of service, returns exit status
+func serviceStatus() int {
+	if !isServiceInstalled() {
+		fmt.Println(ErrNotInstalled)
+		return KAOHI_EXIT_FAILURE
+	}
+
+	output, err := exec.Command("systemctl", "show", "--property=MainPID", "--value", KAOHI_SERVICE_NAME).Output()
+	if err != nil || !isServiceRunning() {
+		fmt.Println("Kaohi service is stopped")
+		return KAOHI_EXIT_NOT_RUNNING
+	}
+
+	fmt.Printf("Kaohi service (pid %s) is running...\n", strings.TrimSpace(string(output)))
+	return KAOHI_EXIT_OK
+}
+
+// run service subcommand, returns exit status
+func runServiceCommand(args []string) int {
+	if err := checkSystemd(); err != nil {
+		fmt.Println(err)
+		return KAOHI_EXIT_FAILURE
+	}
+
+	if args[0] == SERVICE_CMD_STATUS {
+		return serviceStatus()
+	}
+
+	if err := checkRootPrivileges(); err != nil {
+		fmt.Println(err)
+		return KAOHI_EXIT_FAILURE
+	}
+
+	var action string
+	var err error
+
+	switch args[0] {
+	case SERVICE_CMD_INSTALL:
+		action = "Installing Kaohi service:"
+		err = installService(GetConfigPath(args[1:]))
+	case SERVICE_CMD_UNINSTALL:
+		action = "Removing Kaohi service:"
+		err = uninstallService()
+	case SERVICE_CMD_START:
+		action = "Starting Kaohi service:"
+		err = startService()
+	case SERVICE_CMD_STOP:
+		action = "Stopping Kaohi service:"
+		err = stopService()
+	}
+
+	if err != nil {
+		fmt.Println(action + failed)
+		fmt.Println("Error:", err)
+		return KAOHI_EXIT_FAILURE
+	}
+
+	fmt.Println(action + success)
+	return KAOHI_EXIT_OK
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// suffixes of spool segment files and of segments which couldn't be decoded
+const (
+	SPOOL_SEGMENT_SUFFIX          = ".spool"
+	SPOOL_CORRUPT_SUFFIX          = ".corrupt"
+)
+
+// disk spool which keeps events whose delivery failed, so they are retried
+// later and survive restarts; every batch is written into its own segment
+type kSpool struct {
+	mu             sync.Mutex
+	dir            string
+	seq            uint64
+}
+
+// spool record, attempts is the number of failed deliveries of event
+type kSpoolRecord struct {
+	Attempts       int                    `json:"attempts"`
+	Event          *kEvent                `json:"event"`
+}
+
+// create spool in directory
+func NewSpool(dir string) (*kSpool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &kSpool{dir: dir}, nil
+}
+
+// write records into new segment, the segment is renamed into place only
+// after it was written completely
+func (s *kSpool) Put(records []kSpoolRecord) error {
+	s.mu.Lock()
+	s.seq++
+	name := fmt.Sprintf("%020d-%06d", time.Now().UnixNano(), s.seq)
+	s.mu.Unlock()
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i := range records {
+		if err := enc.Encode(&records[i]); err != nil {
+			return err
+		}
+	}
+
+	tmp := filepath.Join(s.dir, name + ".tmp")
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(s.dir, name + SPOOL_SEGMENT_SUFFIX))
+}
+
+// get segments from the oldest one
+func (s *kSpool) segments() ([]os.FileInfo, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := files[:0]
+	for _, fi := range files {
+		if fi.Mode().IsRegular() && strings.HasSuffix(fi.Name(), SPOOL_SEGMENT_SUFFIX) {
+			segments = append(segments, fi)
+		}
+	}
+
+	return segments, nil
+}
+
+// read the oldest segment completely, its path is returned so that it can
+// be removed once its records were handled, path is empty if spool is empty
+// or the segment couldn't be read. A segment which can't be decoded is moved
+// aside to a ".corrupt" file and ErrSpoolCorruptSegment is returned
+func (s *kSpool) Next() (string, []kSpoolRecord, error) {
+	segments, err := s.segments()
+	if err != nil || len(segments) == 0 {
+		return "", nil, err
+	}
+
+	path := filepath.Join(s.dir, segments[0].Name())
+	records, err := readSpoolSegment(path)
+	if err == ErrSpoolCorruptSegment {
+		corrupt := strings.TrimSuffix(path, SPOOL_SEGMENT_SUFFIX) + SPOOL_CORRUPT_SUFFIX
+		if rerr := os.Rename(path, corrupt); rerr != nil {
+			return "", nil, rerr
+		}
+		DEBUG_ERR("Moved spool segment '%s' which could not be decoded to '%s'", path, corrupt)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	return path, records, nil
+}
+
+// read records of segment, ErrSpoolCorruptSegment is returned if any of
+// them can't be decoded
+func readSpoolSegment(path string) ([]kSpoolRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []kSpoolRecord
+	dec := json.NewDecoder(f)
+	for {
+		var rec kSpoolRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			if _, ok := err.(*os.PathError); ok {
+				return nil, err
+			}
+			return nil, ErrSpoolCorruptSegment
+		}
+		if rec.Event != nil {
+			records = append(records, rec)
+		}
+	}
+}
+
+// remove segment which was returned by Next
+func (s *kSpool) Remove(path string) error {
+	return os.Remove(path)
+}
+
+// get size of all segments
+func (s *kSpool) Size() int64 {
+	segments, err := s.segments()
+	if err != nil {
+		return 0
+	}
+
+	var size int64
+	for _, fi := range segments {
+		size += fi.Size()
+	}
+
+	return size
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+)
+
+// expand event template
+//
+// %{name} is replaced with the event field of the given name, and
+// %{+layout} with the event time formatted by Go time layout, e.g.
+// "kaohi-%{group}-%{+2006.01.02}". Unknown fields expand to empty string.
+func expandEventTemplate(tmpl string, ev *kEvent) string {
+	return expandTemplate(tmpl, ev, nil)
+}
+
+// expand event template into file path, path separators and "." or ".."
+// components in field values are replaced, and the path must stay in the
+// directory of the template before its first expansion
+func expandPathTemplate(tmpl string, ev *kEvent) (string, error) {
+	path := filepath.Clean(expandTemplate(tmpl, ev, escapePathValue))
+	rel, err := filepath.Rel(templateStaticDir(tmpl), path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".." + string(filepath.Separator)) {
+		return "", ErrTemplateInvalidPath
+	}
+
+	return path, nil
+}
+
+// replace path separators and "." or ".." components of field value with "_"
+func escapePathValue(value string) string {
+	parts := strings.Split(filepath.ToSlash(value), "/")
+	for i, part := range parts {
+		if part == "." || part == ".." {
+			parts[i] = strings.Repeat("_", len(part))
+		}
+	}
+
+	return strings.Join(parts, "_")
+}
+
+// directory of template before its first expansion
+func templateStaticDir(tmpl string) string {
+	if i := strings.Index(tmpl, "%{"); i >= 0 {
+		tmpl = tmpl[:i]
+	}
+
+	return filepath.Dir(tmpl)
+}
+
+// expand template, field values are passed through filter if given
+func expandTemplate(tmpl string, ev *kEvent, filter func(string) string) string {
+	var buf bytes.Buffer
+
+	for {
+		start := strings.Index(tmpl, "%{")
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(tmpl[start:], '}')
+		if end < 0 {
+			break
+		}
+		end += start
+
+		buf.WriteString(tmpl[:start])
+
+		name := tmpl[start + 2:end]
+		if strings.HasPrefix(name, "+") {
+			buf.WriteString(ev.Time.UTC().Format(name[1:]))
+		} else if value, ok := ev.GetField(name); ok {
+			if filter != nil {
+				value = filter(value)
+			}
+			buf.WriteString(value)
+		}
+
+		tmpl = tmpl[end + 1:]
+	}
+	buf.WriteString(tmpl)
+
+	return buf.String()
+}
@@ -0,0 +1,60 @@
+/*
+ * Copyright (c) 2017, [Ribose Inc](https://www.ribose.com).
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+func TestExpandPathTemplateEscapesValues(t *testing.T) {
+	for _, c := range []struct {
+		group, source, path string
+	}{
+		{"web", "nginx", "/var/log/kaohi/web/nginx.log"},
+		{"../../etc", "passwd", "/var/log/kaohi/______etc/passwd.log"},
+		{"..", ".", "/var/log/kaohi/__/_.log"},
+		{"v1..2", "a/b", "/var/log/kaohi/v1..2/a_b.log"},
+		{"", "", "/var/log/kaohi/.log"},
+	} {
+		ev := NewKaohiEvent(c.group, c.source, "message")
+		path, err := expandPathTemplate("/var/log/kaohi/%{group}/%{source}.log", ev)
+		if err != nil || path != c.path {
+			t.Errorf("%q %q expanded to %q, %v", c.group, c.source, path, err)
+		}
+	}
+}
+
+func TestExpandPathTemplateStaysInDirectory(t *testing.T) {
+	ev := NewKaohiEvent("web", "nginx", "message")
+	if _, err := expandPathTemplate("/var/log/kaohi/%{group}/../../../etc/passwd", ev); err != ErrTemplateInvalidPath {
+		t.Fatalf("path outside of directory wasn't rejected: %v", err)
+	}
+
+	// only field values in path templates are escaped
+	if s := expandEventTemplate("kaohi-%{group}", NewKaohiEvent("../x", "", "")); s != "kaohi-../x" {
+		t.Fatalf("expanded to %q", s)
+	}
+}
@@ -28,8 +28,6 @@ package main
 import (
 	"os"
 	"os/exec"
-	"strconv"
-	"strings"
 	"path/filepath"
 )
 
@@ -62,16 +60,11 @@ func getExecDirpath() (string, error) {
 }
 
 // Check root rights to use system service
-func checkPrivileges() (bool, error) {
-	if output, err := exec.Command("id", "-g").Output(); err == nil {
-		if gid, parseErr := strconv.ParseUint(strings.TrimSpace(string(output)), 10, 32); parseErr == nil {
-			if gid == 0 {
-				return true, nil
-			}
-			return false, ErrRootPriveleges
-		}
+func checkRootPrivileges() error {
+	if os.Geteuid() != 0 {
+		return ErrRootPriveleges
 	}
-	return false, ErrUnsupportedSystem
+	return nil
 }
 
 // fill array with specified character
@@ -31,6 +31,7 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -102,6 +103,8 @@ type Watcher struct {
 	files        map[string]os.FileInfo // map of files.
 	ops          map[Op]struct{}        // Op filtering.
 	maxEvents    int                    // max sent events per cycle
+
+	lastCycle    int64                  // unix nano time when last cycle finished
 }
 
 // New creates a new Watcher.
@@ -143,7 +146,7 @@ func (w *Watcher) FilterOps(ops ...Op) {
 
 // Add adds either a single file or directory to the file list.
 func (w *Watcher) AddFile(name string) (err error) {
-	DEBUG_INFO("Adding file '%s' to watcher", name)
+	DEBUG_DBG("Adding file '%s' to watcher", name)
 
 	w.mu.Lock()
 	defer w.mu.Unlock()
@@ -187,6 +190,19 @@ func (w *Watcher) RemoveFile(name string) (err error) {
 	return nil
 }
 
+// LastCycle returns the time when the last polling cycle finished.
+func (w *Watcher) LastCycle() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&w.lastCycle))
+}
+
+// FileCount returns the number of watched files.
+func (w *Watcher) FileCount() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return len(w.files)
+}
+
 // list files
 func (w *Watcher) GetInfo(name string) (os.FileInfo, error) {
 	// Make sure name exists
@@ -259,6 +275,7 @@ func (w *Watcher) Start(d time.Duration) error {
 
 	// Unblock w.Wait().
 	w.wg.Done()
+	atomic.StoreInt64(&w.lastCycle, time.Now().UnixNano())
 
 	for {
 		// done lets the inner polling cycle loop know when the
@@ -311,10 +328,21 @@ func (w *Watcher) Start(d time.Duration) error {
 			}
 		}
 
-		// Update the file's list.
+		// Update the file's list, the files which were added or removed
+		// during the cycle are kept as they are.
 		w.mu.Lock()
-		w.files = fileList
+		for path, info := range fileList {
+			if _, found := w.files[path]; !found {
+				continue
+			}
+			if info == nil {
+				delete(w.files, path)
+			} else {
+				w.files[path] = info
+			}
+		}
 		w.mu.Unlock()
+		atomic.StoreInt64(&w.lastCycle, time.Now().UnixNano())
 
 		// Sleep and then continue to the next loop iteration.
 		time.Sleep(d)
@@ -330,15 +358,21 @@ func (w *Watcher) pollEvents(files map[string]os.FileInfo, evt chan Event,
 	creates := make(map[string]os.FileInfo)
 	removes := make(map[string]os.FileInfo)
 
-	// Check for removed files.
-	for path, info := range w.files {
-		if _, found := files[path]; !found {
-			removes[path] = info
+	// Check for removed files, they have no file info.
+	for path, info := range files {
+		if info != nil {
+			continue
+		}
+		if oldInfo, found := w.files[path]; found && oldInfo != nil {
+			removes[path] = oldInfo
 		}
 	}
 
 	// Check for created files, writes and chmods.
 	for path, info := range files {
+		if info == nil {
+			continue
+		}
 		oldInfo, found := w.files[path]
 		if !found {
 			// A file was created.
@@ -351,7 +385,7 @@ func (w *Watcher) pollEvents(files map[string]os.FileInfo, evt chan Event,
 			case <-cancel:
 				return
 			case evt <- Event{Write, path, info}:
-				DEBUG_INFO("WRITE event has detected for file '%s'", path)
+				DEBUG_DBG("WRITE event has detected for file '%s'", path)
 				break
 			}
 		}
@@ -361,7 +395,7 @@ func (w *Watcher) pollEvents(files map[string]os.FileInfo, evt chan Event,
 			case <-cancel:
 				return
 			case evt <- Event{Chmod, path, info}:
-				DEBUG_INFO("CHMOD event has detected for file '%s'", path)
+				DEBUG_DBG("CHMOD event has detected for file '%s'", path)
 				break
 			}
 		}
@@ -373,7 +407,7 @@ func (w *Watcher) pollEvents(files map[string]os.FileInfo, evt chan Event,
 		case <-cancel:
 			return
 		case evt <- Event{Create, path, info}:
-			DEBUG_INFO("CREATE event has detected for file '%s'", path)
+			DEBUG_DBG("CREATE event has detected for file '%s'", path)
 			break
 		}
 	}
@@ -382,7 +416,7 @@ func (w *Watcher) pollEvents(files map[string]os.FileInfo, evt chan Event,
 		case <-cancel:
 			return
 		case evt <- Event{Remove, path, info}:
-			DEBUG_INFO("REMOVE event has detected for file '%s'", path)
+			DEBUG_DBG("REMOVE event has detected for file '%s'", path)
 			break
 		}
 	}